@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"miny/miny/ymp"
+)
+
+// Modes that the batch command can run on each input file.
+var batchModes = []string{"pack", "small", "quick", "simple", "delta"}
+
+// File extensions treated as tunes when walking the input directory.
+var batchInputExts = []string{".ym", ".vgm", ".vgz", ".psg", ".sndh", ".snd", ".pt3"}
+
+// Extensions of packed output, by output format.
+var formatExts = map[string]string{"bin": ".ymp", "vasm": ".s", "gas": ".s", "c": ".h"}
+
+// Options for the "batch" command.
+type BatchConfig struct {
+	modes       []string
+	summaryPath string // .csv or .json, default <outdir>/summary.csv
+	force       bool   // repack files that are up to date
+	cacheSize   int    // overall cache size for the "pack" mode
+	uc          UserConfig
+}
+
+// Result of running one mode on one input file.
+type BatchResult struct {
+	Input      string `json:"input"`
+	Mode       string `json:"mode"`
+	Output     string `json:"output"`
+	Status     string `json:"status"` // "packed", "up to date" or "failed"
+	InputSize  int    `json:"inputSize"`
+	OutputSize int    `json:"outputSize"`
+	CacheSize  int    `json:"cacheSize"` // player cache RAM, for .ymp output
+	TotalRAM   int    `json:"totalRam"`
+	Settings   string `json:"settings"` // options the output was made with, see batchSettings
+	Error      string `json:"error,omitempty"`
+}
+
+// Parse a comma-separated list of batch modes.
+func ParseBatchModes(list string) ([]string, error) {
+	var modes []string
+	for _, mode := range strings.Split(list, ",") {
+		mode = strings.TrimSpace(mode)
+		found := false
+		for _, m := range batchModes {
+			found = found || m == mode
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown batch mode '%s' (use %s)", mode, strings.Join(batchModes, ","))
+		}
+		modes = append(modes, mode)
+	}
+	return modes, nil
+}
+
+func isBatchInput(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range batchInputExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Output filename for a mode, following the naming used by tests.sh.
+func batchOutputPath(outDir string, relPath string, mode string, format string) string {
+	var suffix string
+	switch mode {
+	case "simple":
+		suffix = ".yu"
+	case "delta":
+		suffix = ".yd"
+	default:
+		suffix = "." + mode + formatExts[format]
+	}
+	return filepath.Join(outDir, relPath+suffix)
+}
+
+// Describes the options that change the output of a mode, so that a
+// batch run with different options rebuilds it.
+func batchSettings(mode string, bc *BatchConfig) string {
+	if mode == "simple" || mode == "delta" {
+		return mode
+	}
+	uc := &bc.uc
+	settings := fmt.Sprintf("%s encoder=%d format=%s label=%s target=%s padding=%t retune=%t "+
+		"clock=%s:%s rate=%d:%d multispeed=%t load=%d:%d:%d",
+		mode, uc.encoder, uc.format, uc.label, uc.target, uc.padding, uc.retune,
+		uc.clockFrom, uc.clockTo, uc.rateFrom, uc.rateTo, uc.multiSpeed,
+		uc.load.LogRate, uc.load.Subtune, uc.load.Seconds)
+	if mode == "pack" {
+		settings += fmt.Sprintf(" cachesize=%d", bc.cacheSize)
+	}
+	return settings
+}
+
+// Returns true if the output exists and is newer than the input.
+func isUpToDate(inputPath string, outputPath string) bool {
+	in, err := os.Stat(inputPath)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(outputPath)
+	if err != nil {
+		return false
+	}
+	return !out.ModTime().Before(in.ModTime())
+}
+
+// Run a single pack mode. Panics are turned into errors, so that one
+// bad file doesn't stop the batch.
+func runBatchMode(ctx context.Context, mode string, inputPath string, outputPath string, bc *BatchConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	switch mode {
+	case "pack":
+		cfg := FilePackConfig{uc: bc.uc}
+		cfg.cacheSizes = FilledSlice(ymp.NumStreams, bc.cacheSize/ymp.NumStreams)
+		return CommandCustom(inputPath, outputPath, cfg)
+	case "small":
+		return CommandSmall(ctx, inputPath, outputPath, bc.uc)
+	case "quick":
+		return CommandQuick(ctx, inputPath, outputPath, bc.uc)
+	case "simple":
+		return CommandSimple(inputPath, outputPath, bc.uc.output())
+	case "delta":
+		return CommandDelta(inputPath, outputPath, bc.uc.output())
+	}
+	return fmt.Errorf("unknown batch mode '%s'", mode)
+}
+
+// Fill in the sizes of an output file. The cache size is read back
+// from the header of binary .ymp files, or the equates in source output.
+// The total RAM is the packed data without any -padding, plus the cache.
+func (res *BatchResult) readSizes(outputPath string) {
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return
+	}
+	res.OutputSize = len(data)
+	res.TotalRAM = res.OutputSize
+	if hdr, err := ymp.ParseYmpHeader(data); err == nil {
+		res.CacheSize = hdr.CacheSize
+		if _, end, err := ymp.DecodeYmp(data, nil); err == nil {
+			res.TotalRAM = end
+		}
+		res.TotalRAM += hdr.CacheSize
+	} else if size, cacheSize, ok := readSourceSizes(data); ok {
+		res.CacheSize = cacheSize
+		res.TotalRAM = size + cacheSize
+	}
+}
+
+// Pack every supported file under inDir with each of the modes,
+// writing the outputs to the same relative paths under outDir.
+// Files that fail are recorded in the summary and the batch carries on.
+// Stops early if the context is cancelled, after writing the summary
+// for the files done so far.
+func CommandBatch(ctx context.Context, inDir string, outDir string, bc BatchConfig) error {
+	if err := CheckOutputFormat(bc.uc.format, bc.uc.label); err != nil {
+		return err
+	}
+	// Per-file JSON reports would be mixed into the batch output
+	bc.uc.report = reportText
+	if bc.summaryPath == "" {
+		bc.summaryPath = filepath.Join(outDir, "summary.csv")
+	}
+
+	var inputs []string
+	err := filepath.WalkDir(inDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isBatchInput(path) {
+			inputs = append(inputs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	// The output of the individual commands goes to a log file
+	logFile, err := os.Create(filepath.Join(outDir, "batch.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	stdout := bc.uc.output()
+	bc.uc.out = logFile
+
+	// The settings of the last run, to rebuild outputs made differently.
+	// Without a summary, nothing is known to be up to date.
+	lastSettings := make(map[string]string)
+	if last, err := ReadBatchSummary(bc.summaryPath); err == nil {
+		for _, res := range last {
+			if res.Status != "failed" {
+				lastSettings[res.Input+"\x00"+res.Mode] = res.Settings
+			}
+		}
+	}
+
+	var results []BatchResult
+	numFailed := 0
+	for _, inputPath := range inputs {
+		relPath, err := filepath.Rel(inDir, inputPath)
+		if err != nil {
+			return err
+		}
+		inputSize := 0
+		if info, err := os.Stat(inputPath); err == nil {
+			inputSize = int(info.Size())
+		}
+		for _, mode := range bc.modes {
+			if ctx.Err() != nil {
+				break
+			}
+			outputPath := batchOutputPath(outDir, relPath, mode, bc.uc.format)
+			res := BatchResult{Input: relPath, Mode: mode, Output: outputPath, InputSize: inputSize,
+				Settings: batchSettings(mode, &bc)}
+			last, ok := lastSettings[relPath+"\x00"+mode]
+			if !bc.force && ok && last == res.Settings && isUpToDate(inputPath, outputPath) {
+				res.Status = "up to date"
+			} else {
+				fmt.Fprintf(logFile, "---- %s (%s) ----\n", relPath, mode)
+				err := os.MkdirAll(filepath.Dir(outputPath), 0755)
+				if err == nil {
+					err = runBatchMode(ctx, mode, inputPath, outputPath, &bc)
+				}
+				if ctx.Err() != nil {
+					// Interrupted, rather than a bad file
+					os.Remove(outputPath)
+					break
+				}
+				if err != nil {
+					res.Status = "failed"
+					res.Error = err.Error()
+					numFailed++
+					// Don't leave a partial file that looks up to date
+					os.Remove(outputPath)
+					fmt.Fprintf(logFile, "Error: %v\n", err)
+				} else {
+					res.Status = "packed"
+				}
+			}
+			if res.Status != "failed" {
+				res.readSizes(outputPath)
+			}
+			fmt.Fprintf(stdout, "%-40s %-7s %-10s %7d", relPath, mode, res.Status, res.OutputSize)
+			if res.Error != "" {
+				fmt.Fprintf(stdout, " %s", res.Error)
+			}
+			fmt.Fprintln(stdout)
+			results = append(results, res)
+		}
+	}
+
+	if err := WriteBatchSummary(bc.summaryPath, results); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d files, %d results, %d failed. Summary in %s\n",
+		len(inputs), len(results), numFailed, bc.summaryPath)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if numFailed != 0 {
+		return fmt.Errorf("%d of %d packs failed", numFailed, len(results))
+	}
+	return nil
+}
+
+// Columns of the CSV summary, in the order of the BatchResult fields.
+var summaryColumns = []string{"input", "mode", "output", "status", "input_size", "output_size",
+	"cache_size", "total_ram", "settings", "error"}
+
+// Write the batch results as CSV, or JSON if the path ends in .json.
+func WriteBatchSummary(path string, results []BatchResult) error {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		if results == nil {
+			results = []BatchResult{}
+		}
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(data, '\n'), 0644)
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(fh)
+	w.Write(summaryColumns)
+	for _, res := range results {
+		w.Write([]string{res.Input, res.Mode, res.Output, res.Status,
+			strconv.Itoa(res.InputSize), strconv.Itoa(res.OutputSize),
+			strconv.Itoa(res.CacheSize), strconv.Itoa(res.TotalRAM), res.Settings, res.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// Read back a summary written by WriteBatchSummary. Older CSV files
+// without some of the columns leave those fields empty.
+func ReadBatchSummary(path string) ([]BatchResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []BatchResult
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &results)
+		return results, err
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: empty summary", path)
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		number := func(name string) int {
+			val, _ := strconv.Atoi(field(name))
+			return val
+		}
+		results = append(results, BatchResult{
+			Input:      field("input"),
+			Mode:       field("mode"),
+			Output:     field("output"),
+			Status:     field("status"),
+			InputSize:  number("input_size"),
+			OutputSize: number("output_size"),
+			CacheSize:  number("cache_size"),
+			TotalRAM:   number("total_ram"),
+			Settings:   field("settings"),
+			Error:      field("error"),
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"miny/miny/ymp"
+)
+
+var channelNames = [3]string{"A", "B", "C"}
+
+// Error statistics for a single channel, in 16-bit PCM units.
+type ChannelError struct {
+	peak     float64
+	sumSq    float64
+	rms      float64
+	nSamples int
+}
+
+func (ce *ChannelError) add(diff float64) {
+	diff = math.Abs(diff)
+	if diff > ce.peak {
+		ce.peak = diff
+	}
+	ce.sumSq += diff * diff
+	ce.nSamples++
+}
+
+func (ce *ChannelError) finish() {
+	if ce.nSamples != 0 {
+		ce.rms = math.Sqrt(ce.sumSq / float64(ce.nSamples))
+	}
+}
+
+// A frame where the two tunes differ.
+type FrameDiff struct {
+	frame    int
+	channels [3]ChannelError
+	regs     []int // registers that differ, for register comparisons
+}
+
+// The result of comparing two tunes.
+type CompareResult struct {
+	numFrames  int // frames compared
+	lengthDiff bool
+	channels   [3]ChannelError // over the whole tune
+	diffs      []FrameDiff
+}
+
+func (cr *CompareResult) Passed() bool {
+	return !cr.lengthDiff && len(cr.diffs) == 0
+}
+
+// Compare the output of two renders, frame by frame.
+// A frame differs if any sample on any channel differs by more than
+// "tolerance" 16-bit PCM units.
+func CompareAudio(a *ymp.RenderedAudio, b *ymp.RenderedAudio, tolerance float64) *CompareResult {
+	var cr CompareResult
+	numFrames := len(a.FrameOffsets)
+	if len(b.FrameOffsets) != numFrames {
+		cr.lengthDiff = true
+		if len(b.FrameOffsets) < numFrames {
+			numFrames = len(b.FrameOffsets)
+		}
+	}
+	cr.numFrames = numFrames
+
+	frameEnd := func(audio *ymp.RenderedAudio, frame int) int {
+		if frame+1 < len(audio.FrameOffsets) {
+			return audio.FrameOffsets[frame+1]
+		}
+		return len(audio.Channels[0])
+	}
+
+	for frame := 0; frame < numFrames; frame++ {
+		startA := a.FrameOffsets[frame]
+		startB := b.FrameOffsets[frame]
+		count := frameEnd(a, frame) - startA
+		if frameEnd(b, frame)-startB < count {
+			count = frameEnd(b, frame) - startB
+		}
+
+		var fd FrameDiff
+		fd.frame = frame
+		differs := false
+		for ch := 0; ch < 3; ch++ {
+			for i := 0; i < count; i++ {
+				diff := 32767.0 * float64(a.Channels[ch][startA+i]-b.Channels[ch][startB+i])
+				fd.channels[ch].add(diff)
+				cr.channels[ch].add(diff)
+			}
+			fd.channels[ch].finish()
+			if fd.channels[ch].peak > tolerance {
+				differs = true
+			}
+		}
+		if differs {
+			cr.diffs = append(cr.diffs, fd)
+		}
+	}
+	for ch := 0; ch < 3; ch++ {
+		cr.channels[ch].finish()
+	}
+	return &cr
+}
+
+// Create a copy of the register data with every bit which cannot
+// affect the sound cleared, so that two tunes which sound the same
+// have the same register values.
+// This works frame-by-frame, so it ignores e.g. tone periods of silent
+// channels, even though they shift the phase of later notes slightly.
+func CanonicalRegisters(rawRegs *ymp.RawRegisters) *ymp.RawRegisters {
+	var canon ymp.RawRegisters
+	numFrames := len(rawRegs.Data[0])
+	for reg := 0; reg < ymp.NumYmRegs; reg++ {
+		canon.Data[reg] = make([]byte, numFrames)
+		copy(canon.Data[reg], rawRegs.Data[reg])
+	}
+
+	for frame := 0; frame < numFrames; frame++ {
+		mixer := rawRegs.Data[7][frame] & 0x3f
+		canon.Data[7][frame] = mixer
+
+		usesNoise := false
+		usesEnv := false
+		for ch := 0; ch < 3; ch++ {
+			vol := rawRegs.Data[8+ch][frame] & 0x1f
+			if vol&0x10 != 0 {
+				// The fixed volume is unused in envelope mode
+				vol = 0x10
+			}
+			canon.Data[8+ch][frame] = vol
+			toneOn := (mixer>>ch)&1 == 0
+			noiseOn := (mixer>>(ch+3))&1 == 0
+			if vol == 0 {
+				// Silent channel
+				toneOn = false
+				noiseOn = false
+			}
+			if vol&0x10 != 0 {
+				usesEnv = true
+			}
+			if noiseOn {
+				usesNoise = true
+			}
+			if toneOn {
+				canon.Data[ch*2+1][frame] &= 0xf
+			} else {
+				canon.Data[ch*2][frame] = 0
+				canon.Data[ch*2+1][frame] = 0
+			}
+		}
+		if usesNoise {
+			canon.Data[6][frame] &= 0x1f
+		} else {
+			canon.Data[6][frame] = 0
+		}
+		if !usesEnv {
+			canon.Data[11][frame] = 0
+			canon.Data[12][frame] = 0
+		}
+		// Envelope writes always matter, since they restart the envelope
+		if canon.Data[13][frame] != 0xff {
+			canon.Data[13][frame] &= 0xf
+		}
+	}
+	return &canon
+}
+
+// Compare two tunes by their canonical register values.
+func CompareRegisters(a *ymp.RawRegisters, b *ymp.RawRegisters) *CompareResult {
+	var cr CompareResult
+	canonA := CanonicalRegisters(a)
+	canonB := CanonicalRegisters(b)
+	numFrames := len(a.Data[0])
+	if len(b.Data[0]) != numFrames {
+		cr.lengthDiff = true
+		if len(b.Data[0]) < numFrames {
+			numFrames = len(b.Data[0])
+		}
+	}
+	cr.numFrames = numFrames
+
+	for frame := 0; frame < numFrames; frame++ {
+		var fd FrameDiff
+		fd.frame = frame
+		for reg := 0; reg < ymp.NumYmRegs; reg++ {
+			if canonA.Data[reg][frame] != canonB.Data[reg][frame] {
+				fd.regs = append(fd.regs, reg)
+			}
+		}
+		if len(fd.regs) != 0 {
+			cr.diffs = append(cr.diffs, fd)
+		}
+	}
+	return &cr
+}
+
+// Print a summary of the comparison, listing up to maxFrames of the
+// differing frames.
+func (cr *CompareResult) Print(audio bool, maxFrames int) {
+	fmt.Printf("Frames compared:  %6d\n", cr.numFrames)
+	if cr.lengthDiff {
+		fmt.Println("Tunes have different lengths")
+	}
+	if audio {
+		for ch := 0; ch < 3; ch++ {
+			fmt.Printf("Channel %s: peak error %7.1f RMS error %7.2f\n", channelNames[ch],
+				cr.channels[ch].peak, cr.channels[ch].rms)
+		}
+	}
+	fmt.Printf("Differing frames: %6d\n", len(cr.diffs))
+	for i, fd := range cr.diffs {
+		if i >= maxFrames {
+			fmt.Printf("  ... (%d more)\n", len(cr.diffs)-maxFrames)
+			break
+		}
+		if audio {
+			fmt.Printf("  frame %6d:", fd.frame)
+			for ch := 0; ch < 3; ch++ {
+				fmt.Printf(" %s peak %7.1f rms %7.2f", channelNames[ch],
+					fd.channels[ch].peak, fd.channels[ch].rms)
+			}
+			fmt.Println()
+		} else {
+			fmt.Printf("  frame %6d: registers %v\n", fd.frame, fd.regs)
+		}
+	}
+	if cr.Passed() {
+		fmt.Println("Result: PASS")
+	} else {
+		fmt.Println("Result: FAIL")
+	}
+}
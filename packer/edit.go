@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"miny/miny/ymp"
+)
+
+// Options for the "cut", "join", "trim-silence" and "detect-loop" commands.
+type EditConfig struct {
+	uc        UserConfig
+	from      int  // first frame to keep, for "cut"
+	to        int  // frame after the last one to keep, or 0 for the end
+	cacheSize int  // overall cache size when writing a packed file
+	equiv     bool // "detect-loop": compare canonical registers, not exact values
+	minLoop   int  // "detect-loop": shortest loop to look for, in frames
+}
+
+// Write edited register data in the format given by the output
+// extension: .ym (YM6), .yu ("simple"), .yd ("delta"), or anything
+// else is packed with the "pack" settings and written in -format.
+func WriteTuneFile(outputPath string, rawRegs *ymp.RawRegisters, ec EditConfig) error {
+	switch strings.ToLower(filepath.Ext(outputPath)) {
+	case ".ym":
+		return WriteYmFile(outputPath, rawRegs, ec.uc.lha)
+	case ".yu":
+		if len(rawRegs.Data[0]) > 0xffff {
+			return fmt.Errorf("too many frames (%d) for a .yu file", len(rawRegs.Data[0]))
+		}
+		return os.WriteFile(outputPath, EncodeSimple(rawRegs), 0644)
+	case ".yd":
+		return os.WriteFile(outputPath, EncodeDelta(rawRegs), 0644)
+	}
+
+	if err := CheckOutputFormat(ec.uc.format, ec.uc.label); err != nil {
+		return err
+	}
+	ymStr, err := StreamsFromRegisters(rawRegs, ec.uc)
+	if err != nil {
+		return err
+	}
+	fileCfg := FilePackConfig{uc: ec.uc}
+	fileCfg.cacheSizes = FilledSlice(ymp.NumStreams, ec.cacheSize/ymp.NumStreams)
+	packResults, err := PackAndReport(ymStr, fileCfg)
+	if err != nil {
+		return err
+	}
+	return WriteOutputs(outputPath, packResults, &fileCfg, ymStr)
+}
+
+// Keep only a range of frames of a tune.
+func CommandCut(inputPath string, outputPath string, ec EditConfig) error {
+	if ec.from < 0 || ec.to < 0 {
+		return errors.New("frame numbers can't be negative")
+	}
+	if ec.to != 0 && ec.to <= ec.from {
+		return fmt.Errorf("-to (%d) must be after -from (%d)", ec.to, ec.from)
+	}
+	rawRegs, err := LoadTuneFile(inputPath, ec.uc.encoder, ec.uc.load)
+	if err != nil {
+		return err
+	}
+	to := ec.to
+	if to == 0 {
+		to = len(rawRegs.Data[0])
+	}
+	cut, err := ymp.CutRegisters(rawRegs, ec.from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Kept frames %d-%d of %d\n", ec.from, to, len(rawRegs.Data[0]))
+	return WriteTuneFile(outputPath, cut, ec)
+}
+
+// Play one tune after another, e.g. to add a loop section back on.
+func CommandJoin(pathA string, pathB string, outputPath string, ec EditConfig) error {
+	regsA, err := LoadTuneFile(pathA, ec.uc.encoder, ec.uc.load)
+	if err != nil {
+		return err
+	}
+	regsB, err := LoadTuneFile(pathB, ec.uc.encoder, ec.uc.load)
+	if err != nil {
+		return err
+	}
+	joined, err := ymp.JoinRegisters(regsA, regsB)
+	if err != nil {
+		return fmt.Errorf("can't join '%s' and '%s': %v", pathA, pathB, err)
+	}
+	fmt.Printf("Joined %d + %d frames, looping at frame %d\n", len(regsA.Data[0]), len(regsB.Data[0]),
+		joined.LoopFrame)
+	return WriteTuneFile(outputPath, joined, ec)
+}
+
+// Remove the silent frames from the start and end of a tune.
+func CommandTrimSilence(inputPath string, outputPath string, ec EditConfig) error {
+	rawRegs, err := LoadTuneFile(inputPath, ec.uc.encoder, ec.uc.load)
+	if err != nil {
+		return err
+	}
+	trimmed, start, end, err := ymp.TrimSilence(rawRegs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d silent frames from the start and %d from the end\n", start, end)
+	return WriteTuneFile(outputPath, trimmed, ec)
+}
+
+// Find a repeated section at the end of a tune, and if an output file
+// is given, write the tune cut to one playthrough with its loop frame
+// set.
+func CommandDetectLoop(inputPath string, outputPath string, ec EditConfig) error {
+	rawRegs, err := LoadTuneFile(inputPath, ec.uc.encoder, ec.uc.load)
+	if err != nil {
+		return err
+	}
+	search := rawRegs
+	if ec.equiv {
+		search = CanonicalRegisters(rawRegs)
+	}
+	numFrames := len(rawRegs.Data[0])
+	loop, found := ymp.DetectLoop(search, ec.minLoop)
+	if !found {
+		if outputPath != "" {
+			return fmt.Errorf("no loop of %d frames or more found, so nothing to cut", ec.minLoop)
+		}
+		fmt.Printf("No loop of %d frames or more found in %d frames\n", ec.minLoop, numFrames)
+		return nil
+	}
+
+	seconds := func(frames int) float32 {
+		return Ratio(frames, rawRegs.PlayHz)
+	}
+	fmt.Printf("Loop start:   %6d (%.1fs)\n", loop.Start, seconds(loop.Start))
+	fmt.Printf("Loop length:  %6d (%.1fs)\n", loop.Length, seconds(loop.Length))
+	fmt.Printf("Playthroughs: %6.2f\n", loop.Playthroughs())
+	fmt.Printf("Repeated:     %6d frames (%.1f%%)\n", loop.Repeated, Percent(loop.Repeated, numFrames))
+	if rawRegs.LoopFrame != 0 && rawRegs.LoopFrame != loop.Start {
+		fmt.Printf("The file's loop frame is %d\n", rawRegs.LoopFrame)
+	}
+	if outputPath == "" {
+		return nil
+	}
+	trimmed, err := ymp.TrimToLoop(rawRegs, loop)
+	if err != nil {
+		return err
+	}
+	return WriteTuneFile(outputPath, trimmed, ec)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"miny/miny/ymp"
+)
+
+// Output formats for the packed data.
+var outputFormats = []string{"bin", "vasm", "gas", "c"}
+
+// Check the output format and the symbol name given for source output,
+// before spending time on packing.
+func CheckOutputFormat(format string, label string) error {
+	if label != "" && !isIdentifier(label) {
+		return fmt.Errorf("bad label '%s': use letters, digits and '_', not starting with a digit", label)
+	}
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format '%s' (use %s)", format, strings.Join(outputFormats, "|"))
+}
+
+// Returns true if the name can be used as an assembler or C symbol.
+func isIdentifier(name string) bool {
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i != 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Create a symbol name from a file path, e.g. "out/my-tune.ymp" -> "my_tune"
+func LabelFromPath(path string) string {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	var sb strings.Builder
+	for i, c := range base {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	if sb.Len() == 0 {
+		return "tune"
+	}
+	return sb.String()
+}
+
+// Describes how to write data in a given source format.
+type sourceSyntax struct {
+	comment string // line comment prefix
+	equ     string // format for "name, value"
+	label   string // format for label definition
+	bytes   string // directive for a line of bytes
+	hexByte string // format for a single byte
+	space   string // format for reserving N zero bytes
+	perLine int
+}
+
+var vasmSyntax = sourceSyntax{
+	comment: "; ",
+	equ:     "%s\tequ\t%d\n",
+	label:   "%s:\n",
+	bytes:   "\tdc.b\t",
+	hexByte: "$%02x",
+	space:   "\tds.b\t%d\n",
+	perLine: 16,
+}
+
+var gasSyntax = sourceSyntax{
+	comment: "# ",
+	equ:     "\t.equ\t%s, %d\n",
+	label:   "%s:\n",
+	bytes:   "\t.byte\t",
+	hexByte: "0x%02x",
+	space:   "\t.space\t%d\n",
+	perLine: 16,
+}
+
+func writeSourceBytes(w io.Writer, syn *sourceSyntax, data []byte) {
+	for pos := 0; pos < len(data); pos += syn.perLine {
+		end := pos + syn.perLine
+		if end > len(data) {
+			end = len(data)
+		}
+		fmt.Fprint(w, syn.bytes)
+		for i := pos; i < end; i++ {
+			if i != pos {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, syn.hexByte, data[i])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Write the packed file as assembler source, with labels for each
+// part of the file and equates for the sizes the player needs.
+func writeAsmSource(w io.Writer, syn *sourceSyntax, label string, pr *ymp.PackResults) {
+	upper := strings.ToUpper(label)
+	data := pr.PackedData
+	dataEnd := len(data) - pr.PaddingSize
+
+	fmt.Fprintf(w, "%sGenerated by miny. Packed YM data.\n", syn.comment)
+	fmt.Fprintf(w, syn.equ, upper+"_CACHE_SIZE", pr.CacheSize)
+	fmt.Fprintf(w, syn.equ, upper+"_FRAMES", pr.NumVbls)
+	fmt.Fprintf(w, syn.equ, upper+"_SIZE", dataEnd)
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, syn.label, label)
+	fmt.Fprintf(w, syn.label, label+"_header")
+	writeSourceBytes(w, syn, data[:ymp.YmpFixedHeaderSize])
+	fmt.Fprintf(w, syn.label, label+"_sets")
+	writeSourceBytes(w, syn, data[ymp.YmpFixedHeaderSize:pr.HeaderSize])
+	fmt.Fprintf(w, syn.label, label+"_data")
+	writeSourceBytes(w, syn, data[pr.HeaderSize:dataEnd])
+	fmt.Fprintf(w, syn.label, label+"_end")
+	if pr.PaddingSize != 0 {
+		fmt.Fprintf(w, "%sCache space\n", syn.comment)
+		fmt.Fprintf(w, syn.space, pr.PaddingSize)
+	}
+}
+
+// Write the packed file as a C header.
+func writeCHeader(w io.Writer, label string, pr *ymp.PackResults) {
+	upper := strings.ToUpper(label)
+	data := pr.PackedData
+
+	fmt.Fprintln(w, "/* Generated by miny. Packed YM data. */")
+	fmt.Fprintf(w, "#ifndef %s_H\n", upper)
+	fmt.Fprintf(w, "#define %s_H\n\n", upper)
+	fmt.Fprintln(w, "#include <stdint.h>")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "#define %s_CACHE_SIZE %d\n", upper, pr.CacheSize)
+	fmt.Fprintf(w, "#define %s_FRAMES %d\n", upper, pr.NumVbls)
+	fmt.Fprintf(w, "#define %s_HEADER_SIZE %d\n", upper, pr.HeaderSize)
+	fmt.Fprintf(w, "#define %s_SIZE %d\n", upper, len(data)-pr.PaddingSize)
+	if pr.PaddingSize != 0 {
+		// The cache space is zeroes at the end of the array
+		fmt.Fprintf(w, "#define %s_PADDING_SIZE %d\n\n", upper, pr.PaddingSize)
+		fmt.Fprintf(w, "static const uint8_t %s[%s_SIZE + %s_PADDING_SIZE] = {\n", label, upper, upper)
+	} else {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "static const uint8_t %s[%s_SIZE] = {\n", label, upper)
+	}
+	for pos := 0; pos < len(data); pos += 16 {
+		end := pos + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		fmt.Fprint(w, "\t")
+		for i := pos; i < end; i++ {
+			fmt.Fprintf(w, "0x%02x,", data[i])
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "};")
+	fmt.Fprintf(w, "\n#endif /* %s_H */\n", upper)
+}
+
+// Read the size equates back from assembler or C source written by
+// writeAsmSource or writeCHeader. Returns the packed data size and the
+// cache size, or false if they aren't both there.
+func readSourceSizes(data []byte) (int, int, bool) {
+	// The cache size is written first, which gives the label
+	prefix := ""
+	equates := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ','
+		})
+		if len(fields) != 3 {
+			continue
+		}
+		// "NAME equ N", ".equ NAME, N" or "#define NAME N"
+		name := fields[1]
+		if name == "equ" {
+			name = fields[0]
+		}
+		val, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if prefix == "" && strings.HasSuffix(name, "_CACHE_SIZE") {
+			prefix = strings.TrimSuffix(name, "_CACHE_SIZE")
+		}
+		equates[name] = val
+	}
+	size, ok := equates[prefix+"_SIZE"]
+	cacheSize, ok2 := equates[prefix+"_CACHE_SIZE"]
+	return size, cacheSize, prefix != "" && ok && ok2
+}
+
+// Write the packed data to a file in one of the output formats.
+func WritePackedFile(outputPath string, format string, label string, pr *ymp.PackResults) error {
+	if format == "bin" || format == "" {
+		return os.WriteFile(outputPath, pr.PackedData, 0644)
+	}
+	if label == "" {
+		label = LabelFromPath(outputPath)
+	}
+	if err := CheckOutputFormat(format, label); err != nil {
+		return err
+	}
+
+	fh, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	switch format {
+	case "vasm":
+		writeAsmSource(w, &vasmSyntax, label, pr)
+	case "gas":
+		writeAsmSource(w, &gasSyntax, label, pr)
+	case "c":
+		writeCHeader(w, label, pr)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"miny/miny/ymp"
+)
+
+// Options for the "info" command.
+type InfoConfig struct {
+	tokens  bool // list the tokens in a .ymp file
+	encoder int  // encoder used to read .ymp tokens, if the file doesn't record it
+}
+
+// Print the structure of a .ymp, .yd or .yu file.
+// All three start with a 'Y' marker byte, followed by the format.
+func CommandInfo(inputPath string, ic InfoConfig) error {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return err
+	}
+	if len(data) < 2 || data[0] != 'Y' {
+		return errors.New("not a .ymp, .yd or .yu file, no 'Y' marker")
+	}
+	switch {
+	case data[1] == 'U':
+		return infoSimple(data)
+	case data[1] == 'D':
+		return infoDelta(data)
+	case ymp.IsYmpData(data):
+		return infoYmp(data, ic)
+	}
+	return fmt.Errorf("unknown format/version byte $%02x", data[1])
+}
+
+// Output of the "simple" command: a 16-bit frame count, then 14
+// registers per frame.
+func infoSimple(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("truncated .yu header")
+	}
+	numFrames := int(binary.BigEndian.Uint16(data[2:]))
+	expected := 4 + numFrames*ymp.NumYmRegs
+	fmt.Println("Format:       .yu (unpacked registers)")
+	fmt.Printf("Frames:       %d\n", numFrames)
+	fmt.Printf("File size:    %d\n", len(data))
+	if len(data) != expected {
+		return fmt.Errorf("file size should be %d for %d frames", expected, numFrames)
+	}
+	return nil
+}
+
+// Output of the "delta" command: a 32-bit frame count, then for each
+// frame two groups of a mask byte and the changed values, for registers
+// 0-6 and 7-13.
+func infoDelta(data []byte) error {
+	if len(data) < 6 {
+		return errors.New("truncated .yd header")
+	}
+	numFrames := int(binary.BigEndian.Uint32(data[2:]))
+	var writes [ymp.NumYmRegs]int
+	head := 6
+	for frame := 0; frame < numFrames; frame++ {
+		for group := 0; group < 2; group++ {
+			if head >= len(data) {
+				return fmt.Errorf("delta data ends early at frame %d", frame)
+			}
+			mask := data[head]
+			head++
+			for i := 0; i < 7; i++ {
+				if mask&(0x80>>uint(i)) != 0 {
+					writes[group*7+i]++
+					head++
+				}
+			}
+			if mask&1 != 0 {
+				return fmt.Errorf("bad mask byte $%02x at frame %d", mask, frame)
+			}
+		}
+	}
+	if head > len(data) {
+		return errors.New("delta data ends early in the last frame")
+	}
+
+	fmt.Println("Format:       .yd (delta-packed registers)")
+	fmt.Printf("Frames:       %d\n", numFrames)
+	fmt.Printf("File size:    %d\n", len(data))
+	fmt.Printf("Bytes/frame:  %.2f\n", Ratio(head-6, numFrames))
+	fmt.Println("Register writes:")
+	for reg := 0; reg < ymp.NumYmRegs; reg++ {
+		fmt.Printf("    %2d: %6d (%.1f%%)\n", reg, writes[reg], Percent(writes[reg], numFrames))
+	}
+	if head != len(data) {
+		fmt.Printf("Trailing:     %d bytes\n", len(data)-head)
+	}
+	return nil
+}
+
+func infoYmp(data []byte, ic InfoConfig) error {
+	hdr, err := ymp.ParseYmpHeader(data)
+	if err != nil {
+		return err
+	}
+	enc, err := hdr.NewEncoder(ic.encoder)
+	if err != nil {
+		return err
+	}
+	encoder := "not recorded"
+	if info, err := ymp.GetEncoderInfo(hdr.Encoder); err == nil {
+		encoder = fmt.Sprintf("%d (%s)", info.ID, info.Name)
+	}
+
+	// Count tokens while checking the whole file decodes
+	var numLits, numMatches [ymp.NumStreams]int
+	visit := func(frame int, strm int, t ymp.Token, offset int) {
+		kind := "lit  "
+		if t.IsMatch {
+			numMatches[strm]++
+			kind = "match"
+		} else {
+			numLits[strm]++
+		}
+		if ic.tokens {
+			fmt.Printf("    frame %6d  stream %2d  %s len %4d off %5d  at $%06x\n",
+				frame, strm, kind, t.Len, t.Off, offset)
+		}
+	}
+	if ic.tokens {
+		fmt.Println("Tokens:")
+	}
+	_, end, err := ymp.WalkYmp(data, enc, visit)
+	if err != nil {
+		return err
+	}
+
+	endian := "big-endian"
+	if hdr.LittleEndian {
+		endian = "little-endian"
+	}
+	fmt.Println("Format:       .ymp (packed)")
+	fmt.Printf("Version:      %d (%s header)\n", hdr.Version, endian)
+	fmt.Printf("Encoder:      %s\n", encoder)
+	fmt.Printf("Frames:       %d\n", hdr.NumVbls)
+	fmt.Printf("Cache total:  %d\n", hdr.CacheSize)
+	fmt.Println("Remap table:")
+	for strm := 0; strm < ymp.NumStreams; strm++ {
+		fmt.Printf("    %2d %-18s -> file position %2d\n", strm, ymp.StreamNames[strm], hdr.Remap[strm])
+	}
+	fmt.Println("Cache sets:")
+	for i, set := range hdr.Sets {
+		fmt.Printf("    set %d: size %5d, streams %v\n", i, set.CacheSize, set.Streams)
+	}
+	fmt.Printf("Header size:  %d\n", hdr.DataOffset)
+	fmt.Printf("Packed data:  %d\n", end-hdr.DataOffset)
+	padding := data[end:]
+	zeros := 0
+	for _, b := range padding {
+		if b == 0 {
+			zeros++
+		}
+	}
+	fmt.Printf("Padding:      %d bytes", len(padding))
+	if zeros != len(padding) {
+		fmt.Printf(" (%d non-zero)", len(padding)-zeros)
+	}
+	fmt.Println()
+	fmt.Println("Token counts:")
+	for strm := 0; strm < ymp.NumStreams; strm++ {
+		fmt.Printf("    %2d %-18s literals %6d matches %6d\n", strm, ymp.StreamNames[strm],
+			numLits[strm], numMatches[strm])
+	}
+	return nil
+}
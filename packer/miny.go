@@ -1,31 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
-)
-
-// This is the number of registers - 1, since the mixer
-// register data is mixed into the channel volume register streams.
-const numStreams = 13
-
-var streamNames = [numStreams]string{
-	"A period lo", "A period hi",
-	"B period lo", "B period hi",
-	"C period lo", "C period hi",
-	"Noise period",
-	"A volume + mixer",
-	"B volume + mixer",
-	"C volume + mixer",
-	"Env period lo", "Env period hi",
-	"Env shape"}
+	"time"
 
-// Contains a single stream of packed or unpacked data.
-type ByteSlice []byte
+	"miny/miny/ymp"
+)
 
 // Create a byte slice of size 0
 func EmptySlice() []byte {
@@ -33,7 +23,7 @@ func EmptySlice() []byte {
 }
 
 func FilledSlice(size int, val int) []int {
-	arr := make([]int, numStreams)
+	arr := make([]int, ymp.NumStreams)
 	for i := 0; i < size; i++ {
 		arr[i] = val
 	}
@@ -59,46 +49,25 @@ func Sum(arr []int) int {
 	return sum
 }
 
-func EncByte(output []byte, value byte) []byte {
-	return append(output, value)
-}
-
-func EncWord(output []byte, value uint16) []byte {
-	output = append(output, byte(value>>8))
-	return append(output, byte(value&255))
-}
-
-func EncLong(output []byte, value uint32) []byte {
-	output = append(output, byte(value>>24)&255)
-	output = append(output, byte(value>>16)&255)
-	output = append(output, byte(value>>8)&255)
-	return append(output, byte(value&255))
-}
-
-// Raw unpacked data for all the registers, plus tune length.
-type YmStreams struct {
-	// A binary array for each streamData stream to pack
-	streamData [numStreams][]byte
-	numVbls    int // size of each packedstream
-	dataSize   int // sum of sizes of all register arrays
-}
-
-func GetEncoder(choice int) (Encoder, error) {
-	switch choice {
-	case 1:
-		return &Encoder_v1{0}, nil
-	case 2:
-		return &Encoder_v2{0}, nil
-	}
-
-	return nil, fmt.Errorf("unknown encoder ID: (%d)", choice)
-}
-
 type UserConfig struct {
-	verbose  bool
-	padding  bool
-	analysis bool
-	encoder  int // 1 or 2
+	verbose    bool
+	padding    bool
+	analysis   bool
+	encoder    int       // encoder ID, see ymp.Encoders
+	format     string    // output file format, see outputFormats
+	label      string    // symbol name for source output formats
+	target     string    // playback machine, see targetProfiles
+	retune     bool      // convert periods to the target's clock
+	clockFrom  string    // override the clock of the input file
+	clockTo    string    // convert periods to this clock
+	rateFrom   int       // override the frame rate of the input file
+	rateTo     int       // convert to this frame rate
+	multiSpeed bool      // keep several updates per frame when converting down
+	lha        bool      // compress YM output with LHA
+	report     string    // summary format for pack commands: text|json
+	out        io.Writer // human-readable output, see output()
+	jobs       int       // number of packs to run at once, 0 for one per CPU
+	load       ymp.LoadOptions
 }
 
 // Describes packing config for a whole file
@@ -107,254 +76,36 @@ type FilePackConfig struct {
 	uc         UserConfig
 }
 
-// Describes packing config for a single register stream
-type StreamPackCfg struct {
-	bufferSize int // cache size for just this stream
-	verbose    bool
-}
-
-func FindLongestMatch(data []byte, head int, distance int) Match {
-	bestOffset := -1
-	bestLength := 0
-	maxDist := distance
-	if head < distance {
-		maxDist = head
-	}
-
-	for offset := 1; offset <= maxDist; offset++ {
-		length := 0
-		checkPos := head - offset
-		for head+length < len(data) &&
-			data[checkPos+length] == data[head+length] &&
-			length < 0xff00 {
-			length++
-		}
-		if length >= 3 && length > bestLength {
-			bestLength = length
-			bestOffset = offset
-		}
-	}
-	return Match{len: bestLength, off: bestOffset}
-}
-
-func FindCheapestMatch(enc Encoder, data []byte, head int, distance int) Match {
-	bestMatch := Match{0, 0}
-	// Any pack rate of less than 8 bits/byte is automatically useless
-	var bestCost float64 = 8.0
-	maxDist := distance
-	if head < distance {
-		maxDist = head
-	}
-	for offset := 1; offset <= maxDist; offset++ {
-		length := 0
-		checkPos := head - offset
-		for head+length < len(data) &&
-			data[checkPos+length] == data[head+length] &&
-			length < 0xff00 {
-			length++
-		}
-		if length >= 3 {
-			m := Match{len: length, off: offset}
-			mc := float64(enc.Cost(0, m)) / float64(length)
-			if mc < bestCost {
-				bestCost = mc
-				bestMatch = m
-			}
-		}
-	}
-	return bestMatch
-}
-
-// Add a number of literals to a set of tokens.
-// If the last entry was a match, create a new token to
-// represent them
-func AddLiterals(tokens []Token, count int, pos int) []Token {
-	lastIndex := len(tokens) - 1
-
-	// We also split literals at just before 64K to avoid runtime
-	// 16-bit overflow
-	if lastIndex >= 0 &&
-		!tokens[lastIndex].isMatch &&
-		tokens[lastIndex].len < 0xfff0 {
-		tokens[lastIndex].len++
-	} else {
-		return append(tokens, Token{false, count, pos})
-	}
-	return tokens
-}
-
-func TokenizeGreedy(enc Encoder, data []byte, cfg StreamPackCfg) []Token {
-	var tokens []Token
-
-	head := 0
-	matchBytes := 0
-	litBytes := 0
-
-	for head < len(data) {
-		best := FindLongestMatch(data, head, cfg.bufferSize)
-		if best.len != 0 {
-			head += best.len
-			tokens = append(tokens, Token{true, best.len, best.off})
-			matchBytes += best.len
-		} else {
-			// Literal
-			tokens = AddLiterals(tokens, 1, head)
-			head++ // literal
-			litBytes++
-		}
-	}
-	if cfg.verbose {
-		fmt.Printf("\tGreedy: Matches %v Literals %v (%.2f%%)\n", matchBytes, litBytes,
-			Percent(matchBytes, litBytes+matchBytes))
-	}
-	return tokens
-}
-
-func TokenizeLazy(enc Encoder, data []byte, useCheapest bool, cfg StreamPackCfg) []Token {
-	var tokens []Token
-
-	usedMatch := 0
-	usedMatchlit := 0
-	usedSecond := 0
-	matchBytes := 0
-	litBytes := 0
-	head := 0
-
-	var best0 Match
-	var best1 Match
-	bufferSize := cfg.bufferSize
-	for head < len(data) {
-		if useCheapest {
-			best0 = FindCheapestMatch(enc, data, head, bufferSize)
-		} else {
-			best0 = FindLongestMatch(data, head, bufferSize)
-		}
-		chooseLit := best0.len == 0
-
-		// We have 2 choices really
-		// Apply 0 (as a match or a literal)
-		// Apply literal 0 (and check the next byte for a match)
-		if !chooseLit {
-			// See if doing N literals is smaller
-			cost0 := enc.Cost(0, best0)
-			costLit := enc.Cost(best0.len, Match{})
-			if costLit < cost0 {
-				chooseLit = true
-				usedMatchlit++
-			}
-		}
-
-		if !chooseLit {
-			usedMatch++
-			// We only need to decide to choose the second match, if both
-			// 0 and 1 are matches rather than literals.
-			if best0.len != 0 && head+1 < len(data) {
-				if useCheapest {
-					best1 = FindCheapestMatch(enc, data, head+1, bufferSize)
-				} else {
-					best1 = FindLongestMatch(data, head+1, bufferSize)
-				}
-				if best1.len != 0 {
-					cost0 := enc.Cost(0, best0)
-					cost1 := enc.Cost(1, best1)
-					rate0 := Ratio(cost0, best0.len)
-					rate1 := Ratio(cost1, 1+best1.len)
-					if rate1 < rate0 {
-						chooseLit = true
-						usedMatch--
-						usedSecond++
-					}
-				}
-			}
-		}
-
-		// Add the decision to the token stream,
-		// and update the encoder's state so it can update future encoding costs.
-		if chooseLit {
-			// Literal
-			tokens = AddLiterals(tokens, 1, head)
-			head++
-			enc.ApplyLit(1)
-			litBytes++
-		} else {
-			head += best0.len
-			tokens = append(tokens, Token{true, best0.len, best0.off})
-			usedMatch++
-			enc.ApplyMatch(best0)
-			matchBytes += best0.len
-		}
-	}
-
-	if cfg.verbose {
-		fmt.Printf("\tLazy: Matches %v Literals %v (%.2f%%)\n", matchBytes, litBytes,
-			Percent(matchBytes, litBytes+matchBytes))
-		fmt.Println("\tLazy: Used match:", usedMatch, "used matchlit:", usedMatchlit,
-			"used second", usedSecond)
-	}
-
-	return tokens
-}
-
-// Take the 14 raw register arrays and multiplex the mixer bits
-// into the final YmStreams representation.
-// NOTE: this overwrites contents of some of the original
-// RawRegisters byte slices (for the volume channels)
-func RemapFromRaw(rawRegs *RawRegisters) (*YmStreams, error) {
-	// Pull out mixer bits and write into the volume streams
-	for channel := 0; channel < 3; channel++ {
-		target_channel := 8 + channel
-		tone_bit := channel
-		noise_bit := channel + 3
-
-		for i, val := range rawRegs.data[7] {
-			volVal := rawRegs.data[target_channel][i]
-			if (volVal & 0xc0) != 0 {
-				return nil, fmt.Errorf("Bad volume register value: %x", volVal)
-			}
-			// Put the tone and noise mixer bits into bits
-			// 6 and 7 of the volume
-			var acc byte = 0
-			if val&(1<<tone_bit) != 0 {
-				acc |= 1 << 6
-			}
-			if val&(1<<noise_bit) != 0 {
-				acc |= 1 << 7
-			}
-			rawRegs.data[target_channel][i] |= acc
-		}
+func (fc *FilePackConfig) packConfig() ymp.PackConfig {
+	return ymp.PackConfig{
+		CacheSizes: fc.cacheSizes,
+		Encoder:    fc.uc.encoder,
+		Target:     fc.uc.target,
+		Padding:    fc.uc.padding,
 	}
-	var ymStr YmStreams
-	ymStr.numVbls = len(rawRegs.data[0])
-	ymStr.dataSize = 0
-	// Remap the final set
-	for strm := 0; strm < numStreams; strm++ {
-		if strm < 7 {
-			ymStr.streamData[strm] = rawRegs.data[strm]
-		} else {
-			ymStr.streamData[strm] = rawRegs.data[strm+1]
-		}
-		// Accumulate data size
-		ymStr.dataSize += len(ymStr.streamData[strm])
-	}
-	return &ymStr, nil
 }
 
 // Load an input file and create the ym_streams data object.
-func LoadStreamFile(inputPath string) (*YmStreams, error) {
-	dat, err := os.ReadFile(inputPath)
+func LoadStreamFile(inputPath string, uc UserConfig) (*ymp.YmStreams, error) {
+	rawRegisters, err := LoadRegisterFile(inputPath, uc.load, uc.output())
 	if err != nil {
 		return nil, err
 	}
+	return StreamsFromRegisters(rawRegisters, uc)
+}
 
-	rawRegisters, err := LoadRawRegisters(dat)
+// Apply the user's conversions to register data and create the
+// ym_streams data object.
+func StreamsFromRegisters(rawRegisters *ymp.RawRegisters, uc UserConfig) (*ymp.YmStreams, error) {
+	err := ApplyTransforms(rawRegisters, uc)
 	if err != nil {
 		return nil, err
 	}
-	ymStr, err := RemapFromRaw(rawRegisters)
+	ymStr, err := ymp.RemapFromRaw(rawRegisters)
 	if err != nil {
 		return nil, err
 	}
-	return ymStr, nil
+	return ApplyRateConversion(ymStr, rawRegisters.PlayHz, uc)
 }
 
 // General packing statistics
@@ -420,7 +171,7 @@ func WriteHisto(m *map[int]int, path string) error {
 	return nil
 }
 
-func WriteTokenDump(tokens *TokenStreams, path string) error {
+func WriteTokenDump(tokens *ymp.TokenStreams, path string) error {
 	fh, err := os.Create(path)
 	if err != nil {
 		return err
@@ -429,18 +180,18 @@ func WriteTokenDump(tokens *TokenStreams, path string) error {
 		ts := &(*tokens)[strIdx]
 		for _, t := range *ts {
 			typStr := 'l'
-			if t.isMatch {
+			if t.IsMatch {
 				typStr = 'm'
 			}
-			fmt.Fprintf(fh, "%c,%d,%d\n", typStr, t.len, t.off)
+			fmt.Fprintf(fh, "%c,%d,%d\n", typStr, t.Len, t.Off)
 		}
 	}
 	fh.Close()
 	return nil
 }
 
-// Output histogram to stdout
-func PrintHisto(m *map[int]int) float64 {
+// Output histogram to "w"
+func PrintHisto(w io.Writer, m *map[int]int) float64 {
 	max := 0
 	keys := make([]int, 0, len(*m))
 	for k := range *m {
@@ -456,7 +207,7 @@ func PrintHisto(m *map[int]int) float64 {
 		return (*m)[keys[i]] > (*m)[keys[j]]
 	})
 
-	fmt.Printf("Entropy: %.2f bits per value (%.2f total bytes)\n", entropy, totalBytes)
+	fmt.Fprintf(w, "Entropy: %.2f bits per value (%.2f total bytes)\n", entropy, totalBytes)
 	if false {
 		accum := 0
 		for _, k := range keys {
@@ -467,9 +218,9 @@ func PrintHisto(m *map[int]int) float64 {
 			total_pc := Percent(accum, tot)
 
 			if dup != 0 {
-				fmt.Printf("[% 4d] %s %d (%.1f%% -> %.1f%%)\n", k, strings.Repeat("*", int(dup)), cnt, pc, total_pc)
+				fmt.Fprintf(w, "[% 4d] %s %d (%.1f%% -> %.1f%%)\n", k, strings.Repeat("*", int(dup)), cnt, pc, total_pc)
 			} else {
-				fmt.Printf("[% 4d] %d\n", k, cnt)
+				fmt.Fprintf(w, "[% 4d] %d\n", k, cnt)
 			}
 			if total_pc > 90 {
 				break
@@ -504,7 +255,7 @@ func PrintHisto(m *map[int]int) float64 {
 			tmp += 8
 			testSize += tmp * cnt
 		}
-		fmt.Printf("Experimental test size, prefix %d bits -> %d bytes\n", prefixSize, testSize/8)
+		fmt.Fprintf(w, "Experimental test size, prefix %d bits -> %d bytes\n", prefixSize, testSize/8)
 	}
 
 	{
@@ -523,331 +274,259 @@ func PrintHisto(m *map[int]int) float64 {
 			}
 			testSize += tmp * cnt
 		}
-		fmt.Printf("Orig test size: %d bytes\n", testSize/8)
+		fmt.Fprintf(w, "Orig test size: %d bytes\n", testSize/8)
 	}
 	return totalBytes
 }
 
-type TokenStreams [][]Token
-
-type PackResults struct {
-	packedData []byte
-	tokens     *TokenStreams
-	stats      *PackStats
+// Print the encoded size of each stream and cache set in the packed data.
+// Literal tokens are split into the literal bytes themselves and the
+// overhead of their headers.
+func PrintStreamSizes(w io.Writer, sets []ymp.CacheSet, tokens ymp.TokenStreams, litBits [ymp.NumStreams]int,
+	matchBits [ymp.NumStreams]int, dataSize int) {
+	fmt.Fprintf(w, "%-27s %9s %9s %9s %9s\n", "Stream", "Literals", "Lit hdrs", "Matches", "Total")
+	for i, set := range sets {
+		var setLits, setHdrs, setMatches int
+		for _, strm := range set.Streams {
+			lits := 0
+			for _, t := range tokens[strm] {
+				if !t.IsMatch {
+					lits += t.Len
+				}
+			}
+			hdrs := litBits[strm]/8 - lits
+			matches := matchBits[strm] / 8
+			total := lits + hdrs + matches
+			fmt.Fprintf(w, "%2d %-24s %9d %9d %9d %9d (%.1f%%)\n", strm, ymp.StreamNames[strm],
+				lits, hdrs, matches, total, Percent(total, dataSize))
+			setLits += lits
+			setHdrs += hdrs
+			setMatches += matches
+		}
+		total := setLits + setHdrs + setMatches
+		setName := fmt.Sprintf("   Set %d (cache size %d)", i, set.CacheSize)
+		fmt.Fprintf(w, "%-27s %9d %9d %9d %9d (%.1f%%)\n", setName,
+			setLits, setHdrs, setMatches, total, Percent(total, dataSize))
+	}
 }
 
-// Core function to ack a YM3 data file and return an encoded array of bytes.
-func PackAll(ymStr *YmStreams, fileCfg FilePackConfig,
-	report bool, verify bool) (*PackResults, error) {
-	// Compression settings
-	useCheapest := false
-
-	streamCfg := StreamPackCfg{}
-	streamCfg.verbose = fileCfg.uc.verbose
-
-	// Records the tokens needed
-	tokensPerStream := make(TokenStreams, numStreams)
-	enc, err := GetEncoder(fileCfg.uc.encoder)
+// Pack the streams and print a summary of the result.
+func PackAndReport(ymStr *ymp.YmStreams, fileCfg FilePackConfig) (*ymp.PackResults, error) {
+	pr, err := ymp.PackAll(ymStr, fileCfg.packConfig())
 	if err != nil {
 		return nil, err
 	}
-
-	for strmIdx := 0; strmIdx < numStreams; strmIdx++ {
-		streamCfg.bufferSize = fileCfg.cacheSizes[strmIdx]
-		if fileCfg.uc.verbose {
-			fmt.Println("Packing register", strmIdx, streamNames[strmIdx])
-		}
-		// Pack
-		regData := ymStr.streamData[strmIdx]
-		tokens := TokenizeLazy(enc, regData, useCheapest, streamCfg)
-		tokensPerStream[strmIdx] = tokens
-	}
-
-	// Group the registers into sets with the same size
-	sets := make(map[int][]int)
-	for strmIdx := 0; strmIdx < numStreams; strmIdx++ {
-		sets[fileCfg.cacheSizes[strmIdx]] = append(sets[fileCfg.cacheSizes[strmIdx]], strmIdx)
-	}
-
-	// Calc mapping of YM reg->stream in the file
-	// and generate the header data for them.
-
-	// We will output the registers to the file, ordered by set
-	// and flattened.
-	regOrder := make([]byte, numStreams)
-	// The inverse order is used at runtime to map from YM reg
-	// to depacked stream in the file.
-	inverseRegOrder := make([]byte, numStreams)
-
-	// Data repreesenting the set configuration
-	setHeaderData := []byte{}
-	var streamId byte = 0
-	for cacheSize, set := range sets {
-		if fileCfg.uc.verbose {
-			fmt.Printf("Adding set with cache size %d\n", cacheSize)
-		}
-		setHeaderData = EncWord(setHeaderData, uint16(len(set)-1))
-		setHeaderData = EncWord(setHeaderData, uint16(cacheSize))
-		for _, reg := range set {
-			if fileCfg.uc.verbose {
-				fmt.Printf(" - reg stream %d (%s)\n", reg, streamNames[reg])
-			}
-			inverseRegOrder[reg] = streamId
-			regOrder[streamId] = byte(reg)
-			streamId++
+	w := fileCfg.uc.output()
+	if fileCfg.uc.verbose {
+		for strm, stats := range pr.TokenStats {
+			fmt.Fprintln(w, "Packing register", strm, ymp.StreamNames[strm])
+			fmt.Fprintf(w, "\tLazy: Matches %v Literals %v (%.2f%%)\n", stats.MatchBytes, stats.LitBytes,
+				Percent(stats.MatchBytes, stats.LitBytes+stats.MatchBytes))
+			fmt.Fprintln(w, "\tLazy: Used match:", stats.UsedMatch, "used matchlit:", stats.UsedMatchLit,
+				"used second", stats.UsedSecond)
 		}
-	}
-
-	// Flag end of cache set
-	setHeaderData = EncWord(setHeaderData, uint16(0xffff))
-
-	// Number of bytes required by the set data
-	// 4 bytes per set -- loop count, cache size
-	// 2 bytes -- end sentinel
-	if len(setHeaderData) != 2+(4*len(sets)) {
-		panic("header size mismatch")
-	}
-
-	// Do the final interleaving of the encoded tokens into a single stream,
-	// knowing the order-per-frame that they will be depacked in
-	p := NewPackStream()
-	nextTokenFrame := make([]int, numStreams) // frame number when next token gets used
-	nextTokenIndex := make([]int, numStreams) // index in tokensPerStream[x]
-
-	// Use a dumb loop to check the next token.
-	// We could use a constantly-sorted list (mapped by lower position+lower reg order),
-	// but there seems little need for the complexity since matches tend to be
-	// short.
-	for frameIdx := 0; frameIdx < ymStr.numVbls; frameIdx++ {
-		for r := 0; r < numStreams; r++ {
-			strmIdx := regOrder[r]
-			if nextTokenFrame[strmIdx] == frameIdx {
-				// Read the next token from the packed data
-				tIdx := nextTokenIndex[strmIdx]
-				t := tokensPerStream[strmIdx][tIdx]
-				enc.Encode(&t, p, ymStr.streamData[strmIdx])
-
-				// Move on to the next tokem in this stream
-				nextTokenIndex[strmIdx]++
-				nextTokenFrame[strmIdx] += t.len
+		for _, set := range pr.Sets {
+			fmt.Fprintf(w, "Set with cache size %d\n", set.CacheSize)
+			for _, strm := range set.Streams {
+				fmt.Fprintf(w, " - reg stream %d (%s): %d tokens\n", strm, ymp.StreamNames[strm],
+					len((*pr.Tokens)[strm]))
 			}
 		}
 	}
 
-	// Generate the final data
-	outputData := make([]byte, 0)
-
-	// Calc overall header size
-	headerSize := 2 + // header
-		2 + // cache size
-		4 + // num vbls
-		numStreams + // register order
-		1 + // padding
-		len(setHeaderData) // set information
-
-	// Header: "Y" + 0x3 (version)
-	outputData = EncByte(outputData, 'Y')
-	outputData = EncByte(outputData, 0x3)
-
-	// 0) Output required cache size (for user reference)
-	outputData = EncWord(outputData, uint16(Sum(fileCfg.cacheSizes)))
-
-	// 1) Output size in VBLs
-	outputData = EncLong(outputData, uint32(ymStr.numVbls))
-
-	// 2) Order of registers
-	outputData = append(outputData, inverseRegOrder...)
-	outputData = EncByte(outputData, 0x0) // padding
-
-	// Set data
-	outputData = append(outputData, setHeaderData...)
-
-	if len(outputData) != headerSize {
-		panic("header size mismatch 2")
-	}
-
-	// ... then the data
-	outputData = append(outputData, p.byteData...)
-	cacheSize := Sum(fileCfg.cacheSizes)
-
-	if report {
-		origSize := ymStr.dataSize
-		packedSize := len(outputData)
-		totalSize := cacheSize + packedSize
-		bpf := float32(packedSize) / float32(ymStr.numVbls)
-
-		fmt.Println("===== Complete =====")
-		fmt.Printf("Original size:    %6d\n", origSize)
-		fmt.Printf("Packed size:      %6d (%.1f%%) (%.2f bytes/frame)\n", packedSize, Percent(packedSize, origSize), bpf)
-		fmt.Printf("Num cache sizes:  %6d (smaller=faster)\n", len(sets))
-		fmt.Printf("Total cache size: %6d\n", cacheSize)
-		fmt.Printf("Total RAM:        %6d (%.1f%%)\n", totalSize, Percent(totalSize, origSize))
-	}
-
-	// Add optional padding *after* the report,
-	// otherwise the total size looks wrong.
-	if fileCfg.uc.padding {
-
-		padData := make([]byte, cacheSize)
-		outputData = append(outputData, padData...)
-	}
+	origSize := ymStr.DataSize
+	packedSize := len(pr.PackedData) - pr.PaddingSize
+	totalSize := pr.CacheSize + packedSize
+	bpf := float32(packedSize) / float32(ymStr.NumVbls)
 
-	pr := PackResults{
-		packedData: outputData,
-		tokens:     &tokensPerStream,
-	}
-	return &pr, nil
+	fmt.Fprintln(w, "===== Complete =====")
+	fmt.Fprintf(w, "Original size:    %6d\n", origSize)
+	fmt.Fprintf(w, "Packed size:      %6d (%.1f%%) (%.2f bytes/frame)\n", packedSize, Percent(packedSize, origSize), bpf)
+	fmt.Fprintf(w, "Num cache sizes:  %6d (smaller=faster)\n", len(pr.Sets))
+	fmt.Fprintf(w, "Total cache size: %6d\n", pr.CacheSize)
+	fmt.Fprintf(w, "Total RAM:        %6d (%.1f%%)\n", totalSize, Percent(totalSize, origSize))
+	PrintStreamSizes(w, pr.Sets, *pr.Tokens, pr.LitBits, pr.MatchBits, packedSize-pr.HeaderSize)
+	return pr, nil
 }
 
-func WriteOutputs(outputPath string, packResults *PackResults, fileCfg *FilePackConfig,
-	orig *YmStreams) error {
+func WriteOutputs(outputPath string, packResults *ymp.PackResults, fileCfg *FilePackConfig,
+	orig *ymp.YmStreams) error {
 
 	if fileCfg.uc.analysis {
+		w := fileCfg.uc.output()
 		// Generate the stats from the token set...
 		stats := NewPackStats()
 		// Graph histogram
-		for strIdx := range *packResults.tokens {
-			ts := (*packResults.tokens)[strIdx]
+		for strIdx := range *packResults.Tokens {
+			ts := (*packResults.Tokens)[strIdx]
 			for i := range ts {
 				t := ts[i]
-				if t.isMatch {
-					stats.lenMap[t.len]++
-					stats.distMap[t.off]++
-					stats.offs = append(stats.offs, t.off)
-					stats.lens = append(stats.lens, t.len)
+				if t.IsMatch {
+					stats.lenMap[t.Len]++
+					stats.distMap[t.Off]++
+					stats.offs = append(stats.offs, t.Off)
+					stats.lens = append(stats.lens, t.Len)
 					stats.numMatches++
-					stats.matchSize += t.len
+					stats.matchSize += t.Len
 				} else {
-					stats.litSize += t.len
-					stats.litlenMap[t.len]++
+					stats.litSize += t.Len
+					stats.litlenMap[t.Len]++
 				}
 			}
 			stats.numTokens += len(ts)
 		}
 
-		fmt.Printf("Num matches       %6d (%.1f%%)\n", stats.numMatches, Percent(stats.numMatches, stats.numTokens))
-		fmt.Printf("Num tokens        %6d (%.2f tokens/frame)\n", stats.numTokens, float32(stats.numTokens)/float32(orig.numVbls))
-		fmt.Printf("Matched size      %6d (%.1f%%)\n", stats.matchSize, Percent(stats.matchSize, orig.dataSize))
-		fmt.Println("\nMatch Distances:")
-		optimBytes := PrintHisto(&stats.distMap)
-		fmt.Println("\nMatch Lengths:")
-		optimBytes += PrintHisto(&stats.lenMap)
-		fmt.Println("\nLiteral Lengths:")
-		optimBytes += PrintHisto(&stats.litlenMap)
+		fmt.Fprintf(w, "Num matches       %6d (%.1f%%)\n", stats.numMatches, Percent(stats.numMatches, stats.numTokens))
+		fmt.Fprintf(w, "Num tokens        %6d (%.2f tokens/frame)\n", stats.numTokens, float32(stats.numTokens)/float32(orig.NumVbls))
+		fmt.Fprintf(w, "Matched size      %6d (%.1f%%)\n", stats.matchSize, Percent(stats.matchSize, orig.DataSize))
+		fmt.Fprintln(w, "\nMatch Distances:")
+		optimBytes := PrintHisto(w, &stats.distMap)
+		fmt.Fprintln(w, "\nMatch Lengths:")
+		optimBytes += PrintHisto(w, &stats.lenMap)
+		fmt.Fprintln(w, "\nLiteral Lengths:")
+		optimBytes += PrintHisto(w, &stats.litlenMap)
 		optimBytes += float64(stats.litSize)
-		fmt.Printf("Total optimum bytes: %.1f\n", optimBytes)
+		fmt.Fprintf(w, "Total optimum bytes: %.1f\n", optimBytes)
 
 		WriteHisto(&stats.distMap, outputPath+".mdist.csv")
 		WriteHisto(&stats.lenMap, outputPath+".mlen.csv")
 		WriteHisto(&stats.litlenMap, outputPath+".llen.csv")
-		WriteTokenDump(packResults.tokens, outputPath+".tokens.csv")
+		WriteTokenDump(packResults.Tokens, outputPath+".tokens.csv")
 	}
-	err := os.WriteFile(outputPath, packResults.packedData, 0644)
+	err := WritePackedFile(outputPath, fileCfg.uc.format, fileCfg.uc.label, packResults)
 	return err
 }
 
 // Pack a file with custom config like cache size.
 func CommandCustom(inputPath string, outputPath string, fileCfg FilePackConfig) error {
-	ymStr, err := LoadStreamFile(inputPath)
+	if err := CheckOutputFormat(fileCfg.uc.format, fileCfg.uc.label); err != nil {
+		return err
+	}
+	report, err := NewPackReport("pack", inputPath, outputPath, fileCfg.uc)
 	if err != nil {
 		return err
 	}
+	start := time.Now()
+	ymStr, err := LoadStreamFile(inputPath, fileCfg.uc)
+	if err != nil {
+		return err
+	}
+	report.Time("load", start)
 
-	packedData, err := PackAll(ymStr, fileCfg, true, true)
+	start = time.Now()
+	packedData, err := PackAndReport(ymStr, fileCfg)
 	if err != nil {
 		return err
 	}
+	report.Time("pack", start)
 
+	start = time.Now()
 	err = WriteOutputs(outputPath, packedData, &fileCfg, ymStr)
-	return err
+	if err != nil {
+		return err
+	}
+	report.Time("write", start)
+	report.SetResults(ymStr, packedData, &fileCfg)
+	return report.Write()
 }
 
 // Choose the cache size which gives minimal sum of
 // [packed file size] + [cache size]
-func MinpackFindCacheSize(ymStr *YmStreams, minCacheSize int, maxCacheSize int,
-	cacheSizeStep int, phase string, encoder int) (int, error) {
+// The candidate sizes are packed in parallel on the pool.
+func MinpackFindCacheSize(ctx context.Context, pool *WorkerPool, ymStr *ymp.YmStreams, minCacheSize int,
+	maxCacheSize int, cacheSizeStep int, phase string, uc UserConfig) (int, error) {
+	w := uc.output()
 
-	type MinpackResult struct {
-		regCacheSize int // size of cache for a single register
-		cacheSize    int // total size of all caches added together
-		packedSize   int
+	var regCacheSizes []int
+	for cacheSize := minCacheSize; cacheSize <= maxCacheSize; cacheSize += cacheSizeStep {
+		regCacheSizes = append(regCacheSizes, cacheSize)
 	}
+	totalSizes := make([]int, len(regCacheSizes))
 
-	messages := make(chan MinpackResult, 5)
-
-	// Async func to pack the file and return sizes
-	FindPackedSizeFunc := func(regCacheSize int, ymStr *YmStreams, cfg FilePackConfig) {
-		packResult, err := PackAll(ymStr, cfg, false, false)
+	fmt.Fprintf(w, "Collecting stats (%s)", phase)
+	err := pool.Run(ctx, len(regCacheSizes), func(i int) error {
+		cfg := ymp.PackConfig{}
+		cfg.CacheSizes = FilledSlice(ymp.NumStreams, regCacheSizes[i])
+		cfg.Encoder = uc.encoder
+		packResult, err := ymp.PackAll(ymStr, cfg)
 		if err != nil {
-			fmt.Println(err)
-			messages <- MinpackResult{0, 0, 0}
-		} else {
-			messages <- MinpackResult{regCacheSize, Sum(cfg.cacheSizes), len(packResult.packedData)}
+			return err
 		}
+		totalSizes[i] = packResult.CacheSize + len(packResult.PackedData)
+		fmt.Fprint(w, ".")
+		return nil
+	})
+	fmt.Fprintln(w)
+	if err != nil {
+		return 0, err
 	}
 
-	// Launch the async packers
-	for cacheSize := minCacheSize; cacheSize <= maxCacheSize; cacheSize += cacheSizeStep {
-		cfg := FilePackConfig{}
-		cfg.cacheSizes = FilledSlice(numStreams, cacheSize)
-		cfg.uc.verbose = false
-		cfg.uc.encoder = encoder
-		go FindPackedSizeFunc(cacheSize, ymStr, cfg)
-	}
-
-	// Receive results and find the smallest
-	sizeMap := make(map[int]int)
-
+	// Find the smallest, preferring smaller caches if equal
 	smallestCacheSize := -1
-	smallestTotalSize := 1 * 1024 * 1024
-	fmt.Printf("Collecting stats (%s)", phase)
-	for i := minCacheSize; i <= maxCacheSize; i += cacheSizeStep {
-		msg := <-messages
-
-		thisSize := msg.packedSize
-		totalSize := msg.cacheSize + thisSize
-		fmt.Print(".")
+	smallestTotalSize := math.MaxInt
+	for i, totalSize := range totalSizes {
 		if totalSize < smallestTotalSize {
 			smallestTotalSize = totalSize
-			smallestCacheSize = msg.regCacheSize
+			smallestCacheSize = regCacheSizes[i]
 		}
-
-		sizeMap[msg.cacheSize] = thisSize //totalSize
 	}
-	fmt.Println()
 	return smallestCacheSize, nil
 }
 
 // Pack file to be played back with low CPU (single cache size for
 // all registers)
-func CommandQuick(inputPath string, outputPath string, uc UserConfig) error {
-	ymStr, err := LoadStreamFile(inputPath)
+func CommandQuick(ctx context.Context, inputPath string, outputPath string, uc UserConfig) error {
+	if err := CheckOutputFormat(uc.format, uc.label); err != nil {
+		return err
+	}
+	report, err := NewPackReport("quick", inputPath, outputPath, uc)
 	if err != nil {
 		return err
 	}
+	start := time.Now()
+	ymStr, err := LoadStreamFile(inputPath, uc)
+	if err != nil {
+		return err
+	}
+	report.Time("load", start)
+	w := uc.output()
 
-	fmt.Println("---- Pass 1 ----")
-	smallestCacheSize, err := MinpackFindCacheSize(ymStr, 64, 1024, 32, "broad", uc.encoder)
+	start = time.Now()
+	fmt.Fprintln(w, "---- Pass 1 ----")
+	pool := NewWorkerPool(uc.jobs)
+	smallestCacheSize, err := MinpackFindCacheSize(ctx, pool, ymStr, 64, 1024, 32, "broad", uc)
 	if err != nil {
 		return err
 	}
+	report.AddSearch("broad", 64, 1024, 32, smallestCacheSize)
 
-	fmt.Println("---- Pass 2 ----")
-	smallestCacheSize, err = MinpackFindCacheSize(ymStr, smallestCacheSize-32,
-		smallestCacheSize+32, 2, "narrow", uc.encoder)
+	fmt.Fprintln(w, "---- Pass 2 ----")
+	narrowMin, narrowMax := smallestCacheSize-32, smallestCacheSize+32
+	smallestCacheSize, err = MinpackFindCacheSize(ctx, pool, ymStr, narrowMin, narrowMax, 2, "narrow", uc)
 	if err != nil {
 		return err
 	}
+	report.AddSearch("narrow", narrowMin, narrowMax, 2, smallestCacheSize)
+	report.Time("search", start)
 
+	start = time.Now()
 	fileCfg := FilePackConfig{}
 	fileCfg.uc = uc
-	fileCfg.cacheSizes = FilledSlice(numStreams, smallestCacheSize)
-	packedData, err := PackAll(ymStr, fileCfg, true, true)
+	fileCfg.cacheSizes = FilledSlice(ymp.NumStreams, smallestCacheSize)
+	packedData, err := PackAndReport(ymStr, fileCfg)
 	if err != nil {
 		return err
 	}
+	report.Time("pack", start)
+
+	start = time.Now()
 	err = WriteOutputs(outputPath, packedData, &fileCfg, ymStr)
-	return err
+	if err != nil {
+		return err
+	}
+	report.Time("write", start)
+	report.SetResults(ymStr, packedData, &fileCfg)
+	return report.Write()
 }
 
 // Records resulting size for a pack of a single register stream, for
@@ -891,62 +570,72 @@ type SmallResult struct {
 	packedSize int
 }
 
-func CommandSmall(inputPath string, outputPath string, uc UserConfig) error {
-	ymStr, err := LoadStreamFile(inputPath)
+func CommandSmall(ctx context.Context, inputPath string, outputPath string, uc UserConfig) error {
+	if err := CheckOutputFormat(uc.format, uc.label); err != nil {
+		return err
+	}
+	report, err := NewPackReport("small", inputPath, outputPath, uc)
 	if err != nil {
 		return err
 	}
+	start := time.Now()
+	ymStr, err := LoadStreamFile(inputPath, uc)
+	if err != nil {
+		return err
+	}
+	report.Time("load", start)
+	w := uc.output()
 
+	start = time.Now()
 	perRegStats := PerRegStats{}
 	perRegStats.totalPackedSizes = make(map[int][]int)
 	minSize := 8
 	maxSize := 1024
 	step := 16
 	for size := minSize; size < maxSize; size += step {
-		perRegStats.totalPackedSizes[size] = make([]int, numStreams)
+		perRegStats.totalPackedSizes[size] = make([]int, ymp.NumStreams)
 	}
 
-	messages := make(chan SmallResult, 15)
+	var sizes []int
+	for size := minSize; size < maxSize; size += step {
+		sizes = append(sizes, size)
+	}
 
-	// Async func to pack the file and return sizes
-	FindPackedSizeFunc := func(strmIdx int, regCacheSize int, ymStr *YmStreams) {
-		enc, _ := GetEncoder(1)
-		var cfg StreamPackCfg
-		cfg.bufferSize = regCacheSize
-		cfg.verbose = false
-		regData := ymStr.streamData[strmIdx]
-		tokens := TokenizeLazy(enc, regData, true, cfg)
-		p := NewPackStream()
+	// Pack every stream with every cache size, as one task each.
+	// Each task needs its own encoder state.
+	encInfo, err := ymp.GetEncoderInfo(uc.encoder)
+	if err != nil {
+		return err
+	}
+	pool := NewWorkerPool(uc.jobs)
+	results := make([]SmallResult, ymp.NumStreams*len(sizes))
+	fmt.Fprint(w, "Collecting stats")
+	err = pool.Run(ctx, len(results), func(i int) error {
+		strmIdx, regCacheSize := i/len(sizes), sizes[i%len(sizes)]
+		enc := encInfo.New()
+		var cfg ymp.StreamPackCfg
+		cfg.BufferSize = regCacheSize
+		regData := ymStr.StreamData[strmIdx]
+		tokens := ymp.TokenizeLazy(enc, regData, true, cfg)
+		p := ymp.NewPackStream()
 		for i := 0; i < len(tokens); i++ {
-			enc.Encode(&tokens[i], p, regData)
+			if err := enc.Encode(&tokens[i], p, regData); err != nil {
+				return err
+			}
 		}
-		if err != nil {
-			fmt.Println(err)
-			messages <- SmallResult{strmIdx, 0, 0}
-		} else {
-			messages <- SmallResult{strmIdx, regCacheSize, (p.BitCount() + 7) / 8}
+		results[i] = SmallResult{strmIdx, regCacheSize, (p.BitCount() + 7) / 8}
+		if i%len(sizes) == len(sizes)-1 {
+			fmt.Fprint(w, ".")
 		}
+		return nil
+	})
+	fmt.Fprintln(w)
+	if err != nil {
+		return err
 	}
-
-	fmt.Print("Collecting stats")
-	for strmIdx := 0; strmIdx < numStreams; strmIdx++ {
-		fmt.Print(".")
-
-		// Launch...
-		for size := minSize; size < maxSize; size += step {
-			go FindPackedSizeFunc(strmIdx, size, ymStr)
-		}
-
-		// ... Collect.
-		for size := minSize; size < maxSize; size += step {
-			msg := <-messages
-			csize := msg.cacheSize
-			total := msg.cacheSize + msg.packedSize
-			perRegStats.totalPackedSizes[csize][strmIdx] = total
-		}
-
+	for _, res := range results {
+		perRegStats.totalPackedSizes[res.cacheSize][res.strmIdx] = res.cacheSize + res.packedSize
 	}
-	fmt.Println()
 
 	bestTotalSize := 0
 	bestCacheSize := 0
@@ -954,13 +643,14 @@ func CommandSmall(inputPath string, outputPath string, uc UserConfig) error {
 	statsForRegs := make([]RegPackSizes, 0)
 	var smallCfg FilePackConfig
 	smallCfg.uc = uc
-	smallCfg.cacheSizes = make([]int, numStreams)
+	smallCfg.cacheSizes = make([]int, ymp.NumStreams)
 
-	for strmIdx := 0; strmIdx < numStreams; strmIdx++ {
+	for strmIdx := 0; strmIdx < ymp.NumStreams; strmIdx++ {
 		minTotal := 9999999
 		minCache := minTotal
 
-		for csize := range perRegStats.totalPackedSizes {
+		// In size order, so that the smallest cache wins a tie
+		for _, csize := range sizes {
 			total := perRegStats.totalPackedSizes[csize][strmIdx]
 			if total < minTotal {
 				minTotal = total
@@ -982,86 +672,97 @@ func CommandSmall(inputPath string, outputPath string, uc UserConfig) error {
 	})
 
 	// Now we can grade the streams based on who needs the biggest cache
-	for i := 0; i < numStreams; i++ {
+	for i := 0; i < ymp.NumStreams; i++ {
 		strmIdx := statsForRegs[i].strmIdx
-		fmt.Printf("Stream %2d Needs cache %4d -> Total size %5d (%s)\n", strmIdx, statsForRegs[i].cacheSize,
+		fmt.Fprintf(w, "Stream %2d Needs cache %4d -> Total size %5d (%s)\n", strmIdx, statsForRegs[i].cacheSize,
 			statsForRegs[i].totalSize,
-			streamNames[strmIdx])
+			ymp.StreamNames[strmIdx])
 	}
 
+	// Each stream picks its own size, so there is no single chosen value
+	report.AddSearch("per-stream", minSize, maxSize-1, step, 0)
+	report.Time("search", start)
+
 	// Write out a final minimal file
-	packResult, err := PackAll(ymStr, smallCfg, true, true)
+	start = time.Now()
+	packResult, err := PackAndReport(ymStr, smallCfg)
 	if err != nil {
 		return err
 	}
-	err = WriteOutputs(outputPath, packResult, &smallCfg, ymStr)
-	return nil
-}
+	report.Time("pack", start)
 
-func CommandSimple(inputPath string, outputPath string) error {
-	data, err := os.ReadFile(inputPath)
+	start = time.Now()
+	err = WriteOutputs(outputPath, packResult, &smallCfg, ymStr)
 	if err != nil {
 		return err
 	}
+	report.Time("write", start)
+	report.SetResults(ymStr, packResult, &smallCfg)
+	return report.Write()
+}
 
-	rawRegs, err := LoadRawRegisters(data)
+func CommandSimple(inputPath string, outputPath string, w io.Writer) error {
+	rawRegs, err := LoadRegisterFile(inputPath, ymp.LoadOptions{}, w)
 	if err != nil {
 		return err
 	}
-	numFrames := len(rawRegs.data[0])
+	return os.WriteFile(outputPath, EncodeSimple(rawRegs), 0644)
+}
+
+// Create the "simple" output from register data.
+func EncodeSimple(rawRegs *ymp.RawRegisters) []byte {
+	numFrames := len(rawRegs.Data[0])
 
 	// The format of the output is
 	// 2 bytes -- header "YU"
 	// 4 bytes -- number of frames to play
 	// Followed by blocks of 14 bytes with the full set of register data per frame.
 	var outputData []byte
-	outputData = EncByte(outputData, 'Y')
-	outputData = EncByte(outputData, 'U')
-	outputData = EncWord(outputData, uint16(numFrames))
+	outputData = ymp.EncByte(outputData, 'Y')
+	outputData = ymp.EncByte(outputData, 'U')
+	outputData = ymp.EncWord(outputData, uint16(numFrames))
 
 	// Interleave the registers by frame
 	for i := 0; i < numFrames; i++ {
-		for reg := 0; reg < numYmRegs; reg++ {
-			outputData = EncByte(outputData, data[4+(reg*numFrames)+i])
+		for reg := 0; reg < ymp.NumYmRegs; reg++ {
+			outputData = ymp.EncByte(outputData, rawRegs.Data[reg][i])
 		}
 	}
-
-	err = os.WriteFile(outputPath, outputData, 0644)
-	return err
+	return outputData
 }
 
-func CommandDelta(inputPath string, outputPath string) error {
-	data, err := os.ReadFile(inputPath)
+func CommandDelta(inputPath string, outputPath string, w io.Writer) error {
+	rawRegs, err := LoadRegisterFile(inputPath, ymp.LoadOptions{}, w)
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(outputPath, EncodeDelta(rawRegs), 0644)
+}
 
-	rawRegs, err := LoadRawRegisters(data)
-	if err != nil {
-		return err
-	}
-	numFrames := len(rawRegs.data[0])
+// Create the "delta" output from register data.
+func EncodeDelta(rawRegs *ymp.RawRegisters) []byte {
+	numFrames := len(rawRegs.Data[0])
 
 	// The format of the output is
 	// 2 bytes -- header "YU"
 	// 4 bytes -- number of frames to play
 	// Followed by blocks of 14 bytes with the full set of register data per frame.
 	var outputData []byte
-	outputData = EncByte(outputData, 'Y')
-	outputData = EncByte(outputData, 'D')
-	outputData = EncLong(outputData, uint32(numFrames))
+	outputData = ymp.EncByte(outputData, 'Y')
+	outputData = ymp.EncByte(outputData, 'D')
+	outputData = ymp.EncLong(outputData, uint32(numFrames))
 
 	// Interleave the registers by frame
-	previous_val := make([]byte, numYmRegs)
-	for i := 0; i < numYmRegs; i++ {
+	previous_val := make([]byte, ymp.NumYmRegs)
+	for i := 0; i < ymp.NumYmRegs; i++ {
 		previous_val[i] = 0xff
 	}
 
 	for frame := 0; frame < numFrames; frame++ {
 		var mask byte = 0
 		var vals []byte
-		for reg := 0; reg < numYmRegs; reg++ {
-			regVal := data[4+(reg*numFrames)+frame]
+		for reg := 0; reg < ymp.NumYmRegs; reg++ {
+			regVal := rawRegs.Data[reg][frame]
 			do_out := false // enforce on first frame
 			if reg == 13 {
 				// Spacial case -- only write out any non-0xff value
@@ -1079,16 +780,145 @@ func CommandDelta(inputPath string, outputPath string) error {
 			previous_val[reg] = regVal
 
 			if reg == 6 || reg == 13 {
-				outputData = EncByte(outputData, mask<<1)
+				outputData = ymp.EncByte(outputData, mask<<1)
 				outputData = append(outputData, vals...)
 				mask = 0
 				vals = vals[:0] // resets slice without freeing memory
 			}
 		}
 	}
+	return outputData
+}
+
+// Settings for commands which play register data through the PSG emulator.
+type AudioConfig struct {
+	clock      string  // machine name or Hz, see ParseClock; "" for the tune's clock
+	frameRate  float64 // 0 for the tune's frame rate
+	sampleRate int
+	encoder    int // for decoding .ymp input
+	load       ymp.LoadOptions
+}
+
+// Register logs are sampled at the render frame rate, if one is given.
+func (ac *AudioConfig) loadOptions() ymp.LoadOptions {
+	opts := ac.load
+	if opts.LogRate == 0 {
+		opts.LogRate = int(ac.frameRate)
+	}
+	return opts
+}
 
-	err = os.WriteFile(outputPath, outputData, 0644)
-	return err
+// Settings to render a tune with: the clock and frame rate loaded from
+// the file, unless they were given on the command line.
+func (ac *AudioConfig) RenderConfig(rawRegs *ymp.RawRegisters) (ymp.RenderConfig, error) {
+	rc := ymp.RenderConfig{ClockHz: rawRegs.ClockHz, SampleRate: ac.sampleRate, FrameRate: float64(rawRegs.PlayHz)}
+	if ac.clock != "" {
+		clockHz, err := ymp.ParseClock(ac.clock)
+		if err != nil {
+			return ymp.RenderConfig{}, err
+		}
+		rc.ClockHz = clockHz
+	}
+	if ac.frameRate != 0 {
+		rc.FrameRate = ac.frameRate
+	}
+	if rc.ClockHz == 0 {
+		rc.ClockHz = ymp.ClockAtariST
+	}
+	if rc.FrameRate == 0 {
+		rc.FrameRate = 50
+	}
+	return rc, nil
+}
+
+// Play a YM or .ymp file through the PSG emulator and write a .wav file.
+func CommandRender(inputPath string, outputPath string, ac AudioConfig) error {
+	rawRegs, err := LoadTuneFile(inputPath, ac.encoder, ac.loadOptions())
+	if err != nil {
+		return err
+	}
+	rc, err := ac.RenderConfig(rawRegs)
+	if err != nil {
+		return err
+	}
+	audio, err := ymp.RenderRegisters(rawRegs, rc)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rendered %d frames (%.1f seconds) at %d Hz clock, %g frames per second\n", len(rawRegs.Data[0]),
+		float64(len(audio.Channels[0]))/float64(rc.SampleRate), rc.ClockHz, rc.FrameRate)
+	return WriteWav(outputPath, audio.MixMono(), rc.SampleRate)
+}
+
+// Settings for the compare command.
+type CompareConfig struct {
+	equiv     bool    // compare canonical registers rather than audio
+	tolerance float64 // allowed PCM difference per sample
+	maxFrames int     // number of differing frames to list
+}
+
+// Compare two YM or .ymp files, and return an error if they differ.
+func CommandCompare(pathA string, pathB string, ac AudioConfig, cc CompareConfig) error {
+	regsA, err := LoadTuneFile(pathA, ac.encoder, ac.loadOptions())
+	if err != nil {
+		return err
+	}
+	regsB, err := LoadTuneFile(pathB, ac.encoder, ac.loadOptions())
+	if err != nil {
+		return err
+	}
+
+	var result *CompareResult
+	if cc.equiv {
+		result = CompareRegisters(regsA, regsB)
+	} else {
+		// Each tune plays at its own clock and rate, unless overridden
+		var audio [2]*ymp.RenderedAudio
+		for i, regs := range []*ymp.RawRegisters{regsA, regsB} {
+			rc, err := ac.RenderConfig(regs)
+			if err != nil {
+				return err
+			}
+			audio[i], err = ymp.RenderRegisters(regs, rc)
+			if err != nil {
+				return err
+			}
+		}
+		audioA, audioB := audio[0], audio[1]
+		result = CompareAudio(audioA, audioB, cc.tolerance)
+	}
+	result.Print(!cc.equiv, cc.maxFrames)
+	if !result.Passed() {
+		return fmt.Errorf("'%s' and '%s' differ", pathA, pathB)
+	}
+	return nil
+}
+
+// Convert the periods in a tune to a different master clock, and
+// write out the result as a YM file.
+func CommandConvertClock(inputPath string, outputPath string, uc UserConfig) error {
+	if uc.clockTo == "" {
+		return errors.New("no target clock given (use -to)")
+	}
+	return CommandConvert(inputPath, outputPath, uc)
+}
+
+// Load a tune in any supported format, apply any clock or frame rate
+// conversion, and write it out as a YM6 file.
+func CommandConvert(inputPath string, outputPath string, uc UserConfig) error {
+	rawRegs, err := LoadTuneFile(inputPath, uc.encoder, uc.load)
+	if err != nil {
+		return err
+	}
+	err = ApplyTransforms(rawRegs, uc)
+	if err != nil {
+		return err
+	}
+	rawRegs, err = ApplyRegisterRateConversion(rawRegs, uc)
+	if err != nil {
+		return err
+	}
+	return WriteYmFile(outputPath, rawRegs, uc.lha)
 }
 
 type CliCommand struct {
@@ -1124,30 +954,170 @@ func PrintUsage(commands map[string]CliCommand) {
 
 	for _, name := range names {
 		cmd := commands[name]
-		fmt.Printf("    %-10s %s\n", name, cmd.desc)
+		fmt.Printf("    %-13s %s\n", name, cmd.desc)
+	}
+
+	fmt.Println("Encoders available (-encoder):")
+	for _, e := range ymp.Encoders() {
+		fmt.Printf("    %d %-7s %s\n", e.ID, e.Name, e.Desc)
+	}
+}
+
+// A flag which takes an encoder name or ID, and stores the ID.
+type encoderFlag int
+
+func (ef *encoderFlag) String() string {
+	return strconv.Itoa(int(*ef))
+}
+
+func (ef *encoderFlag) Set(value string) error {
+	info, err := ymp.LookupEncoder(value)
+	if err != nil {
+		return err
 	}
+	*ef = encoderFlag(info.ID)
+	return nil
+}
+
+// Add an "-encoder" flag, defaulting to the first encoder.
+func addEncoderFlag(fs *flag.FlagSet, encoder *int, usage string) {
+	*encoder = ymp.Encoders()[0].ID
+	fs.Var((*encoderFlag)(encoder), "encoder", usage+": "+ymp.EncoderNames()+" or ID")
+}
+
+// Parse flags that may come before, between or after the file
+// arguments, e.g. "cut in.ym out.ym -from 100". Returns the files.
+func parseWithFiles(fs *flag.FlagSet, args []string) []string {
+	var files []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return files
+		}
+		files = append(files, args[0])
+		args = args[1:]
+	}
+}
+
+// Flags for input formats which need extra information to load.
+func addLoadFlags(fs *flag.FlagSet, opts *ymp.LoadOptions) {
+	fs.IntVar(&opts.LogRate, "log-rate", 0, "frames per second to sample VGM logs at (default from file, or 50)")
+	fs.IntVar(&opts.Subtune, "subtune", 0, "SNDH subtune to record (default 1)")
+	fs.IntVar(&opts.Seconds, "seconds", 0, "SNDH length to record (default from file, or 180)")
 }
 
 func main() {
+	// Ctrl-C cancels long searches and batches
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	uc := UserConfig{}
 	addCommonFlags := func(fs *flag.FlagSet) {
 		fs.BoolVar(&uc.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&uc.padding, "padding", false, "add zero bytes for cache into file")
 		fs.BoolVar(&uc.analysis, "analysis", false, "output analysis CSV files")
-		fs.IntVar(&uc.encoder, "encoder", 1, "encoder version (1|2)")
+		addEncoderFlag(fs, &uc.encoder, "encoder")
+		fs.StringVar(&uc.format, "format", "bin", "output format: "+strings.Join(outputFormats, "|"))
+		fs.StringVar(&uc.label, "label", "", "symbol name for source output (default from output filename)")
+		fs.StringVar(&uc.target, "target", "st", "playback machine: "+ymp.TargetNames())
+		fs.BoolVar(&uc.retune, "retune", false, "convert periods to the target machine's clock")
+		fs.StringVar(&uc.clockFrom, "clock-from", "", "clock of input file, if not stored in file: st|spectrum|cpc or Hz")
+		fs.StringVar(&uc.clockTo, "clock-to", "", "convert periods to this clock: st|spectrum|cpc or Hz")
+		fs.IntVar(&uc.rateFrom, "rate-from", 0, "frame rate of input file in Hz, if not stored in file")
+		fs.IntVar(&uc.rateTo, "rate-to", 0, "convert to this frame rate in Hz")
+		fs.BoolVar(&uc.multiSpeed, "multispeed", false, "with -rate-to, keep 2-4 updates per frame as extra frames")
+		fs.IntVar(&uc.jobs, "jobs", 0, "number of packs to run in parallel (default one per CPU)")
+		fs.StringVar(&uc.report, "report", "text", "summary format: text|json (json goes to stdout, other output to stderr)")
+		addLoadFlags(fs, &uc.load)
 	}
 	customFlags := flag.NewFlagSet("pack", flag.ExitOnError)
 	addCommonFlags(customFlags)
 
 	quickFlags := flag.NewFlagSet("minpack", flag.ExitOnError)
 	addCommonFlags(quickFlags)
-	packOptSize := customFlags.Int("cachesize", numStreams*512, "overall cache size in bytes")
+	packOptSize := customFlags.Int("cachesize", ymp.NumStreams*512, "overall cache size in bytes")
 
 	smallFlags := flag.NewFlagSet("smallest", flag.ExitOnError)
 	addCommonFlags(smallFlags)
 
+	bc := BatchConfig{}
+	batchFlags := flag.NewFlagSet("batch", flag.ExitOnError)
+	addCommonFlags(batchFlags)
+	batchModeList := batchFlags.String("modes", "quick", "comma-separated pack modes: "+strings.Join(batchModes, ","))
+	batchFlags.StringVar(&bc.summaryPath, "summary", "", "summary file, .csv or .json (default <outdir>/summary.csv)")
+	batchFlags.BoolVar(&bc.force, "force", false, "repack files even if the output is up to date")
+	batchFlags.IntVar(&bc.cacheSize, "cachesize", ymp.NumStreams*512, "overall cache size in bytes for the 'pack' mode")
+
 	simpleFlags := flag.NewFlagSet("simple", flag.ExitOnError)
 	deltaFlags := flag.NewFlagSet("delta", flag.ExitOnError)
+
+	ac := AudioConfig{}
+	addAudioFlags := func(fs *flag.FlagSet) {
+		fs.StringVar(&ac.clock, "clock", "", "PSG clock: st|spectrum|cpc or value in Hz (default from file, or st)")
+		fs.Float64Var(&ac.frameRate, "rate", 0, "register frames per second (default from file, or 50)")
+		fs.IntVar(&ac.sampleRate, "samplerate", 44100, "output sample rate in Hz")
+		addEncoderFlag(fs, &ac.encoder, "encoder for .ymp files that don't record it")
+		addLoadFlags(fs, &ac.load)
+	}
+	renderFlags := flag.NewFlagSet("render", flag.ExitOnError)
+	addAudioFlags(renderFlags)
+
+	cc := CompareConfig{}
+	compareFlags := flag.NewFlagSet("compare", flag.ExitOnError)
+	addAudioFlags(compareFlags)
+	compareFlags.BoolVar(&cc.equiv, "equiv", false, "compare register-equivalent values instead of audio")
+	compareFlags.Float64Var(&cc.tolerance, "tolerance", 0.0, "allowed PCM error per sample")
+	compareFlags.IntVar(&cc.maxFrames, "maxframes", 20, "number of differing frames to list")
+	playerGenFlags := flag.NewFlagSet("player-gen", flag.ExitOnError)
+
+	clockUc := UserConfig{}
+	convertClockFlags := flag.NewFlagSet("convert-clock", flag.ExitOnError)
+	convertClockFlags.StringVar(&clockUc.clockFrom, "from", "", "clock of input file, if not stored in file: st|spectrum|cpc or Hz")
+	convertClockFlags.StringVar(&clockUc.clockTo, "to", "", "clock to convert to: st|spectrum|cpc or Hz")
+	addEncoderFlag(convertClockFlags, &clockUc.encoder, "encoder for .ymp files that don't record it")
+	convertClockFlags.BoolVar(&clockUc.lha, "lha", false, "compress the output with LHA -lh5-")
+	addLoadFlags(convertClockFlags, &clockUc.load)
+
+	convertUc := UserConfig{}
+	convertFlags := flag.NewFlagSet("convert", flag.ExitOnError)
+	convertFlags.StringVar(&convertUc.clockFrom, "clock-from", "", "clock of input file, if not stored in file: st|spectrum|cpc or Hz")
+	convertFlags.StringVar(&convertUc.clockTo, "clock-to", "", "convert periods to this clock: st|spectrum|cpc or Hz")
+	convertFlags.IntVar(&convertUc.rateFrom, "rate-from", 0, "frame rate of input file in Hz, if not stored in file")
+	convertFlags.IntVar(&convertUc.rateTo, "rate-to", 0, "convert to this frame rate in Hz")
+	convertFlags.BoolVar(&convertUc.multiSpeed, "multispeed", false, "with -rate-to, keep 2-4 updates per frame as extra frames")
+	addEncoderFlag(convertFlags, &convertUc.encoder, "encoder for .ymp files that don't record it")
+	convertFlags.BoolVar(&convertUc.lha, "lha", false, "compress the output with LHA -lh5-")
+	addLoadFlags(convertFlags, &convertUc.load)
+
+	ic := InfoConfig{}
+	infoFlags := flag.NewFlagSet("info", flag.ExitOnError)
+	infoFlags.BoolVar(&ic.tokens, "tokens", false, "list every token with its frame and file offset")
+	addEncoderFlag(infoFlags, &ic.encoder, "encoder for .ymp files that don't record it")
+
+	ec := EditConfig{}
+	addEditFlags := func(fs *flag.FlagSet) {
+		addEncoderFlag(fs, &ec.uc.encoder, "encoder for packed output, and .ymp input that doesn't record it")
+		fs.StringVar(&ec.uc.format, "format", "bin", "packed output format: "+strings.Join(outputFormats, "|"))
+		fs.StringVar(&ec.uc.label, "label", "", "symbol name for source output (default from output filename)")
+		fs.StringVar(&ec.uc.target, "target", "st", "playback machine for packed output: "+ymp.TargetNames())
+		fs.BoolVar(&ec.uc.padding, "padding", false, "add zero bytes for cache into packed output")
+		fs.IntVar(&ec.cacheSize, "cachesize", ymp.NumStreams*512, "overall cache size in bytes for packed output")
+		fs.BoolVar(&ec.uc.lha, "lha", false, "compress .ym output with LHA -lh5-")
+		addLoadFlags(fs, &ec.uc.load)
+	}
+	cutFlags := flag.NewFlagSet("cut", flag.ExitOnError)
+	addEditFlags(cutFlags)
+	cutFlags.IntVar(&ec.from, "from", 0, "first frame to keep")
+	cutFlags.IntVar(&ec.to, "to", 0, "frame to stop before (default the end)")
+	joinFlags := flag.NewFlagSet("join", flag.ExitOnError)
+	addEditFlags(joinFlags)
+	trimFlags := flag.NewFlagSet("trim-silence", flag.ExitOnError)
+	addEditFlags(trimFlags)
+	loopFlags := flag.NewFlagSet("detect-loop", flag.ExitOnError)
+	addEditFlags(loopFlags)
+	loopFlags.BoolVar(&ec.equiv, "equiv", false, "match frames that sound the same, ignoring unused register bits")
+	loopFlags.IntVar(&ec.minLoop, "min-length", 100, "shortest loop to look for, in frames")
 	helpFlags := flag.NewFlagSet("help", flag.ExitOnError)
 
 	var commands map[string]CliCommand
@@ -1160,7 +1130,7 @@ func main() {
 			os.Exit(1)
 		}
 		cfg := FilePackConfig{}
-		cfg.cacheSizes = FilledSlice(numStreams, *packOptSize/numStreams)
+		cfg.cacheSizes = FilledSlice(ymp.NumStreams, *packOptSize/ymp.NumStreams)
 		cfg.uc = uc
 		return CommandCustom(files[0], files[1], cfg)
 	}
@@ -1172,7 +1142,7 @@ func main() {
 			fmt.Println("'quick' command: expected <input> <output> arguments")
 			os.Exit(1)
 		}
-		return CommandQuick(files[0], files[1], uc)
+		return CommandQuick(ctx, files[0], files[1], uc)
 	}
 
 	cmdSmall := func(args []string) error {
@@ -1182,7 +1152,23 @@ func main() {
 			fmt.Println("'small' command: expected <input> <output> arguments")
 			os.Exit(1)
 		}
-		return CommandSmall(files[0], files[1], uc)
+		return CommandSmall(ctx, files[0], files[1], uc)
+	}
+
+	cmdBatch := func(args []string) error {
+		batchFlags.Parse(args)
+		dirs := batchFlags.Args()
+		if len(dirs) != 2 {
+			fmt.Println("'batch' command: expected <indir> <outdir> arguments")
+			os.Exit(1)
+		}
+		modes, err := ParseBatchModes(*batchModeList)
+		if err != nil {
+			return err
+		}
+		bc.modes = modes
+		bc.uc = uc
+		return CommandBatch(ctx, dirs[0], dirs[1], bc)
 	}
 
 	cmdSimple := func(args []string) error {
@@ -1192,7 +1178,7 @@ func main() {
 			fmt.Println("'simple' command: expected <input> <output> arguments")
 			os.Exit(1)
 		}
-		return CommandSimple(files[0], files[1])
+		return CommandSimple(files[0], files[1], os.Stdout)
 	}
 
 	cmdDelta := func(args []string) error {
@@ -1202,7 +1188,107 @@ func main() {
 			fmt.Println("'delta' command: expected <input> <output> arguments")
 			os.Exit(1)
 		}
-		return CommandDelta(files[0], files[1])
+		return CommandDelta(files[0], files[1], os.Stdout)
+	}
+
+	cmdRender := func(args []string) error {
+		renderFlags.Parse(args)
+		files := renderFlags.Args()
+		if len(files) != 2 {
+			fmt.Println("'render' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandRender(files[0], files[1], ac)
+	}
+
+	cmdCompare := func(args []string) error {
+		compareFlags.Parse(args)
+		files := compareFlags.Args()
+		if len(files) != 2 {
+			fmt.Println("'compare' command: expected <input1> <input2> arguments")
+			os.Exit(1)
+		}
+		return CommandCompare(files[0], files[1], ac, cc)
+	}
+
+	cmdPlayerGen := func(args []string) error {
+		playerGenFlags.Parse(args)
+		files := playerGenFlags.Args()
+		if len(files) != 2 {
+			fmt.Println("'player-gen' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandPlayerGen(files[0], files[1])
+	}
+
+	cmdConvertClock := func(args []string) error {
+		convertClockFlags.Parse(args)
+		files := convertClockFlags.Args()
+		if len(files) != 2 {
+			fmt.Println("'convert-clock' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandConvertClock(files[0], files[1], clockUc)
+	}
+
+	cmdConvert := func(args []string) error {
+		convertFlags.Parse(args)
+		files := convertFlags.Args()
+		if len(files) != 2 {
+			fmt.Println("'convert' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandConvert(files[0], files[1], convertUc)
+	}
+
+	cmdInfo := func(args []string) error {
+		infoFlags.Parse(args)
+		files := infoFlags.Args()
+		if len(files) != 1 {
+			fmt.Println("'info' command: expected <input> argument")
+			os.Exit(1)
+		}
+		return CommandInfo(files[0], ic)
+	}
+
+	cmdCut := func(args []string) error {
+		files := parseWithFiles(cutFlags, args)
+		if len(files) != 2 {
+			fmt.Println("'cut' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandCut(files[0], files[1], ec)
+	}
+
+	cmdJoin := func(args []string) error {
+		files := parseWithFiles(joinFlags, args)
+		if len(files) != 3 {
+			fmt.Println("'join' command: expected <input1> <input2> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandJoin(files[0], files[1], files[2], ec)
+	}
+
+	cmdTrim := func(args []string) error {
+		files := parseWithFiles(trimFlags, args)
+		if len(files) != 2 {
+			fmt.Println("'trim-silence' command: expected <input> <output> arguments")
+			os.Exit(1)
+		}
+		return CommandTrimSilence(files[0], files[1], ec)
+	}
+
+	cmdDetectLoop := func(args []string) error {
+		files := parseWithFiles(loopFlags, args)
+		if len(files) != 1 && len(files) != 2 {
+			fmt.Println("'detect-loop' command: expected <input> [output] arguments")
+			os.Exit(1)
+		}
+		outputPath := ""
+		if len(files) == 2 {
+			outputPath = files[1]
+		}
+		return CommandDetectLoop(files[0], outputPath, ec)
 	}
 
 	cmdHelp := func(args []string) error {
@@ -1223,12 +1309,23 @@ func main() {
 	}
 
 	commands = map[string]CliCommand{
-		"pack":   {cmdCustom, customFlags, "<input> <output>", "pack with custom settings"},
-		"quick":  {cmdQuick, quickFlags, "<input> <output>", "pack to small with quick runtime"},
-		"small":  {cmdSmall, smallFlags, "<input> <output>", "pack to smallest runtime memory (more CPU)"},
-		"simple": {cmdSimple, simpleFlags, "<input> <output>", "de-interleave to per-frame register values"},
-		"delta":  {cmdDelta, deltaFlags, "<input> <output>", "delta-pack file"},
-		"help":   {cmdHelp, helpFlags, "", "list commands or describe a single command"},
+		"pack":          {cmdCustom, customFlags, "<input> <output>", "pack with custom settings"},
+		"quick":         {cmdQuick, quickFlags, "<input> <output>", "pack to small with quick runtime"},
+		"small":         {cmdSmall, smallFlags, "<input> <output>", "pack to smallest runtime memory (more CPU)"},
+		"batch":         {cmdBatch, batchFlags, "<indir> <outdir>", "pack every tune in a directory tree, with a summary"},
+		"simple":        {cmdSimple, simpleFlags, "<input> <output>", "de-interleave to per-frame register values"},
+		"delta":         {cmdDelta, deltaFlags, "<input> <output>", "delta-pack file"},
+		"render":        {cmdRender, renderFlags, "<input> <output.wav>", "play YM or .ymp file through PSG emulator to .wav"},
+		"compare":       {cmdCompare, compareFlags, "<input1> <input2>", "check two YM or .ymp files sound the same"},
+		"player-gen":    {cmdPlayerGen, playerGenFlags, "<input.ymp> <output.s>", "generate a 68000 player specialised for one .ymp file"},
+		"convert":       {cmdConvert, convertFlags, "<input> <output.ym>", "convert any supported input to a YM6 file"},
+		"convert-clock": {cmdConvertClock, convertClockFlags, "<input> <output.ym>", "convert periods to a different PSG clock"},
+		"info":          {cmdInfo, infoFlags, "<input.ymp|.yd|.yu>", "print the structure of a packed file"},
+		"cut":           {cmdCut, cutFlags, "<input> <output> -from N -to M", "keep a range of frames"},
+		"join":          {cmdJoin, joinFlags, "<input1> <input2> <output>", "play one tune after another"},
+		"trim-silence":  {cmdTrim, trimFlags, "<input> <output>", "remove silent frames from the start and end"},
+		"detect-loop":   {cmdDetectLoop, loopFlags, "<input> [output]", "find a repeat at the end, and cut to one playthrough"},
+		"help":          {cmdHelp, helpFlags, "", "list commands or describe a single command"},
 	}
 
 	if len(os.Args) < 2 {
@@ -1248,6 +1345,7 @@ func main() {
 	err := cmd.fn(os.Args[2:])
 	if err != nil {
 		fmt.Println("Error: ", err.Error())
+		stop()
 		os.Exit(1)
 	}
 }
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"miny/miny/ymp"
 )
 
 func check(condition bool, t *testing.T, msg string, args ...any) {
@@ -11,131 +20,506 @@ func check(condition bool, t *testing.T, msg string, args ...any) {
 	}
 }
 
-func costsForMatches(enc Encoder, test *testing.T) {
-	var t Token
-	var m Match
-
-	input := make([]byte, 512)
-	t.isMatch = true
-	for tlen := 1; tlen < 512; tlen++ {
-		m.len = tlen
-		t.len = tlen
-		for toff := 1; toff < 512; toff++ {
-			m.off = toff
-			t.off = toff
-			cost := enc.Cost(0, m)
-			encoded := NewPackStream()
-			enc.Encode(&t, encoded, input)
-			if encoded.BitCount() != cost {
-				test.Errorf("match_cost failure, len %d off %d: got %d, want %d",
-					tlen, toff, encoded.BitCount(), cost)
-			}
-		}
+func TestCanonicalRegisters(t *testing.T) {
+	var a, b ymp.RawRegisters
+	for reg := 0; reg < ymp.NumYmRegs; reg++ {
+		a.Data[reg] = make([]byte, 1)
+		b.Data[reg] = make([]byte, 1)
 	}
+	// Channel A tone only, channel B and C silent
+	a.Data[7][0] = 0x3e
+	b.Data[7][0] = 0x3e | 0xc0
+	a.Data[8][0] = 0xf
+	b.Data[8][0] = 0xf
+	a.Data[0][0], a.Data[1][0] = 0x34, 0x02
+	b.Data[0][0], b.Data[1][0] = 0x34, 0xf2 // unused top bits
+	b.Data[2][0] = 0x55                     // tone B, but B is silent
+	b.Data[6][0] = 0x1f                     // noise, but unused
+	b.Data[11][0] = 0x10                    // envelope period, but unused
+	a.Data[13][0] = 0xff
+	b.Data[13][0] = 0xff
+
+	result := CompareRegisters(&a, &b)
+	check(result.Passed(), t, "expected equivalent registers, diffs %v", result.diffs)
+
+	// The fixed volume doesn't matter in envelope mode
+	a.Data[9][0], b.Data[9][0] = 0x10, 0x1f
+	a.Data[11][0] = b.Data[11][0]
+	result = CompareRegisters(&a, &b)
+	check(result.Passed(), t, "expected envelope volumes to be equivalent, diffs %v", result.diffs)
+	b.Data[9][0] = 0x0f
+	result = CompareRegisters(&a, &b)
+	check(!result.Passed(), t, "expected envelope and fixed volume to differ")
+	b.Data[9][0] = 0x10
+
+	// Envelope restarts always matter
+	b.Data[13][0] = 0x8
+	result = CompareRegisters(&a, &b)
+	check(!result.Passed(), t, "expected envelope write to differ")
 }
 
-func costsForLits(enc Encoder, test *testing.T) {
-	var t Token
-	var m Match
+func TestRenderConfig(t *testing.T) {
+	rawRegs := ymp.RawRegisters{ClockHz: ymp.ClockSpectrum, PlayHz: 60}
+	ac := AudioConfig{sampleRate: 44100}
+	rc, err := ac.RenderConfig(&rawRegs)
+	check(err == nil && rc.ClockHz == ymp.ClockSpectrum && rc.FrameRate == 60, t, "from file: %+v, %v", rc, err)
+
+	ac.clock, ac.frameRate = "cpc", 50
+	rc, err = ac.RenderConfig(&rawRegs)
+	check(err == nil && rc.ClockHz == ymp.ClockCPC && rc.FrameRate == 50, t, "from flags: %+v, %v", rc, err)
+
+	rc, _ = (&AudioConfig{}).RenderConfig(&ymp.RawRegisters{})
+	check(rc.ClockHz == ymp.ClockAtariST && rc.FrameRate == 50, t, "defaults: %+v", rc)
+}
+
+func TestInfo(t *testing.T) {
+	ymStr, err := LoadStreamFile("../test_data/led2.ym", UserConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := FilePackConfig{}
+	cfg.cacheSizes = FilledSlice(ymp.NumStreams, 256)
+	cfg.uc.encoder = 1
+	packResults, err := ymp.PackAll(ymStr, cfg.packConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	good := dir + "/good.ymp"
+	os.WriteFile(good, packResults.PackedData, 0644)
+	check(CommandInfo(good, InfoConfig{encoder: 1}) == nil, t, "info failed on a valid file")
+
+	truncated := dir + "/truncated.ymp"
+	os.WriteFile(truncated, packResults.PackedData[:300], 0644)
+	check(CommandInfo(truncated, InfoConfig{encoder: 1}) != nil, t, "info accepted a truncated file")
+
+	badSize := dir + "/bad.yu"
+	os.WriteFile(badSize, []byte{'Y', 'U', 0, 2, 1, 2, 3}, 0644)
+	check(CommandInfo(badSize, InfoConfig{}) != nil, t, "info accepted a .yu file with the wrong size")
+}
+
+func TestPackReport(t *testing.T) {
+	ymStr, err := LoadStreamFile("../test_data/sanxion.ym", UserConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := FilePackConfig{}
+	cfg.cacheSizes = FilledSlice(ymp.NumStreams, 128)
+	cfg.cacheSizes[12] = 32
+	cfg.uc.encoder = 2
+	packResults, err := ymp.PackAll(ymStr, cfg.packConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := NewPackReport("pack", "in", "out", cfg.uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.SetResults(ymStr, packResults, &cfg)
+
+	streamTotal, dataTotal := 0, 0
+	for _, sr := range report.Streams {
+		streamTotal += sr.PackedBytes
+		dataTotal += sr.LiteralBytes + sr.MatchBytes
+	}
+	check(report.HeaderSize+streamTotal == report.PackedSize, t, "stream sizes %d + header %d != packed size %d",
+		streamTotal, report.HeaderSize, report.PackedSize)
+	check(dataTotal == ymStr.DataSize, t, "token bytes %d != data size %d", dataTotal, ymStr.DataSize)
+	check(len(report.CacheSets) == 2, t, "cache sets = %v", report.CacheSets)
+	for _, sr := range report.Streams {
+		check(sr.PackedLiteralData+sr.PackedLiteralHeaders+sr.PackedMatches == sr.PackedBytes, t,
+			"stream %d: split sizes don't add up to %d", sr.Index, sr.PackedBytes)
+	}
+	setTotal := 0
+	for _, set := range report.CacheSets {
+		setTotal += set.PackedBytes
+	}
+	check(setTotal == streamTotal, t, "cache set sizes %d != stream sizes %d", setTotal, streamTotal)
+
+	_, err = NewPackReport("pack", "in", "out", UserConfig{report: "xml"})
+	check(err != nil, t, "unknown report format accepted")
 
-	input := make([]byte, 512)
+	// Progress goes to stderr with JSON, leaving stdout alone
+	uc := UserConfig{report: reportJSON}
+	check(uc.output() == os.Stderr, t, "JSON progress output is %v", uc.output())
+	uc.out = io.Discard
+	check(uc.output() == io.Discard, t, "progress writer ignored")
+}
 
-	t.isMatch = false
-	for tlen := 1; tlen < 512; tlen++ {
-		cost := enc.Cost(tlen, m)
-		t.len = tlen
-		encoded := NewPackStream()
-		enc.Encode(&t, encoded, input)
-		if encoded.BitCount() != cost {
-			test.Errorf("lit_cost failure: len %d: result %d, expected %d", tlen, encoded.BitCount(), cost)
+func TestSourceOutput(t *testing.T) {
+	dir := t.TempDir()
+	ymStr, err := LoadStreamFile("../test_data/led2.ym", UserConfig{out: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := ymp.PackConfig{CacheSizes: FilledSlice(ymp.NumStreams, 256), Encoder: 1, Padding: true}
+	pr, err := ymp.PackAll(ymStr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sizes mean the same in every format: packed data without the
+	// cache padding, and the cache
+	for _, format := range []string{"vasm", "gas", "c"} {
+		path := dir + "/tune." + format
+		if err := WritePackedFile(path, format, "", pr); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
 		}
-		enc.Reset()
+		size, cacheSize, ok := readSourceSizes(data)
+		check(ok && size == len(pr.PackedData)-pr.PaddingSize && cacheSize == pr.CacheSize, t,
+			"%s: sizes %d, %d", format, size, cacheSize)
+	}
+
+	for _, label := range []string{"my-tune", "9lives", "tune.data"} {
+		check(CheckOutputFormat("c", label) != nil, t, "label '%s' accepted", label)
+		check(WritePackedFile(dir+"/bad.h", "c", label, pr) != nil, t, "label '%s' written", label)
 	}
+	check(CheckOutputFormat("vasm", "_tune2") == nil, t, "good label rejected")
 }
 
-func TestEncV2(t *testing.T) {
-	var costs = []struct {
-		lit                int
-		matchlen, matchoff int
-		want               int
-	}{
-		{1, 0, 0, 2 * 8}, // 1 literal == 1 byte + 1 lit
-		{2, 0, 0, 3 * 8},
-		{15, 0, 0, (15 + 1) * 8},
-		{16, 0, 0, (16 + 2) * 8},
-		{255, 0, 0, (255 + 2) * 8},
-		{256, 0, 0, (256 + 4) * 8}, // 00 00 00 256
-
-		{0, 1, 1, 1 * 8}, // match of 1,1 -> 1 byte
-	}
-	var e Encoder_v2
-	for _, tt := range costs {
-		e.numLiterals = 0 // reset
-		ans := e.Cost(tt.lit, Match{tt.matchlen, tt.matchoff})
-		if ans != tt.want {
-			t.Errorf("cost failure: got %d, want %d", ans, tt.want)
+func TestGeneratePlayer(t *testing.T) {
+	ymStr, err := LoadStreamFile("../test_data/led2.ym", UserConfig{out: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := func(encoder int, target string) []byte {
+		cfg := ymp.PackConfig{CacheSizes: FilledSlice(ymp.NumStreams, 256), Encoder: encoder, Target: target}
+		pr, err := ymp.PackAll(ymStr, cfg)
+		if err != nil {
+			t.Fatal(err)
 		}
+		return pr.PackedData
+	}
+	var source bytes.Buffer
+	err = GeneratePlayer(&source, pack(1, "st"), "led2.ymp")
+	check(err == nil && source.Len() != 0, t, "v1 player failed: %v", err)
+	check(GeneratePlayer(io.Discard, pack(2, "st"), "led2.ymp") != nil, t, "v2 file accepted")
+	check(GeneratePlayer(io.Discard, pack(1, "spectrum"), "led2.ymp") != nil, t, "little-endian file accepted")
+}
 
-		if tt.lit != 0 {
-			testname := fmt.Sprintf("lit_cost %d", tt.lit)
-			t.Run(testname, func(t *testing.T) {
-				ans := e.litCost(tt.lit)
-				if ans != tt.want {
-					t.Errorf("lit_cost failure: got %d, want %d", ans, tt.want)
-				}
-			})
+func TestBatch(t *testing.T) {
+	inDir, outDir := t.TempDir(), t.TempDir()
+	data, err := os.ReadFile("../test_data/led2.ym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(inDir+"/sub", 0755)
+	os.WriteFile(inDir+"/sub/led2.ym", data, 0644)
+	os.WriteFile(inDir+"/bad.ym", []byte("junk"), 0644)
+	os.WriteFile(inDir+"/notes.txt", []byte("ignored"), 0644)
+
+	modes, err := ParseBatchModes("simple,delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := BatchConfig{modes: modes, summaryPath: outDir + "/summary.json"}
+	bc.uc.format = "bin"
+	bc.uc.out = io.Discard
+	err = CommandBatch(context.Background(), inDir, outDir, bc)
+	check(err != nil, t, "expected the bad file to be reported as an error")
+
+	readSummary := func() []BatchResult {
+		var results []BatchResult
+		data, err := os.ReadFile(bc.summaryPath)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if tt.matchlen != 0 {
-			testname := fmt.Sprintf("match_cost %d,%d", tt.matchlen, tt.matchoff)
-			t.Run(testname, func(t *testing.T) {
-				m := Match{tt.matchlen, tt.matchoff}
-				ans := e.matchCost(m)
-				if ans != tt.want {
-					t.Errorf("match_cost failure: got %d, want %d", ans, tt.want)
-				}
-			})
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	results := readSummary()
+	check(len(results) == 4, t, "results = %d", len(results))
+	statuses := ""
+	for _, res := range results {
+		statuses += res.Input + ":" + res.Status + " "
+	}
+	check(statuses == "bad.ym:failed bad.ym:failed sub/led2.ym:packed sub/led2.ym:packed ", t, "statuses = %s", statuses)
+	check(results[2].OutputSize == 4+ymp.NumYmRegs*8365, t, "simple output size = %d", results[2].OutputSize)
+
+	// Outputs are now newer than the inputs
+	CommandBatch(context.Background(), inDir, outDir, bc)
+	results = readSummary()
+	check(results[2].Status == "up to date" && results[3].Status == "up to date", t, "expected up to date, got %+v", results[2:])
+
+	// Source output records the cache size too, and a new cache size
+	// makes the output out of date
+	bc.modes = []string{"pack"}
+	bc.uc.format = "vasm"
+	bc.uc.encoder = 2
+	bc.cacheSize = ymp.NumStreams * 256
+	CommandBatch(context.Background(), inDir, outDir, bc)
+	results = readSummary()
+	check(results[1].Status == "packed" && results[1].CacheSize == bc.cacheSize, t, "vasm result %+v", results[1])
+	CommandBatch(context.Background(), inDir, outDir, bc)
+	results = readSummary()
+	check(results[1].Status == "up to date" && results[1].CacheSize == bc.cacheSize, t, "vasm result %+v", results[1])
+	bc.cacheSize = ymp.NumStreams * 128
+	CommandBatch(context.Background(), inDir, outDir, bc)
+	results = readSummary()
+	check(results[1].Status == "packed" && results[1].CacheSize == bc.cacheSize, t, "vasm result %+v", results[1])
+
+	// -padding makes the file bigger, but needs no more RAM
+	bc.force = true
+	bc.uc.format = "bin"
+	CommandBatch(context.Background(), inDir, outDir, bc)
+	totalRAM := readSummary()[1].TotalRAM
+	bc.uc.padding = true
+	for _, format := range outputFormats {
+		bc.uc.format = format
+		CommandBatch(context.Background(), inDir, outDir, bc)
+		results = readSummary()
+		check(results[1].TotalRAM == totalRAM, t, "%s with padding: total RAM %d, want %d", format,
+			results[1].TotalRAM, totalRAM)
+	}
+
+	_, err = ParseBatchModes("quick,fast")
+	check(err != nil, t, "unknown mode accepted")
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := NewWorkerPool(2)
+	var done [20]bool
+	err := pool.Run(context.Background(), len(done), func(i int) error {
+		done[i] = true
+		return nil
+	})
+	check(err == nil, t, "unexpected error %v", err)
+	for i := range done {
+		check(done[i], t, "task %d not run", i)
+	}
+
+	// The first error stops new tasks and is returned
+	started := 0
+	errBad := errors.New("bad size")
+	pool = NewWorkerPool(1)
+	err = pool.Run(context.Background(), 20, func(i int) error {
+		started++
+		if i == 3 {
+			return errBad
 		}
+		return nil
+	})
+	check(err == errBad, t, "error = %v", err)
+	check(started <= 5, t, "%d tasks started after the error", started)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ymStr, err := LoadStreamFile("../test_data/led2.ym", UserConfig{})
+	if err != nil {
+		t.Fatal(err)
 	}
+	_, err = MinpackFindCacheSize(ctx, NewWorkerPool(0), ymStr, 64, 1024, 32, "broad", UserConfig{encoder: 1, out: io.Discard})
+	check(err == context.Canceled, t, "cancelled search returned %v", err)
 }
 
-func TestMatchCosts_V1(t *testing.T) {
-	t.Log("Testing match length for Encoder_v1")
-	var e1 Encoder_v1
-	costsForMatches(&e1, t)
+func TestEditCommands(t *testing.T) {
+	dir := t.TempDir()
+	input := "../test_data/led2.ym"
+	ec := EditConfig{cacheSize: ymp.NumStreams * 256}
+	ec.uc.encoder = 2
+	ec.uc.format = "bin"
+
+	err := CommandTrimSilence(input, dir+"/trimmed.ym", ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed, err := LoadTuneFile(dir+"/trimmed.ym", 0, ymp.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(trimmed.Data[0]) == 8365-54-151, t, "trimmed to %d frames", len(trimmed.Data[0]))
+
+	// Straight to a packed file, and back
+	ec.from, ec.to = 100, 600
+	err = CommandCut(dir+"/trimmed.ym", dir+"/cut.ymp", ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut, err := LoadTuneFile(dir+"/cut.ymp", 0, ymp.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(cut.Data[0]) == 500, t, "cut to %d frames", len(cut.Data[0]))
+	check(bytes.Equal(cut.Data[0], trimmed.Data[0][100:600]), t, "cut data differs")
+
+	ec.to = 50
+	check(CommandCut(input, dir+"/bad.ym", ec) != nil, t, "cut with -to before -from accepted")
+
+	err = CommandJoin(dir+"/cut.ymp", dir+"/trimmed.ym", dir+"/joined.yd", ec)
+	check(err == nil, t, "join failed: %v", err)
+	check(CommandInfo(dir+"/joined.yd", InfoConfig{}) == nil, t, "joined .yd file is bad")
 }
 
-func TestLitCosts_V1(t *testing.T) {
-	t.Log("Testing lit length for Encoder_v1")
-	var e1 Encoder_v1
-	costsForLits(&e1, t)
+func TestConvertCommand(t *testing.T) {
+	dir := t.TempDir()
+	rawRegs, err := LoadRegisterFile("../test_data/led2.ym", ymp.LoadOptions{}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Loops at the start of the second playthrough
+	twice, err := ymp.JoinRegisters(rawRegs, rawRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteYmFile(dir+"/twice.ym", twice, false); err != nil {
+		t.Fatal(err)
+	}
+
+	uc := UserConfig{rateTo: 25}
+	if err := CommandConvert(dir+"/twice.ym", dir+"/slow.ym", uc); err != nil {
+		t.Fatal(err)
+	}
+	slow, err := LoadTuneFile(dir+"/slow.ym", 0, ymp.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numFrames := len(rawRegs.Data[0])
+	check(len(slow.Data[0]) == numFrames, t, "converted to %d frames", len(slow.Data[0]))
+	check(slow.PlayHz == 25, t, "frame rate is %d Hz", slow.PlayHz)
+	check(slow.LoopFrame == numFrames/2, t, "loop frame is %d", slow.LoopFrame)
+	check(slow.Title == rawRegs.Title, t, "title is '%s'", slow.Title)
+
+	// Nothing to do at the same rate
+	uc.rateTo = 50
+	if err := CommandConvert(dir+"/twice.ym", dir+"/same.ym", uc); err != nil {
+		t.Fatal(err)
+	}
+	same, err := LoadTuneFile(dir+"/same.ym", 0, ymp.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(same.Data[0]) == 2*numFrames, t, "unconverted file has %d frames", len(same.Data[0]))
+
+	check(CommandConvertClock(dir+"/twice.ym", dir+"/bad.ym", UserConfig{}) != nil, t,
+		"clock conversion without -to accepted")
 }
 
-func TestMatchCosts_V2(t *testing.T) {
-	t.Log("Testing match length for Encoder_v2")
-	var e2 Encoder_v2
-	costsForMatches(&e2, t)
+func TestDetectLoopCommand(t *testing.T) {
+	dir := t.TempDir()
+	rawRegs, err := LoadRegisterFile("../test_data/led2.ym", ymp.LoadOptions{}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two playthroughs, the second with the mixer's I/O port bits set,
+	// which don't change the sound
+	twice, err := ymp.JoinRegisters(rawRegs, rawRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numFrames := len(rawRegs.Data[0])
+	for frame := numFrames; frame < 2*numFrames; frame++ {
+		twice.Data[7][frame] |= 0xc0
+	}
+	if err := WriteYmFile(dir+"/twice.ym", twice, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ec := EditConfig{minLoop: 100}
+	check(CommandDetectLoop(dir+"/twice.ym", dir+"/exact.ym", ec) != nil, t, "exact loop found")
+	ec.equiv = true
+	err = CommandDetectLoop(dir+"/twice.ym", dir+"/once.ym", ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	once, err := LoadTuneFile(dir+"/once.ym", 0, ymp.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(once.Data[0]) == numFrames && once.LoopFrame == 0, t, "cut to %d frames, loop frame %d",
+		len(once.Data[0]), once.LoopFrame)
 }
 
-func TestLitCosts_V2(t *testing.T) {
-	t.Log("Testing lit length for Encoder_v2")
-	var e1 Encoder_v2
-	costsForLits(&e1, t)
+// Packed .ymp sizes for the files in test_data, by file, mode and
+// encoder name. A change that makes any of these bigger is a compression
+// regression; if it is smaller, update the table.
+var goldenSizes = map[string]int{
+	"led2.ym pack v1":     4609,
+	"led2.ym pack v2":     4346,
+	"led2.ym quick v1":    5201,
+	"led2.ym quick v2":    4822,
+	"led2.ym small v1":    5336,
+	"led2.ym small v2":    5021,
+	"motus.ym pack v1":    32096,
+	"motus.ym pack v2":    30755,
+	"motus.ym quick v1":   32427,
+	"motus.ym quick v2":   30927,
+	"motus.ym small v1":   32968,
+	"motus.ym small v2":   31557,
+	"sanxion.ym pack v1":  12515,
+	"sanxion.ym pack v2":  12427,
+	"sanxion.ym quick v1": 14359,
+	"sanxion.ym quick v2": 14111,
+	"sanxion.ym small v1": 11052,
+	"sanxion.ym small v2": 11244,
 }
 
-func TestPackStreamBits(t *testing.T) {
-	p := NewPackStream()
-	check(len(p.bitData) == 0, t, "bitsize failure")
-	for i := 0; i < 8; i++ {
-		p.AddBit(1)
-		p.AddBit(0)
-	}
-	check(len(p.bitData) == 1, t, "bitsize failure")
-	for i := 0; i < 7; i++ {
-		p.AddBit(1)
-		p.AddBit(0)
-	}
-	check(len(p.bitData) == 2, t, "bitsize failure")
-	check(p.bitData[0] == 0xaaaa, t, "bitdata failure 0")
-	check(p.bitData[1] == 0xaaa8, t, "bitdata failure 1")
-	check(p.bitCount == 30, t, "bitcount = %d", p.bitCount)
+// Pack every file in test_data with each mode and encoder, check that
+// the output decodes back to the original streams, and compare the
+// size with goldenSizes. The search modes are skipped with -short.
+func TestGoldenRoundTrip(t *testing.T) {
+	inputs, err := filepath.Glob("../test_data/*.ym")
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no test_data files: %v", err)
+	}
+	modes := []string{"pack", "quick", "small"}
+	if testing.Short() {
+		modes = modes[:1]
+	}
+
+	dir := t.TempDir()
+	for _, inputPath := range inputs {
+		name := filepath.Base(inputPath)
+		for _, mode := range modes {
+			for _, encInfo := range ymp.Encoders() {
+				key := fmt.Sprintf("%s %s %s", name, mode, encInfo.Name)
+				// The commands print progress, which isn't wanted here
+				uc := UserConfig{encoder: encInfo.ID, format: "bin", out: io.Discard}
+				outputPath := filepath.Join(dir, fmt.Sprintf("%s.%s.%s.ymp", name, mode, encInfo.Name))
+				switch mode {
+				case "pack":
+					cfg := FilePackConfig{uc: uc}
+					cfg.cacheSizes = FilledSlice(ymp.NumStreams, 512)
+					err = CommandCustom(inputPath, outputPath, cfg)
+				case "quick":
+					err = CommandQuick(context.Background(), inputPath, outputPath, uc)
+				case "small":
+					err = CommandSmall(context.Background(), inputPath, outputPath, uc)
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+
+				packed, err := os.ReadFile(outputPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The encoder is read from the header
+				unpacked, _, err := ymp.DecodeYmp(packed, nil)
+				if err != nil {
+					t.Fatalf("%s: decode failed: %v", key, err)
+				}
+				orig, err := LoadStreamFile(inputPath, uc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(unpacked.NumVbls == orig.NumVbls, t, "%s: %d frames, want %d", key, unpacked.NumVbls, orig.NumVbls)
+				for strm := 0; strm < ymp.NumStreams; strm++ {
+					check(bytes.Equal(unpacked.StreamData[strm], orig.StreamData[strm]), t,
+						"%s: stream %d differs", key, strm)
+				}
+
+				// Every registered encoder must have its sizes in the table
+				want, ok := goldenSizes[key]
+				if !ok {
+					t.Fatalf("%s: no golden size, packed to %d bytes; add it to goldenSizes", key, len(packed))
+				}
+				check(len(packed) == want, t, "%s: packed to %d bytes, golden size %d", key, len(packed), want)
+			}
+		}
+	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"miny/miny/ymp"
+)
+
+// Generates a 68000 player (vasm/Devpac syntax) specialised for a single .ymp file.
+// The header, cache set layout, stream order and cache sizes are all known,
+// so they are compiled into the code as constants and the set and stream
+// loops are fully unrolled.
+//
+// The generated routines use the same names and calling conventions
+// as player/ymp.s, so the output can be included in its place.
+type playerGen struct {
+	w   io.Writer
+	hdr *ymp.YmpHeader
+}
+
+func (g *playerGen) emit(format string, args ...any) {
+	fmt.Fprintf(g.w, format+"\n", args...)
+}
+
+// Offset of a stream's state in the player structure, by file position
+func streamStateLabel(filePos int) string {
+	return fmt.Sprintf("ymp_streams_state+%d", filePos*6)
+}
+
+func (g *playerGen) header(sourceName string) {
+	hdr := g.hdr
+	g.emit("; -----------------------------------------------------------------------")
+	g.emit(";	YMP PLAYER CODE (generated by miny player-gen)")
+	g.emit("; -----------------------------------------------------------------------")
+	g.emit("; Specialised for: %s", sourceName)
+	g.emit("; Only plays this exact file. Regenerate if the file is repacked.")
+	g.emit(";")
+	g.emit("; Cache sets:")
+	for setIdx, set := range hdr.Sets {
+		g.emit(";   set %d: size %5d, streams:", setIdx, set.CacheSize)
+		for _, strm := range set.Streams {
+			g.emit(";     %2d (%s)", strm, ymp.StreamNames[strm])
+		}
+	}
+	g.emit("")
+	g.emit("YMP_CACHE_SIZE\t\tequ\t%d\t\t\t; size of ds.b needed for the player cache", hdr.CacheSize)
+	g.emit("YMP_NUM_FRAMES\t\tequ\t%d", hdr.NumVbls)
+	g.emit("YMP_DATA_OFFSET\t\tequ\t%d\t\t\t; start of token data in the file", hdr.DataOffset)
+	g.emit("")
+	g.emit("; Per-stream state, in file order. Each is:")
+	g.emit(";   +0.l  match read pointer (cache or packed data)")
+	g.emit(";   +4.w  number of bytes left to copy")
+	g.emit("\t\t\trsreset")
+	g.emit("ymp_stream_read_ptr:\trs.l\t1\t\t\t; position in packed data we are reading from")
+	g.emit("ymp_vbl_countdown:\trs.l\t1\t\t\t; number of VBLs left to restart")
+	g.emit("ymp_tune_ptr:\t\trs.l\t1")
+	g.emit("ymp_cache_ptr:\t\trs.l\t1")
+	g.emit("ymp_set_offsets:\trs.w\t%d\t\t\t; cache write offset for each set", len(hdr.Sets))
+	g.emit("ymp_streams_state:\trs.b\t6*%d", ymp.NumStreams)
+	g.emit("ymp_output_buffer:\trs.b\t%d", ymp.NumStreams)
+	g.emit("\t\t\trs.b\t%d\t\t\t; pad to even offset", ymp.NumStreams&1)
+	g.emit("ymp_size:\t\trs.b\t0")
+	g.emit("")
+}
+
+func (g *playerGen) init() {
+	hdr := g.hdr
+	g.emit("; -----------------------------------------------------------------------")
+	g.emit("; a0 = player state (ds.b ymp_size)")
+	g.emit("; a1 = start of packed ym data")
+	g.emit("; a2 = start of player cache (ds.b YMP_CACHE_SIZE)")
+	g.emit("ymp_player_init:")
+	g.emit("\tmove.l\ta1,ymp_tune_ptr(a0)")
+	g.emit("\tmove.l\ta2,ymp_cache_ptr(a0)")
+	g.emit("ymp_player_restart:")
+	g.emit("\tmove.l\tymp_tune_ptr(a0),a1")
+	g.emit("\tadd.l\t#YMP_DATA_OFFSET,a1")
+	g.emit("\tmove.l\ta1,ymp_stream_read_ptr(a0)")
+	g.emit("\tmove.l\t#YMP_NUM_FRAMES,ymp_vbl_countdown(a0)")
+	for setIdx := range hdr.Sets {
+		g.emit("\tclr.w\tymp_set_offsets+%d(a0)", setIdx*2)
+	}
+	for filePos := 0; filePos < ymp.NumStreams; filePos++ {
+		g.emit("\tclr.l\t%s(a0)", streamStateLabel(filePos))
+		g.emit("\tmove.w\t#1,%s+4(a0)", streamStateLabel(filePos))
+	}
+	g.emit("\trts")
+	g.emit("")
+}
+
+// Emit the depack code for a single stream.
+func (g *playerGen) stream(filePos int, cacheSize int) {
+	state := streamStateLabel(filePos)
+	strm := g.hdr.RegOrder[filePos]
+	g.emit("\t; ---- stream %d (%s), file position %d", strm, ymp.StreamNames[strm], filePos)
+	g.emit("\tsubq.w\t#1,%s+4(a0)", state)
+	g.emit("\tbne.s\t.copy%d\t\t\t\t; still copying from the last token", filePos)
+	g.emit("\tmoveq\t#0,d0")
+	g.emit("\tmove.b\t(a1)+,d0")
+	g.emit("\tbclr\t#7,d0")
+	g.emit("\tbne.s\t.lit%d", filePos)
+
+	// Match
+	g.emit("\ttst.b\td0")
+	g.emit("\tbne.s\t.mcount%d", filePos)
+	g.emit("\tmove.b\t(a1)+,d0\t\t\t; extended count")
+	g.emit("\tlsl.w\t#8,d0")
+	g.emit("\tmove.b\t(a1)+,d0")
+	g.emit(".mcount%d:", filePos)
+	g.emit("\tmove.w\td0,%s+4(a0)", state)
+	g.emit("\tmoveq\t#0,d0\t\t\t\t; d0 = offset")
+	g.emit(".moff%d:", filePos)
+	g.emit("\tmove.b\t(a1)+,d4")
+	g.emit("\tbne.s\t.moffdone%d", filePos)
+	g.emit("\tadd.w\t#255,d0")
+	g.emit("\tbra.s\t.moff%d", filePos)
+	g.emit(".moffdone%d:", filePos)
+	g.emit("\tadd.w\td4,d0")
+	g.emit("\tmove.l\ta2,a5\t\t\t\t; apply offset backwards from write ptr")
+	g.emit("\tadd.l\t#%d,a5", cacheSize)
+	g.emit("\tsub.l\td0,a5")
+	g.emit("\tcmp.l\td5,a5\t\t\t\t; past cache end?")
+	g.emit("\tblt.s\t.mok%d", filePos)
+	g.emit("\tsub.l\t#%d,a5", cacheSize)
+	g.emit(".mok%d:", filePos)
+	g.emit("\tmove.l\ta5,%s(a0)", state)
+	g.emit("\tbra.s\t.copy%d", filePos)
+
+	// Literals
+	g.emit(".lit%d:", filePos)
+	g.emit("\ttst.b\td0")
+	g.emit("\tbne.s\t.lcount%d", filePos)
+	g.emit("\tmove.b\t(a1)+,d0\t\t\t; extended count")
+	g.emit("\tlsl.w\t#8,d0")
+	g.emit("\tmove.b\t(a1)+,d0")
+	g.emit(".lcount%d:", filePos)
+	g.emit("\tmove.w\td0,%s+4(a0)", state)
+	g.emit("\tmove.l\ta1,%s(a0)", state)
+	g.emit("\tadd.l\td0,a1\t\t\t\t; skip literals in packed data")
+
+	// Copy the next byte into the cache and the output
+	g.emit(".copy%d:", filePos)
+	g.emit("\tmove.l\t%s(a0),a5", state)
+	g.emit("\tmove.b\t(a5)+,d0")
+	g.emit("\tmove.b\td0,(a2)")
+	g.emit("\tcmp.l\td5,a5\t\t\t\t; has match read ptr hit end of cache?")
+	g.emit("\tbne.s\t.nowrap%d", filePos)
+	g.emit("\tsub.l\t#%d,a5", cacheSize)
+	g.emit(".nowrap%d:", filePos)
+	g.emit("\tmove.l\ta5,%s(a0)", state)
+	g.emit("\tmove.b\td0,ymp_output_buffer+%d(a0)", filePos)
+}
+
+func (g *playerGen) update() {
+	hdr := g.hdr
+	g.emit("; -----------------------------------------------------------------------")
+	g.emit("; a0 = player state")
+	g.emit("ymp_player_update:")
+	g.emit("\tmove.l\tymp_stream_read_ptr(a0),a1\t; a1 = packed data stream")
+	g.emit("\tmove.l\tymp_cache_ptr(a0),a4\t\t; a4 = cache base")
+	g.emit("\tmoveq\t#0,d4\t\t\t\t; d4 = clear so offsets can use add.w")
+
+	filePos := 0
+	setBase := 0
+	for setIdx, set := range hdr.Sets {
+		g.emit("\t;=============================================")
+		g.emit("\t; Set %d: %d streams, cache size %d", setIdx, len(set.Streams), set.CacheSize)
+		g.emit("\tmoveq\t#0,d7")
+		g.emit("\tmove.w\tymp_set_offsets+%d(a0),d7\t; d7 = set cache write offset", setIdx*2)
+		g.emit("\tmove.l\ta4,a2")
+		if setBase != 0 {
+			g.emit("\tadd.l\t#%d,a2", setBase)
+		}
+		g.emit("\tmove.l\ta2,d5")
+		g.emit("\tadd.l\t#%d,d5\t\t\t; d5 = stream cache end ptr", set.CacheSize)
+		g.emit("\tadd.l\td7,a2\t\t\t\t; a2 = stream cache write ptr")
+		for i := range set.Streams {
+			if i != 0 {
+				g.emit("\tadd.l\t#%d,a2\t\t\t; next stream cache", set.CacheSize)
+				g.emit("\tadd.l\t#%d,d5", set.CacheSize)
+			}
+			g.stream(filePos, set.CacheSize)
+			filePos++
+		}
+		g.emit("\t; Update and wrap the set offset")
+		g.emit("\taddq.w\t#1,d7")
+		g.emit("\tcmp.w\t#%d,d7", set.CacheSize)
+		g.emit("\tbne.s\t.nosetwrap%d", setIdx)
+		g.emit("\tmoveq\t#0,d7")
+		g.emit(".nosetwrap%d:", setIdx)
+		g.emit("\tmove.w\td7,ymp_set_offsets+%d(a0)", setIdx*2)
+		setBase += set.CacheSize * len(set.Streams)
+	}
+	g.emit("\tmove.l\ta1,ymp_stream_read_ptr(a0)")
+	g.emit("")
+
+	out := func(strm int) string {
+		return fmt.Sprintf("ymp_output_buffer+%d(a0)", hdr.Remap[strm])
+	}
+	g.emit("\t; Generate the mixer register from the top bits of the volume streams")
+	g.emit("\tmove.b\t%s,d1\t; d1 = mixer A", out(7))
+	g.emit("\tmove.b\t%s,d2\t; d2 = mixer B", out(8))
+	g.emit("\tmove.b\t%s,d3\t; d3 = mixer C", out(9))
+	g.emit("\tmoveq\t#0,d4")
+	for i := 0; i < 2; i++ {
+		g.emit("\tadd.b\td3,d3")
+		g.emit("\taddx.w\td4,d4")
+		g.emit("\tadd.b\td2,d2")
+		g.emit("\taddx.w\td4,d4")
+		g.emit("\tadd.b\td1,d1")
+		g.emit("\taddx.w\td4,d4")
+	}
+	g.emit("")
+	g.emit("\tlea\t$ffff8800.w,a3")
+	for reg := 0; reg < 7; reg++ {
+		g.emit("\tmove.b\t#%d,(a3)", reg)
+		g.emit("\tmove.b\t%s,2(a3)", out(reg))
+	}
+	g.emit("\tmove.b\t#7,(a3)")
+	g.emit("\tmove.b\t(a3),d1")
+	g.emit("\tand.b\t#$c0,d1\t\t\t\t; preserve top 2 bits (port A/B direction)")
+	g.emit("\tor.b\td1,d4")
+	g.emit("\tmove.b\td4,2(a3)")
+	for reg := 8; reg < 13; reg++ {
+		g.emit("\tmove.b\t#%d,(a3)", reg)
+		g.emit("\tmove.b\t%s,2(a3)", out(reg-1))
+	}
+	g.emit("\tmove.b\t%s,d0", out(12))
+	g.emit("\tbmi.s\t.skip_env\t\t\t; only write if value is not -1")
+	g.emit("\tmove.b\t#13,(a3)")
+	g.emit("\tmove.b\td0,2(a3)")
+	g.emit(".skip_env:")
+	g.emit("")
+	g.emit("\t; Check for tune restart")
+	g.emit("\tsubq.l\t#1,ymp_vbl_countdown(a0)")
+	g.emit("\tbne.s\t.no_tune_restart")
+	g.emit("\tbsr\tymp_player_restart")
+	g.emit(".no_tune_restart:")
+	g.emit("\trts")
+}
+
+// Write a specialised player for the given .ymp file data.
+// Like player/ymp.s, the player reads a big-endian header and decodes
+// the "v1" encoder only.
+func GeneratePlayer(w io.Writer, data []byte, sourceName string) error {
+	hdr, err := ymp.ParseYmpHeader(data)
+	if err != nil {
+		return err
+	}
+	if hdr.LittleEndian {
+		return errors.New("the file has a little-endian header, which the 68000 player can't read (pack with -target st)")
+	}
+	v1, err := ymp.LookupEncoder("v1")
+	if err != nil {
+		return err
+	}
+	// Files from before the encoder was recorded are all v1
+	if hdr.Encoder != 0 && hdr.Encoder != v1.ID {
+		info, err := ymp.GetEncoderInfo(hdr.Encoder)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("the player only decodes the 'v1' encoder, not '%s' (pack with -encoder v1)", info.Name)
+	}
+	g := playerGen{w: w, hdr: hdr}
+	g.header(sourceName)
+	g.init()
+	g.update()
+	return nil
+}
+
+func CommandPlayerGen(inputPath string, outputPath string) error {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return err
+	}
+	fh, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	err = GeneratePlayer(w, data, inputPath)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Limits the number of packing tasks that run at once.
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// Create a pool running up to "jobs" tasks at once, or one per CPU if
+// jobs is 0.
+func NewWorkerPool(jobs int) *WorkerPool {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	return &WorkerPool{slots: make(chan struct{}, jobs)}
+}
+
+// Run task(0) ... task(numTasks-1) on the pool and wait for them.
+// Stops starting new tasks after the first error, or when the context
+// is cancelled, and returns that error.
+func (wp *WorkerPool) Run(ctx context.Context, numTasks int, task func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+launch:
+	for i := 0; i < numTasks; i++ {
+		select {
+		case wp.slots <- struct{}{}:
+		case <-ctx.Done():
+			break launch
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-wp.slots }()
+			if ctx.Err() != nil {
+				return
+			}
+			if err := task(i); err != nil {
+				fail(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
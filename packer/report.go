@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"miny/miny/ymp"
+)
+
+// Report formats for the pack commands.
+const (
+	reportText = "text"
+	reportJSON = "json"
+)
+
+// Machine-readable summary of a pack command, written with -report json.
+// The field names are part of the output format, so must stay stable.
+type PackReport struct {
+	Command      string             `json:"command"`
+	Input        string             `json:"input"`
+	Output       string             `json:"output"`
+	Encoder      int                `json:"encoder"`
+	Target       string             `json:"target"`
+	Format       string             `json:"format"`
+	Search       []SearchReport     `json:"search"`
+	Frames       int                `json:"frames"`
+	OriginalSize int                `json:"originalSize"`
+	HeaderSize   int                `json:"headerSize"`
+	PackedSize   int                `json:"packedSize"` // header plus token data
+	CacheSize    int                `json:"cacheSize"`
+	TotalRAM     int                `json:"totalRam"`
+	PaddingSize  int                `json:"paddingSize"`
+	CacheSets    []CacheSetReport   `json:"cacheSets"`
+	Streams      []StreamReport     `json:"streams"`
+	TimingsMs    map[string]float64 `json:"timingsMs"`
+
+	format string
+	start  time.Time
+}
+
+// Parameters of one cache size search pass.
+type SearchReport struct {
+	Phase  string `json:"phase"`
+	Min    int    `json:"min"`
+	Max    int    `json:"max"`
+	Step   int    `json:"step"`
+	Chosen int    `json:"chosen"`
+}
+
+type CacheSetReport struct {
+	CacheSize   int   `json:"cacheSize"`
+	Streams     []int `json:"streams"`
+	PackedBytes int   `json:"packedBytes"` // encoded size of all the streams in the set
+}
+
+type StreamReport struct {
+	Index        int    `json:"index"`
+	Name         string `json:"name"`
+	CacheSize    int    `json:"cacheSize"`
+	Literals     int    `json:"literals"` // number of literal tokens
+	Matches      int    `json:"matches"`  // number of match tokens
+	LiteralBytes int    `json:"literalBytes"`
+	MatchBytes   int    `json:"matchBytes"`
+	PackedBytes  int    `json:"packedBytes"`
+	// Split of PackedBytes: literal data, literal token headers and match tokens
+	PackedLiteralData    int `json:"packedLiteralData"`
+	PackedLiteralHeaders int `json:"packedLiteralHeaders"`
+	PackedMatches        int `json:"packedMatches"`
+}
+
+// Where the human-readable output of a command goes: uc.out if set,
+// otherwise stdout, or stderr with -report json so that stdout only
+// has the JSON.
+func (uc *UserConfig) output() io.Writer {
+	if uc.out != nil {
+		return uc.out
+	}
+	if uc.report == reportJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Start a report for a pack command.
+func NewPackReport(command string, inputPath string, outputPath string, uc UserConfig) (*PackReport, error) {
+	format := uc.report
+	if format == "" {
+		format = reportText
+	}
+	if format != reportText && format != reportJSON {
+		return nil, fmt.Errorf("unknown report format '%s' (text|json)", format)
+	}
+	return &PackReport{
+		Command:   command,
+		Input:     inputPath,
+		Output:    outputPath,
+		Encoder:   uc.encoder,
+		Target:    uc.target,
+		Format:    uc.format,
+		Search:    []SearchReport{},
+		TimingsMs: make(map[string]float64),
+		format:    format,
+		start:     time.Now(),
+	}, nil
+}
+
+// Record how long a phase took, since "start".
+func (r *PackReport) Time(phase string, start time.Time) {
+	r.TimingsMs[phase] += float64(time.Since(start).Microseconds()) / 1000
+}
+
+func (r *PackReport) AddSearch(phase string, min int, max int, step int, chosen int) {
+	r.Search = append(r.Search, SearchReport{phase, min, max, step, chosen})
+}
+
+// Fill in the sizes and per-stream stats from the final pack.
+func (r *PackReport) SetResults(ymStr *ymp.YmStreams, pr *ymp.PackResults, fileCfg *FilePackConfig) {
+	r.Frames = pr.NumVbls
+	r.OriginalSize = ymStr.DataSize
+	r.HeaderSize = pr.HeaderSize
+	r.PackedSize = len(pr.PackedData) - pr.PaddingSize
+	r.CacheSize = pr.CacheSize
+	r.TotalRAM = r.PackedSize + pr.CacheSize
+	r.PaddingSize = pr.PaddingSize
+
+	r.Streams = []StreamReport{}
+	for strm := 0; strm < ymp.NumStreams; strm++ {
+		sr := StreamReport{
+			Index:       strm,
+			Name:        ymp.StreamNames[strm],
+			CacheSize:   fileCfg.cacheSizes[strm],
+			PackedBytes: (pr.LitBits[strm] + pr.MatchBits[strm]) / 8,
+		}
+		for _, t := range (*pr.Tokens)[strm] {
+			if t.IsMatch {
+				sr.Matches++
+				sr.MatchBytes += t.Len
+			} else {
+				sr.Literals++
+				sr.LiteralBytes += t.Len
+			}
+		}
+		sr.PackedLiteralData = sr.LiteralBytes
+		sr.PackedLiteralHeaders = pr.LitBits[strm]/8 - sr.LiteralBytes
+		sr.PackedMatches = pr.MatchBits[strm] / 8
+		r.Streams = append(r.Streams, sr)
+	}
+
+	r.CacheSets = []CacheSetReport{}
+	for _, set := range pr.Sets {
+		sr := CacheSetReport{CacheSize: set.CacheSize, Streams: set.Streams}
+		for _, strm := range set.Streams {
+			sr.PackedBytes += r.Streams[strm].PackedBytes
+		}
+		r.CacheSets = append(r.CacheSets, sr)
+	}
+}
+
+// Write the report to stdout, if the JSON format was chosen.
+func (r *PackReport) Write() error {
+	if r.format != reportJSON {
+		return nil
+	}
+	r.Time("total", r.start)
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
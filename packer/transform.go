@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"miny/miny/ymp"
+)
+
+// Apply the user's conversions to loaded register data, before it
+// is remapped and packed. This is shared by all the pack commands.
+func ApplyTransforms(rawRegs *ymp.RawRegisters, uc UserConfig) error {
+	target, err := ymp.GetTargetProfile(uc.target)
+	if err != nil {
+		return err
+	}
+	if uc.clockFrom != "" {
+		// Override the clock for files that don't record it (e.g. YM3)
+		rawRegs.ClockHz, err = ymp.ParseClock(uc.clockFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := uc.output()
+	if target.AyRegisters {
+		numChanged := ymp.MaskAyRegisters(rawRegs)
+		if uc.verbose && numChanged != 0 {
+			fmt.Fprintf(w, "Target %s: cleared unused bits in %d register values\n", target.Name, numChanged)
+		}
+	}
+
+	toHz := 0
+	if uc.clockTo != "" {
+		toHz, err = ymp.ParseClock(uc.clockTo)
+		if err != nil {
+			return err
+		}
+	} else if uc.retune {
+		toHz = target.ClockHz
+	}
+	if toHz != 0 {
+		cc := ymp.ConvertClock(rawRegs, toHz)
+		PrintClockConversion(w, cc)
+	}
+	return nil
+}
+
+// Work out the frame rate to convert to from "fromHz", as set in the
+// user config. Returns 0 if there is nothing to do.
+func targetRate(fromHz int, uc UserConfig) int {
+	if uc.rateTo == 0 {
+		return 0
+	}
+	toHz := uc.rateTo
+	if uc.multiSpeed {
+		factor := ymp.MultiSpeedFactor(fromHz, uc.rateTo)
+		toHz = uc.rateTo * factor
+		if factor != 1 {
+			fmt.Fprintf(uc.output(), "Multi-speed: %d updates per frame, call the player update %d times per frame\n",
+				factor, factor)
+		}
+	}
+	if toHz == fromHz {
+		return 0
+	}
+	return toHz
+}
+
+// Convert the frame rate of the streams, as set in the user config.
+// Returns the new streams, or the original ones if there is nothing to do.
+func ApplyRateConversion(ymStr *ymp.YmStreams, playHz int, uc UserConfig) (*ymp.YmStreams, error) {
+	fromHz := playHz
+	if uc.rateFrom != 0 {
+		fromHz = uc.rateFrom
+	}
+	toHz := targetRate(fromHz, uc)
+	if toHz == 0 {
+		return ymStr, nil
+	}
+	out, err := ymp.ResampleStreams(ymStr, fromHz, toHz)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(uc.output(), "Converted frame rate from %d Hz to %d Hz (%d -> %d frames)\n",
+		fromHz, toHz, ymStr.NumVbls, out.NumVbls)
+	return out, nil
+}
+
+// As ApplyRateConversion, for register data that is written out
+// rather than packed. The strings and clock are kept, PlayHz is set
+// to the new rate and the loop frame is moved to match.
+// The original data can't be used after this.
+func ApplyRegisterRateConversion(rawRegs *ymp.RawRegisters, uc UserConfig) (*ymp.RawRegisters, error) {
+	if uc.rateFrom != 0 {
+		rawRegs.PlayHz = uc.rateFrom
+	}
+	fromHz := rawRegs.PlayHz
+	toHz := targetRate(fromHz, uc)
+	if toHz == 0 {
+		return rawRegs, nil
+	}
+	ymStr, err := ymp.RemapFromRaw(rawRegs)
+	if err != nil {
+		return nil, err
+	}
+	resampled, err := ymp.ResampleStreams(ymStr, fromHz, toHz)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(uc.output(), "Converted frame rate from %d Hz to %d Hz (%d -> %d frames)\n",
+		fromHz, toHz, ymStr.NumVbls, resampled.NumVbls)
+	out := ymp.RemapToRaw(resampled)
+	out.ClockHz, out.PlayHz = rawRegs.ClockHz, toHz
+	out.Title, out.Author, out.Comment = rawRegs.Title, rawRegs.Author, rawRegs.Comment
+	out.LoopFrame = int(int64(rawRegs.LoopFrame) * int64(toHz) / int64(fromHz))
+	return out, nil
+}
+
+// Print a summary of the conversion, with warnings for values
+// that went out of range.
+func PrintClockConversion(w io.Writer, cc *ymp.ClockConversion) {
+	fmt.Fprintf(w, "Converted periods from %d Hz to %d Hz clock\n", cc.FromHz, cc.ToHz)
+	if cc.NumClamped() == 0 {
+		return
+	}
+	for ch := 0; ch < 3; ch++ {
+		if cc.ToneClamped[ch] != 0 {
+			fmt.Fprintf(w, "WARNING: channel %s has %d frames with notes out of range\n",
+				channelNames[ch], cc.ToneClamped[ch])
+		}
+	}
+	if cc.NoiseClamped != 0 {
+		fmt.Fprintf(w, "WARNING: %d frames with noise period out of range\n", cc.NoiseClamped)
+	}
+	if cc.EnvClamped != 0 {
+		fmt.Fprintf(w, "WARNING: %d frames with envelope period out of range\n", cc.EnvClamped)
+	}
+	fmt.Fprintf(w, "WARNING: first out of range value at frame %d\n", cc.FirstFrame)
+}
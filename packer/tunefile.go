@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"miny/miny/ymp"
+)
+
+// Load register data from a file, printing any notes from the loader
+// to "w".
+func LoadRegisterFile(inputPath string, opts ymp.LoadOptions, w io.Writer) (*ymp.RawRegisters, error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	return loadRegisterData(data, opts, w)
+}
+
+func loadRegisterData(data []byte, opts ymp.LoadOptions, w io.Writer) (*ymp.RawRegisters, error) {
+	rawRegs, err := ymp.LoadRawRegisters(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range rawRegs.Messages {
+		fmt.Fprintln(w, msg)
+	}
+	return rawRegs, nil
+}
+
+// Load register data from either a raw YM file, or a packed .ymp
+// file (which is unpacked with the encoder recorded in it, or the
+// given encoder for older files).
+func LoadTuneFile(inputPath string, encoder int, opts ymp.LoadOptions) (*ymp.RawRegisters, error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if ymp.IsYmpData(data) {
+		hdr, err := ymp.ParseYmpHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := hdr.NewEncoder(encoder)
+		if err != nil {
+			return nil, err
+		}
+		ymStr, _, err := ymp.DecodeYmp(data, enc)
+		if err != nil {
+			return nil, err
+		}
+		return ymp.RemapToRaw(ymStr), nil
+	}
+	return loadRegisterData(data, opts, os.Stdout)
+}
+
+// Write register data as a YM6 file, optionally LHA-compressed as
+// expected by most YM players.
+func WriteYmFile(outputPath string, rawRegs *ymp.RawRegisters, lha bool) error {
+	output := ymp.EncodeYM6(rawRegs)
+	if lha {
+		output = ymp.LhaPack(filepath.Base(outputPath), output)
+	}
+	return os.WriteFile(outputPath, output, 0644)
+}
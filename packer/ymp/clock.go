@@ -0,0 +1,87 @@
+package ymp
+
+// Records the period values which could not be represented at the
+// new clock, and had to be clamped.
+type ClockConversion struct {
+	FromHz       int
+	ToHz         int
+	ToneClamped  [3]int // number of frames, per channel
+	NoiseClamped int
+	EnvClamped   int
+	FirstFrame   int // first frame with a clamped value, or -1
+}
+
+func (cc *ClockConversion) NumClamped() int {
+	return cc.ToneClamped[0] + cc.ToneClamped[1] + cc.ToneClamped[2] + cc.NoiseClamped + cc.EnvClamped
+}
+
+func (cc *ClockConversion) clamp(frame int, count *int) {
+	*count++
+	if cc.FirstFrame < 0 {
+		cc.FirstFrame = frame
+	}
+}
+
+// Scale a period value for a new master clock, rounding to the
+// nearest value and clamping to the register's range.
+// Returns the new value, and true if it had to be clamped.
+func scalePeriod(period int, fromHz int, toHz int, maxPeriod int) (int, bool) {
+	if period == 0 {
+		// Period 0 acts like period 1 on the chip, and is usually
+		// just an unused channel, so leave it alone.
+		return 0, false
+	}
+	scaled := (int64(period)*int64(toHz) + int64(fromHz)/2) / int64(fromHz)
+	if scaled < 1 {
+		return 1, true
+	}
+	if scaled > int64(maxPeriod) {
+		return maxPeriod, true
+	}
+	return int(scaled), false
+}
+
+// Rescale the tone, noise and envelope periods so that the tune plays
+// at the same pitch on a machine with a different master clock.
+// Tone periods are 12 bits, noise 5 bits and the envelope 16 bits.
+func ConvertClock(rawRegs *RawRegisters, toHz int) *ClockConversion {
+	cc := ClockConversion{FromHz: rawRegs.ClockHz, ToHz: toHz, FirstFrame: -1}
+	fromHz := rawRegs.ClockHz
+	rawRegs.ClockHz = toHz
+	if fromHz == toHz || fromHz == 0 {
+		return &cc
+	}
+
+	numFrames := len(rawRegs.Data[0])
+	for frame := 0; frame < numFrames; frame++ {
+		// Tone periods: 12 bits over 2 registers
+		for ch := 0; ch < 3; ch++ {
+			lo := rawRegs.Data[ch*2]
+			hi := rawRegs.Data[ch*2+1]
+			period := int(lo[frame]) | int(hi[frame]&0xf)<<8
+			period, clamped := scalePeriod(period, fromHz, toHz, 0xfff)
+			if clamped {
+				cc.clamp(frame, &cc.ToneClamped[ch])
+			}
+			lo[frame] = byte(period)
+			hi[frame] = byte(period >> 8)
+		}
+
+		// Noise period: 5 bits
+		noise, clamped := scalePeriod(int(rawRegs.Data[6][frame]&0x1f), fromHz, toHz, 0x1f)
+		if clamped {
+			cc.clamp(frame, &cc.NoiseClamped)
+		}
+		rawRegs.Data[6][frame] = byte(noise)
+
+		// Envelope period: 16 bits
+		env := int(rawRegs.Data[11][frame]) | int(rawRegs.Data[12][frame])<<8
+		env, clamped = scalePeriod(env, fromHz, toHz, 0xffff)
+		if clamped {
+			cc.clamp(frame, &cc.EnvClamped)
+		}
+		rawRegs.Data[11][frame] = byte(env)
+		rawRegs.Data[12][frame] = byte(env >> 8)
+	}
+	return &cc
+}
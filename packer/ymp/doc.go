@@ -0,0 +1,16 @@
+// Package ymp packs YM2149/AY-3-8910 register data into the .ymp
+// format played back by the miny players, and unpacks it again.
+//
+// Register data is loaded with LoadRawRegisters (YM, VGM, PSG, SNDH
+// and PT3 files, optionally gzip or LHA compressed), converted to
+// streams with RemapFromRaw, then packed with PackAll. DecodeYmp
+// unpacks a .ymp file with the Encoder it was packed with, which is
+// recorded in the header.
+//
+// Encoders register themselves with RegisterEncoder, giving a name,
+// ID and limits, and are found with GetEncoder or LookupEncoder.
+//
+// Functions take and return byte slices, with io.Reader and io.Writer
+// versions where useful. Nothing is printed: errors are returned, and
+// any notes from loading a file are in RawRegisters.Messages.
+package ymp
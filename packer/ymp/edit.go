@@ -0,0 +1,100 @@
+package ymp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returns a copy of frames [from, to) of the register data, with the
+// same clock, frame rate and strings.
+//
+// The loop frame moves with the data, or goes to the start if it was
+// outside the range. If the envelope shape is not written on the first
+// frame, the last shape written before it is, so the envelope plays
+// the same as it did at that point in the original.
+func CutRegisters(rawRegs *RawRegisters, from int, to int) (*RawRegisters, error) {
+	numFrames := len(rawRegs.Data[0])
+	if from < 0 || to > numFrames || from >= to {
+		return nil, fmt.Errorf("bad frame range %d-%d for %d frames", from, to, numFrames)
+	}
+	out := *rawRegs
+	out.Messages = nil
+	for reg := 0; reg < NumYmRegs; reg++ {
+		out.Data[reg] = append(ByteSlice(nil), rawRegs.Data[reg][from:to]...)
+	}
+	out.LoopFrame = rawRegs.LoopFrame - from
+	if rawRegs.LoopFrame < from || rawRegs.LoopFrame >= to {
+		out.LoopFrame = 0
+	}
+
+	if out.Data[13][0] == 0xff {
+		for frame := from - 1; frame >= 0; frame-- {
+			if shape := rawRegs.Data[13][frame]; shape != 0xff {
+				out.Data[13][0] = shape
+				break
+			}
+		}
+	}
+	return &out, nil
+}
+
+// Returns the register data of "a" followed by "b".
+//
+// The strings come from "a". The loop frame is taken from "b", since
+// that is what plays last: joining an intro to a looping section loops
+// back to the start of that section. Both must use the same clock and
+// frame rate; convert one of them first if not.
+func JoinRegisters(a *RawRegisters, b *RawRegisters) (*RawRegisters, error) {
+	if a.ClockHz != b.ClockHz {
+		return nil, fmt.Errorf("clocks differ (%d Hz and %d Hz)", a.ClockHz, b.ClockHz)
+	}
+	if a.PlayHz != b.PlayHz {
+		return nil, fmt.Errorf("frame rates differ (%d Hz and %d Hz)", a.PlayHz, b.PlayHz)
+	}
+	lenA := len(a.Data[0])
+	if lenA+len(b.Data[0]) > maxFrames {
+		return nil, fmt.Errorf("joined tune is longer than %d frames", maxFrames)
+	}
+	out := *a
+	out.Messages = nil
+	for reg := 0; reg < NumYmRegs; reg++ {
+		data := make(ByteSlice, 0, lenA+len(b.Data[reg]))
+		data = append(data, a.Data[reg]...)
+		out.Data[reg] = append(data, b.Data[reg]...)
+	}
+	out.LoopFrame = lenA + b.LoopFrame
+	return &out, nil
+}
+
+// Returns true if no channel makes any sound on a frame: every volume
+// is zero, and none use the envelope.
+func isSilentFrame(rawRegs *RawRegisters, frame int) bool {
+	for ch := 0; ch < 3; ch++ {
+		if volumeLevel(rawRegs.Data[8+ch][frame]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the register data without the silent frames at the start
+// and end, such as an emulator's lead-in before the tune starts, plus
+// the number of frames removed from each end.
+func TrimSilence(rawRegs *RawRegisters) (*RawRegisters, int, int, error) {
+	numFrames := len(rawRegs.Data[0])
+	from, to := 0, numFrames
+	for from < to && isSilentFrame(rawRegs, from) {
+		from++
+	}
+	for to > from && isSilentFrame(rawRegs, to-1) {
+		to--
+	}
+	if from == to {
+		return nil, 0, 0, errors.New("the whole tune is silent")
+	}
+	out, err := CutRegisters(rawRegs, from, to)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return out, from, numFrames - to, nil
+}
@@ -0,0 +1,243 @@
+package ymp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Describes a match or a series of literals.
+type Token struct {
+	IsMatch bool
+	Len     int // length in bytes
+	Off     int // reverse offset if isMatch, abs position if literal
+}
+
+// Describes a Match run.
+type Match struct {
+	Len int
+	Off int
+}
+
+// Interface for being able to encode a stream into a packed format.
+type Encoder interface {
+	// Calculate the Cost for adding literals or matches, or both
+	// Returns the cost in *bits*
+	Cost(litCount int, m Match) int
+
+	// Apply N literals to the internal state
+	ApplyLit(litCount int)
+	// Apply a ApplyMatch to the internal state
+	ApplyMatch(m Match)
+
+	// Encodes a single token a binary stream.
+	// Returns an error if the token can't be represented.
+	Encode(t *Token, p *PackStream, input []byte) error
+
+	// Reads a single token from a packed binary stream at "head".
+	// Returns the token and the position of the next token.
+	// For literals, the token's offset is the position of the literal
+	// bytes in the packed stream.
+	// Returns an error if the token runs past the end of the input.
+	DecodeToken(input []byte, head int) (Token, int, error)
+
+	// Unpacks the given packed binary stream.
+	Decode(input []byte) ([]byte, error)
+
+	// Clear internal state to restart
+	// (used for testing)
+	Reset()
+}
+
+// Describes an encoder, so that it can be chosen by name or ID and its
+// limits checked without knowing its type.
+type EncoderInfo struct {
+	ID          int // format ID, recorded in the .ymp header
+	Name        string
+	Desc        string
+	MaxMatchLen int  // longest match or literal run in a single token
+	MaxOffset   int  // furthest match offset
+	BitChannel  bool // writes single bits with PackStream.AddBit
+	New         func() Encoder
+}
+
+// All the registered encoders, in ID order.
+var encoders []EncoderInfo
+
+// Add an encoder to the list used by GetEncoder. Each encoder calls
+// this from init() in its own file.
+// IDs must fit in the header byte, and IDs and names must be unique.
+func RegisterEncoder(info EncoderInfo) {
+	if info.ID <= 0 || info.ID > 0xff {
+		panic(fmt.Sprintf("encoder '%s' has bad ID %d", info.Name, info.ID))
+	}
+	for _, e := range encoders {
+		if e.ID == info.ID || e.Name == info.Name {
+			panic(fmt.Sprintf("encoder '%s' (%d) registered twice", info.Name, info.ID))
+		}
+	}
+	encoders = append(encoders, info)
+	sort.Slice(encoders, func(i, j int) bool { return encoders[i].ID < encoders[j].ID })
+}
+
+// Returns all the registered encoders, in ID order.
+func Encoders() []EncoderInfo {
+	return append([]EncoderInfo(nil), encoders...)
+}
+
+// Returns the names of all the encoders, for help text.
+func EncoderNames() string {
+	names := []string{}
+	for _, e := range encoders {
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, "|")
+}
+
+func GetEncoderInfo(id int) (*EncoderInfo, error) {
+	for i := range encoders {
+		if encoders[i].ID == id {
+			return &encoders[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encoder ID %d (use %s)", id, EncoderNames())
+}
+
+// Find an encoder by its name, or by its ID as a decimal string.
+func LookupEncoder(nameOrID string) (*EncoderInfo, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return GetEncoderInfo(id)
+	}
+	for i := range encoders {
+		if encoders[i].Name == nameOrID {
+			return &encoders[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encoder '%s' (use %s)", nameOrID, EncoderNames())
+}
+
+// Returns a new encoder with the given ID.
+func GetEncoder(id int) (Encoder, error) {
+	info, err := GetEncoderInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	return info.New(), nil
+}
+
+// Appends the bytes described by a decoded token to the output.
+// Literals are copied from the packed input, matches from the
+// previously-decoded output.
+// Returns an error if the bytes to copy are outside the input or output.
+func ApplyToken(output []byte, t *Token, input []byte) ([]byte, error) {
+	if !t.IsMatch {
+		if t.Off < 0 || t.Off+t.Len > len(input) {
+			return output, errors.New("literals run past end of data")
+		}
+		// Copy the next "count" bytes of the packed stream to the output
+		return append(output, input[t.Off:t.Off+t.Len]...), nil
+	}
+	if t.Off <= 0 || t.Off > len(output) {
+		return output, fmt.Errorf("bad match offset %d with %d bytes unpacked", t.Off, len(output))
+	}
+	// Copy bytes from the previously-decoded data, at a distance of "offset"
+	matchPos := len(output) - t.Off
+	for count := t.Len; count > 0; count-- {
+		output = append(output, output[matchPos])
+		matchPos++
+	}
+	return output, nil
+}
+
+// Check that a token can be encoded: the length and match offset must
+// be within the encoder's limits, and literals must be inside the input.
+func checkToken(t *Token, input []byte, info *EncoderInfo) error {
+	if t.Len <= 0 || t.Len > info.MaxMatchLen {
+		return fmt.Errorf("token length %d out of range", t.Len)
+	}
+	if t.IsMatch {
+		if t.Off <= 0 || t.Off > info.MaxOffset {
+			return fmt.Errorf("bad match offset %d", t.Off)
+		}
+	} else if t.Off < 0 || t.Off+t.Len > len(input) {
+		return fmt.Errorf("literals at %d-%d are outside the %d byte input", t.Off, t.Off+t.Len, len(input))
+	}
+	return nil
+}
+
+// Reads the fields of a packed token. Reading past the end of the data
+// returns zeroes and records an error, which is checked once the token
+// has been read.
+type tokenReader struct {
+	input []byte
+	start int // offset of the token, for errors
+	head  int
+	err   error
+}
+
+func newTokenReader(input []byte, head int) *tokenReader {
+	return &tokenReader{input: input, start: head, head: head}
+}
+
+func (r *tokenReader) byte() int {
+	if r.head >= len(r.input) {
+		if r.err == nil {
+			r.err = fmt.Errorf("truncated token at offset %d", r.start)
+		}
+		return 0
+	}
+	val := int(r.input[r.head])
+	r.head++
+	return val
+}
+
+// A big-endian 16-bit count.
+func (r *tokenReader) word() int {
+	hi := r.byte()
+	return hi<<8 | r.byte()
+}
+
+// An offset as a run of zero bytes each adding 255, then a non-zero byte.
+func (r *tokenReader) offset() int {
+	offset := 0
+	for {
+		val := r.byte()
+		if r.err != nil || val != 0 {
+			return offset + val
+		}
+		offset += 255
+	}
+}
+
+// A literal token of "count" bytes, which follow it in the data.
+func (r *tokenReader) literals(count int) (Token, int, error) {
+	if r.err == nil && r.head+count > len(r.input) {
+		r.err = fmt.Errorf("literals at offset %d run past end of data", r.start)
+	}
+	return Token{false, count, r.head}, r.head + count, r.err
+}
+
+// Unpacks a stream of tokens with DecodeToken and ApplyToken.
+func decodeStream(enc Encoder, input []byte) ([]byte, error) {
+	output := make([]byte, 0)
+	head := 0
+	// Loop over all tokens
+	for head < len(input) {
+		t, next, err := enc.DecodeToken(input, head)
+		if err != nil {
+			return nil, err
+		}
+		output, err = ApplyToken(output, &t, input)
+		if err != nil {
+			return nil, fmt.Errorf("%v at offset %d", err, head)
+		}
+		// Each byte is one frame of a register
+		if len(output) > maxFrames {
+			return nil, fmt.Errorf("stream unpacks to more than %d bytes", maxFrames)
+		}
+		head = next
+	}
+	return output, nil
+}
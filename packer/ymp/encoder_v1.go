@@ -0,0 +1,146 @@
+package ymp
+
+import "fmt"
+
+type Encoder_v1 struct {
+	numLiterals int
+}
+
+var encoderV1Info = EncoderInfo{
+	ID:          1,
+	Name:        "v1",
+	Desc:        "byte-aligned, with a type bit and 7-bit length in the first byte",
+	MaxMatchLen: 0xffff,
+	MaxOffset:   0xffff,
+	New:         func() Encoder { return &Encoder_v1{} },
+}
+
+func init() {
+	RegisterEncoder(encoderV1Info)
+}
+
+func encodeCount(p *PackStream, count int, literalFlag byte) {
+	if count < 128 {
+		p.AddByte(byte(count) | literalFlag)
+	} else {
+		p.AddByte(0 | literalFlag)
+		p.AddWord(uint16(count))
+	}
+}
+
+func encodeOffset(p *PackStream, offset int) error {
+	if offset <= 0 {
+		return fmt.Errorf("can't encode match offset %d", offset)
+	}
+	for offset >= 256 {
+		// 256 can be encoded as "255 + 1"
+		p.AddByte(0)
+		offset -= 255
+	}
+	p.AddByte(byte(offset))
+	return nil
+}
+
+func (e *Encoder_v1) litCost(count int) int {
+	if count == 0 {
+		return 0
+	}
+	cost := 0
+	if count < 128 {
+		cost = 1 * 8
+	} else {
+		cost = 3 * 8
+	}
+	cost += count * 8 // needs the actual literal data too
+	return cost
+}
+
+// Calculate the byte cost of only a match
+func (e *Encoder_v1) matchCost(m Match) int {
+	cost := 0
+	// Match
+	// A match is always new, so apply full cost
+	if m.Len > 0 {
+		// length encoding
+		cost = 8
+		if m.Len >= 128 {
+			cost += 2 * 8
+		}
+		// offset encoding
+		cost += 8 // always 1 byte
+		offset := m.Off
+		for offset >= 256 {
+			cost += 8
+			offset -= 255
+		}
+	}
+	return cost
+}
+
+// Return the additional Cost (in bits) of adding literal(s) and match to an output stream
+func (e *Encoder_v1) Cost(litCount int, m Match) int {
+	cost := 0
+	if litCount != 0 {
+		// Check if literal count will increase cost
+		currLitCost := e.litCost(e.numLiterals)
+		nextLitCost := e.litCost(e.numLiterals + litCount)
+		cost += (nextLitCost - currLitCost)
+	}
+	cost += e.matchCost(m)
+	return cost
+}
+
+func (e *Encoder_v1) Encode(t *Token, p *PackStream, input []byte) error {
+	if err := checkToken(t, input, &encoderV1Info); err != nil {
+		return err
+	}
+	if t.IsMatch {
+		encodeCount(p, t.Len, 0)
+		return encodeOffset(p, t.Off)
+	}
+	// Encode the literal
+	encodeCount(p, t.Len, 0x80)
+	literals := input[t.Off : t.Off+t.Len]
+	// https://github.com/golang/go/issues/28292
+	p.AddBytes(literals)
+	return nil
+}
+
+// Reads a single token from the packed data at "head".
+// Returns the token, and the position of the token after it.
+func (e *Encoder_v1) DecodeToken(input []byte, head int) (Token, int, error) {
+	r := newTokenReader(input, head)
+	// Choose either match or literal, depending on the top bit of the next byte
+	top := r.byte()
+	var count int = top & 0x7f
+	if count == 0 {
+		count = r.word()
+	}
+	if (top & 0x80) != 0 {
+		// Literals
+		// These are encoded as "Length only", and the literal
+		// bytes follow directly in the packed data.
+		return r.literals(count)
+	}
+
+	// Match
+	// Encoded as "Length, then Offset"
+	offset := r.offset()
+	return Token{true, count, offset}, r.head, r.err
+}
+
+func (e *Encoder_v1) Decode(input []byte) ([]byte, error) {
+	return decodeStream(e, input)
+}
+
+func (e *Encoder_v1) ApplyLit(litCount int) {
+	e.numLiterals += litCount
+}
+
+func (e *Encoder_v1) ApplyMatch(m Match) {
+	e.numLiterals = 0
+}
+
+func (e *Encoder_v1) Reset() {
+	e.numLiterals = 0
+}
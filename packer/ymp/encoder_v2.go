@@ -1,9 +1,24 @@
-package main
+package ymp
+
+import "fmt"
 
 type Encoder_v2 struct {
 	numLiterals int
 }
 
+var encoderV2Info = EncoderInfo{
+	ID:          2,
+	Name:        "v2",
+	Desc:        "byte-aligned, with short matches in a single byte",
+	MaxMatchLen: 0xffff,
+	MaxOffset:   0xffff,
+	New:         func() Encoder { return &Encoder_v2{} },
+}
+
+func init() {
+	RegisterEncoder(encoderV2Info)
+}
+
 /*
 	Encoding scheme
 
@@ -33,16 +48,17 @@ func encodeCountV2(p *PackStream, count int) {
 	}
 }
 
-func encodeOffsetV2(p *PackStream, offset int) {
+func encodeOffsetV2(p *PackStream, offset int) error {
+	if offset <= 0 {
+		return fmt.Errorf("can't encode match offset %d", offset)
+	}
 	for offset >= 256 {
 		// 256 can be encoded as "255 + 1"
 		p.AddByte(0)
 		offset -= 255
 	}
-	if offset == 0 {
-		panic("Problem when encoding offset")
-	}
 	p.AddByte(byte(offset))
+	return nil
 }
 
 // Return the additional Cost (in bits) of adding literal(s) and match to an output stream
@@ -76,14 +92,14 @@ func (e *Encoder_v2) litCost(litCount int) int {
 
 // Calculate the byte cost of only a match
 func (e *Encoder_v2) matchCost(m Match) int {
-	if m.len == 0 {
+	if m.Len == 0 {
 		return 0
 	}
 	cost := 1 // header byte
 
 	// Length first
-	len := m.len
-	off := m.off
+	len := m.Len
+	off := m.Off
 	if len > 0xe {
 		cost++ // another byte
 		if len > 0xff {
@@ -102,93 +118,80 @@ func (e *Encoder_v2) matchCost(m Match) int {
 	return cost * 8
 }
 
-func (e *Encoder_v2) Encode(t *Token, p *PackStream, input []byte) {
-	if t.isMatch {
+func (e *Encoder_v2) Encode(t *Token, p *PackStream, input []byte) error {
+	if err := checkToken(t, input, &encoderV2Info); err != nil {
+		return err
+	}
+	if t.IsMatch {
 		var startLen byte = 0 // "more" marker
 		var startOff byte = 0 // "more" marker
-		if t.len <= 0xe {
-			startLen = byte(t.len)
+		if t.Len <= 0xe {
+			startLen = byte(t.Len)
 		}
-		if t.off <= 0xf {
-			startOff = byte(t.off)
+		if t.Off <= 0xf {
+			startOff = byte(t.Off)
 		}
 		p.AddByte(startLen<<4 | startOff)
 		// Now rest of length
-		if t.len > 0xe {
-			encodeCountV2(p, t.len)
+		if t.Len > 0xe {
+			encodeCountV2(p, t.Len)
 		}
 		// and rest of offset
-		if t.off > 0xf {
-			encodeOffsetV2(p, t.off)
+		if t.Off > 0xf {
+			return encodeOffsetV2(p, t.Off)
 		}
+		return nil
+	}
+	// Encode the literal
+	if t.Len <= 0xf {
+		p.AddByte(0xf0 + byte(t.Len))
 	} else {
-		// Encode the literal
-		if t.len <= 0xf {
-			p.AddByte(0xf0 + byte(t.len))
-		} else {
-			p.AddByte(0xf0)
-			encodeCountV2(p, t.len)
-		}
-		// Then copy literals
-		literals := input[t.off : t.off+t.len]
-		p.AddBytes(literals)
+		p.AddByte(0xf0)
+		encodeCountV2(p, t.Len)
 	}
+	// Then copy literals
+	literals := input[t.Off : t.Off+t.Len]
+	p.AddBytes(literals)
+	return nil
 }
 
-func (e *Encoder_v2) Decode(input []byte) []byte {
-	output := make([]byte, 0)
-	head := 0
-	for head < len(input) {
-		top := input[head]
-		if (top & 0xf0) == 0xf0 {
-			// Literals
-			// Length only
-			var count int = int(top & 0xf)
-			head++
+// Reads a single token from the packed data at "head".
+// Returns the token, and the position of the token after it.
+func (e *Encoder_v2) DecodeToken(input []byte, head int) (Token, int, error) {
+	r := newTokenReader(input, head)
+	top := r.byte()
+	if (top & 0xf0) == 0xf0 {
+		// Literals
+		// Length only
+		var count int = top & 0xf
+		if count == 0 {
+			count = r.byte()
 			if count == 0 {
-				count = int(input[head])
-				head++
-				if count == 0 {
-					count = int(input[head]) << 8
-					count |= int(input[head+1])
-					head += 2
-				}
-			}
-			output = append(output, input[head:head+count]...)
-			head += count
-		} else {
-			// Match
-			// Length + Offset encoded in one
-			var count int = int(top >> 4)
-			var off int = int(top & 0xf)
-			head++
-			if count == 0 {
-				count = int(input[head])
-				head++
-				if count == 0 {
-					count = int(input[head]) << 8
-					count |= int(input[head+1])
-					head += 2
-				}
-			}
-			if off == 0 {
-				// Longer offset, use prefix code
-				for input[head] == 0 {
-					off += 255
-					head++
-				}
-				off += int(input[head])
-				head++
-			}
-			matchPos := len(output) - off
-			for count > 0 {
-				output = append(output, output[matchPos])
-				matchPos++
-				count--
+				count = r.word()
 			}
 		}
+		return r.literals(count)
+	}
+
+	// Match
+	// Length + Offset encoded in one
+	var count int = top >> 4
+	var off int = top & 0xf
+	if count == 0 {
+		count = r.byte()
+		if count == 0 {
+			count = r.word()
+		}
+	}
+	if off == 0 {
+		// Longer offset, use prefix code
+		off = r.offset()
 	}
-	return output
+	return Token{true, count, off}, r.head, r.err
+}
+
+func (e *Encoder_v2) Decode(input []byte) ([]byte, error) {
+	return decodeStream(e, input)
 }
 
 func (e *Encoder_v2) ApplyLit(litCount int) {
@@ -0,0 +1,666 @@
+package ymp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// LHA archives with the -lh5- method, as used by most YM files.
+// -lh5- is LZSS with an 8K window, followed by Huffman coding of the
+// literals/lengths and of the match offsets in blocks.
+const (
+	lh5DictBits  = 13
+	lh5DictSize  = 1 << lh5DictBits
+	lh5MaxMatch  = 256
+	lh5Threshold = 3
+	lh5NC        = 255 + lh5MaxMatch + 2 - lh5Threshold // literal + length codes
+	lh5NP        = lh5DictBits + 1                      // offset codes
+	lh5NT        = 16 + 3                               // codes for the code lengths
+	lh5CBits     = 9
+	lh5PBits     = 4
+	lh5TBits     = 5
+	lh5MaxLen    = 16 // longest Huffman code
+	lh5BlockSize = 0x4000
+	lhaLevel0    = 22 // size of a level 0 header without the filename
+)
+
+// CRC-16 as used by LHA (polynomial 0xa001, reflected)
+func lhaCrc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Returns true if the data starts with an LHA file header.
+func IsLhaData(data []byte) bool {
+	return len(data) >= lhaLevel0 && data[2] == '-' && data[3] == 'l' && data[4] == 'h' && data[6] == '-'
+}
+
+// Extract the first file from an LHA archive.
+func LhaUnpack(data []byte) ([]byte, error) {
+	if !IsLhaData(data) {
+		return nil, errors.New("not an LHA archive")
+	}
+	method := string(data[2:7])
+	packedSize := int(binary.LittleEndian.Uint32(data[7:]))
+	origSize := int(binary.LittleEndian.Uint32(data[11:]))
+	level := data[20]
+
+	// The CRC of the unpacked file follows the filename in level 0
+	// and 1 headers, and is at a fixed place in level 2
+	var start, crcPos int
+	switch level {
+	case 0, 1:
+		start = 2 + int(data[0])
+		crcPos = lhaLevel0 + int(data[21])
+		if level == 1 {
+			// Extended headers are counted in the packed size
+			for next := start - 2; ; {
+				if next+2 > len(data) {
+					return nil, errors.New("truncated LHA header")
+				}
+				extSize := int(binary.LittleEndian.Uint16(data[next:]))
+				if extSize == 0 {
+					break
+				}
+				next = start + extSize - 2
+				start += extSize
+				packedSize -= extSize
+			}
+		}
+	case 2:
+		start = int(binary.LittleEndian.Uint16(data[0:]))
+		crcPos = 21
+	default:
+		return nil, fmt.Errorf("unsupported LHA header level %d", level)
+	}
+	if crcPos+2 > start {
+		return nil, errors.New("truncated LHA header")
+	}
+	if packedSize < 0 || start+packedSize > len(data) {
+		return nil, errors.New("truncated LHA data")
+	}
+	crc := binary.LittleEndian.Uint16(data[crcPos:])
+	if origSize > maxFileSize {
+		return nil, fmt.Errorf("LHA file too large, %d bytes", origSize)
+	}
+	packed := data[start : start+packedSize]
+
+	var output []byte
+	var err error
+	switch method {
+	case "-lh0-":
+		output = packed
+	case "-lh5-":
+		output, err = lh5Decode(packed, origSize)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LHA method %s", method)
+	}
+	if lhaCrc16(output) != crc {
+		return nil, errors.New("LHA CRC mismatch, the file is corrupt")
+	}
+	return output, nil
+}
+
+// Create an LHA archive with a level 0 header, containing one file
+// packed with -lh5-.
+func LhaPack(name string, data []byte) []byte {
+	packed := lh5Encode(data)
+	if len(name) > 255-lhaLevel0 {
+		name = name[:255-lhaLevel0]
+	}
+	var hdr []byte
+	hdr = append(hdr, 0, 0) // size and checksum, filled in below
+	hdr = append(hdr, "-lh5-"...)
+	hdr = EncLongLE(hdr, uint32(len(packed)))
+	hdr = EncLongLE(hdr, uint32(len(data)))
+	hdr = EncLongLE(hdr, 0) // MS-DOS time and date
+	hdr = append(hdr, 0x20, 0, byte(len(name)))
+	hdr = append(hdr, name...)
+	hdr = EncWordLE(hdr, lhaCrc16(data))
+	hdr[0] = byte(len(hdr) - 2)
+	sum := byte(0)
+	for _, b := range hdr[2:] {
+		sum += b
+	}
+	hdr[1] = sum
+
+	output := append(hdr, packed...)
+	return append(output, 0) // end of archive
+}
+
+// Reads bits MSB-first.
+type lhaBitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (br *lhaBitReader) bits(n int) int {
+	val := 0
+	for i := 0; i < n; i++ {
+		bit := 0
+		if br.pos>>3 < len(br.data) {
+			bit = int(br.data[br.pos>>3]>>(7-uint(br.pos&7))) & 1
+		}
+		br.pos++
+		val = val<<1 | bit
+	}
+	return val
+}
+
+// Canonical Huffman decoding table, built from code lengths.
+type lhaHuffman struct {
+	count  [lh5MaxLen + 1]int // number of codes of each length
+	symbol []int              // symbols ordered by code
+	single int                // the symbol, when only one is used
+}
+
+func newLhaHuffman(lengths []int) (*lhaHuffman, error) {
+	var h lhaHuffman
+	for _, l := range lengths {
+		if l > lh5MaxLen {
+			return nil, errors.New("bad LHA code length")
+		}
+		h.count[l]++
+	}
+	h.count[0] = 0
+	for l := 1; l <= lh5MaxLen; l++ {
+		for sym, sl := range lengths {
+			if sl == l {
+				h.symbol = append(h.symbol, sym)
+			}
+		}
+	}
+	// The code must be complete
+	left := 1
+	for l := 1; l <= lh5MaxLen; l++ {
+		left = left<<1 - h.count[l]
+		if left < 0 {
+			return nil, errors.New("bad LHA Huffman table")
+		}
+	}
+	if left != 0 {
+		return nil, errors.New("incomplete LHA Huffman table")
+	}
+	return &h, nil
+}
+
+func newLhaSingle(sym int) *lhaHuffman {
+	return &lhaHuffman{single: sym}
+}
+
+func (h *lhaHuffman) decode(br *lhaBitReader) int {
+	if h.symbol == nil {
+		return h.single
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= lh5MaxLen; l++ {
+		code |= br.bits(1)
+		count := h.count[l]
+		if code-first < count {
+			return h.symbol[index+code-first]
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0
+}
+
+// Read the code lengths for the T (code length) or P (offset) tables.
+func lh5ReadPtLen(br *lhaBitReader, nn int, nbits int, special int) (*lhaHuffman, error) {
+	n := br.bits(nbits)
+	if n == 0 {
+		return newLhaSingle(br.bits(nbits)), nil
+	}
+	if n > nn {
+		return nil, errors.New("bad LHA table size")
+	}
+	lengths := make([]int, nn)
+	for i := 0; i < n; {
+		l := br.bits(3)
+		if l == 7 {
+			for br.bits(1) == 1 {
+				l++
+			}
+		}
+		lengths[i] = l
+		i++
+		if i == special {
+			for zeros := br.bits(2); zeros > 0 && i < nn; zeros-- {
+				lengths[i] = 0
+				i++
+			}
+		}
+	}
+	return newLhaHuffman(lengths)
+}
+
+// Read the code lengths for the C (literal/length) table.
+func lh5ReadCLen(br *lhaBitReader, tTable *lhaHuffman) (*lhaHuffman, error) {
+	n := br.bits(lh5CBits)
+	if n == 0 {
+		return newLhaSingle(br.bits(lh5CBits)), nil
+	}
+	if n > lh5NC {
+		return nil, errors.New("bad LHA table size")
+	}
+	lengths := make([]int, lh5NC)
+	for i := 0; i < n; {
+		c := tTable.decode(br)
+		if c > 2 {
+			lengths[i] = c - 2
+			i++
+			continue
+		}
+		zeros := 1
+		switch c {
+		case 1:
+			zeros = br.bits(4) + 3
+		case 2:
+			zeros = br.bits(lh5CBits) + 20
+		}
+		if i+zeros > lh5NC {
+			return nil, errors.New("bad LHA code lengths")
+		}
+		i += zeros
+	}
+	return newLhaHuffman(lengths)
+}
+
+func lh5Decode(packed []byte, origSize int) ([]byte, error) {
+	br := &lhaBitReader{data: packed}
+	// The size is from the header, so only trust it so far
+	capacity := origSize
+	if capacity > 64*len(packed) {
+		capacity = 64 * len(packed)
+	}
+	output := make([]byte, 0, capacity)
+	var cTable, pTable *lhaHuffman
+	blockLeft := 0
+	for len(output) < origSize {
+		if blockLeft == 0 {
+			if br.pos>>3 >= len(packed) {
+				return nil, errors.New("LHA data ends early")
+			}
+			blockLeft = br.bits(16)
+			tTable, err := lh5ReadPtLen(br, lh5NT, lh5TBits, 3)
+			if err != nil {
+				return nil, err
+			}
+			cTable, err = lh5ReadCLen(br, tTable)
+			if err != nil {
+				return nil, err
+			}
+			pTable, err = lh5ReadPtLen(br, lh5NP, lh5PBits, -1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		blockLeft--
+		c := cTable.decode(br)
+		if c < 256 {
+			output = append(output, byte(c))
+			continue
+		}
+		length := c - 256 + lh5Threshold
+		p := pTable.decode(br)
+		if p > 1 {
+			p = 1<<uint(p-1) + br.bits(p-1)
+		}
+		from := len(output) - p - 1
+		if from < 0 {
+			return nil, errors.New("bad LHA match offset")
+		}
+		for i := 0; i < length && len(output) < origSize; i++ {
+			output = append(output, output[from+i])
+		}
+	}
+	return output, nil
+}
+
+// Writes bits MSB-first.
+type lhaBitWriter struct {
+	data  []byte
+	acc   uint32
+	count int
+}
+
+func (bw *lhaBitWriter) put(n int, val int) {
+	for i := n - 1; i >= 0; i-- {
+		bw.acc = bw.acc<<1 | uint32(val>>uint(i))&1
+		bw.count++
+		if bw.count == 8 {
+			bw.data = append(bw.data, byte(bw.acc))
+			bw.acc, bw.count = 0, 0
+		}
+	}
+}
+
+func (bw *lhaBitWriter) flush() []byte {
+	if bw.count != 0 {
+		bw.put(8-bw.count, 0)
+	}
+	return bw.data
+}
+
+// Build Huffman code lengths for the frequencies, limited to
+// lh5MaxLen bits. Returns nil if fewer than 2 symbols are used.
+func lhaCodeLengths(freq []int) []int {
+	type node struct {
+		weight      int
+		sym         int // -1 for internal nodes
+		left, right int
+	}
+	for {
+		var nodes []node
+		var live []int
+		for sym, f := range freq {
+			if f != 0 {
+				nodes = append(nodes, node{f, sym, -1, -1})
+				live = append(live, len(nodes)-1)
+			}
+		}
+		if len(live) < 2 {
+			return nil
+		}
+		for len(live) > 1 {
+			sort.SliceStable(live, func(i, j int) bool { return nodes[live[i]].weight < nodes[live[j]].weight })
+			a, b := live[0], live[1]
+			nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, -1, a, b})
+			live = append(live[2:], len(nodes)-1)
+		}
+
+		lengths := make([]int, len(freq))
+		maxLen := 0
+		var walk func(n int, depth int)
+		walk = func(n int, depth int) {
+			if nodes[n].sym >= 0 {
+				lengths[nodes[n].sym] = depth
+				if depth > maxLen {
+					maxLen = depth
+				}
+				return
+			}
+			walk(nodes[n].left, depth+1)
+			walk(nodes[n].right, depth+1)
+		}
+		walk(live[0], 0)
+		if maxLen <= lh5MaxLen {
+			return lengths
+		}
+		// Flatten the frequencies and try again
+		for sym := range freq {
+			if freq[sym] != 0 {
+				freq[sym] = (freq[sym] + 1) / 2
+			}
+		}
+	}
+}
+
+// Assign canonical codes from code lengths.
+func lhaCodes(lengths []int) []int {
+	codes := make([]int, len(lengths))
+	code := 0
+	for l := 1; l <= lh5MaxLen; l++ {
+		for sym, sl := range lengths {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// Number of bits in an offset, which is its P code.
+func lh5OffsetCode(off int) int {
+	code := 0
+	for off != 0 {
+		code++
+		off >>= 1
+	}
+	return code
+}
+
+// A literal (length 0) or match in the LZSS output.
+type lh5Code struct {
+	val    int // literal byte, or match length
+	offset int // distance - 1
+	match  bool
+}
+
+// Find LZSS matches with hash chains over the last lh5DictSize bytes.
+func lh5Matches(data []byte) []lh5Code {
+	const hashSize = 1 << 15
+	head := make([]int, hashSize)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(data))
+	hash := func(pos int) int {
+		return (int(data[pos])<<10 ^ int(data[pos+1])<<5 ^ int(data[pos+2])) & (hashSize - 1)
+	}
+	insert := func(pos int) {
+		if pos+lh5Threshold <= len(data) {
+			h := hash(pos)
+			prev[pos] = head[h]
+			head[h] = pos
+		}
+	}
+
+	var codes []lh5Code
+	for pos := 0; pos < len(data); {
+		bestLen, bestPos := 0, 0
+		if pos+lh5Threshold <= len(data) {
+			maxLen := len(data) - pos
+			if maxLen > lh5MaxMatch {
+				maxLen = lh5MaxMatch
+			}
+			chain := 0
+			for cand := head[hash(pos)]; cand >= 0 && pos-cand <= lh5DictSize && chain < 256; cand = prev[cand] {
+				l := 0
+				for l < maxLen && data[cand+l] == data[pos+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestPos = l, cand
+					if l == maxLen {
+						break
+					}
+				}
+				chain++
+			}
+		}
+		if bestLen >= lh5Threshold {
+			codes = append(codes, lh5Code{bestLen, pos - bestPos - 1, true})
+			for i := 0; i < bestLen; i++ {
+				insert(pos + i)
+			}
+			pos += bestLen
+		} else {
+			codes = append(codes, lh5Code{int(data[pos]), 0, false})
+			insert(pos)
+			pos++
+		}
+	}
+	return codes
+}
+
+// Write the code lengths for the T or P tables.
+func lh5WritePtLen(bw *lhaBitWriter, lengths []int, nbits int, special int) {
+	n := len(lengths)
+	for n > 0 && lengths[n-1] == 0 {
+		n--
+	}
+	bw.put(nbits, n)
+	for i := 0; i < n; {
+		l := lengths[i]
+		i++
+		if l <= 6 {
+			bw.put(3, l)
+		} else {
+			bw.put(l-3, 1<<uint(l-3)-2)
+		}
+		if i == special {
+			for i < 6 && lengths[i] == 0 {
+				i++
+			}
+			bw.put(2, (i-3)&3)
+		}
+	}
+}
+
+// Turn the C code lengths into T symbols (with run lengths of zeros).
+// Calls emit(sym, extraBits, extra) for each.
+func lh5CLenSymbols(cLen []int, emit func(sym int, nbits int, extra int)) {
+	n := len(cLen)
+	for n > 0 && cLen[n-1] == 0 {
+		n--
+	}
+	for i := 0; i < n; {
+		l := cLen[i]
+		i++
+		if l != 0 {
+			emit(l+2, 0, 0)
+			continue
+		}
+		count := 1
+		for i < n && cLen[i] == 0 {
+			i++
+			count++
+		}
+		switch {
+		case count <= 2:
+			for k := 0; k < count; k++ {
+				emit(0, 0, 0)
+			}
+		case count <= 18:
+			emit(1, 4, count-3)
+		case count == 19:
+			emit(0, 0, 0)
+			emit(1, 4, 15)
+		default:
+			emit(2, lh5CBits, count-20)
+		}
+	}
+}
+
+func lh5WriteBlock(bw *lhaBitWriter, codes []lh5Code) {
+	cFreq := make([]int, lh5NC)
+	pFreq := make([]int, lh5NP)
+	for _, c := range codes {
+		if c.match {
+			cFreq[c.val-lh5Threshold+256]++
+			pFreq[lh5OffsetCode(c.offset)]++
+		} else {
+			cFreq[c.val]++
+		}
+	}
+	bw.put(16, len(codes))
+
+	cLen := lhaCodeLengths(cFreq)
+	var cCode []int
+	if cLen == nil {
+		// Only one symbol: send zero-length T and C tables
+		bw.put(lh5TBits, 0)
+		bw.put(lh5TBits, 0)
+		bw.put(lh5CBits, 0)
+		bw.put(lh5CBits, codes[0].cSymbol())
+		cLen = make([]int, lh5NC)
+		cCode = make([]int, lh5NC)
+	} else {
+		cCode = lhaCodes(cLen)
+		tFreq := make([]int, lh5NT)
+		lh5CLenSymbols(cLen, func(sym int, _ int, _ int) { tFreq[sym]++ })
+		tLen := lhaCodeLengths(tFreq)
+		var tCode []int
+		if tLen == nil {
+			for sym, f := range tFreq {
+				if f != 0 {
+					bw.put(lh5TBits, 0)
+					bw.put(lh5TBits, sym)
+				}
+			}
+			tLen = make([]int, lh5NT)
+			tCode = make([]int, lh5NT)
+		} else {
+			lh5WritePtLen(bw, tLen, lh5TBits, 3)
+			tCode = lhaCodes(tLen)
+		}
+		n := len(cLen)
+		for n > 0 && cLen[n-1] == 0 {
+			n--
+		}
+		bw.put(lh5CBits, n)
+		lh5CLenSymbols(cLen, func(sym int, nbits int, extra int) {
+			bw.put(tLen[sym], tCode[sym])
+			bw.put(nbits, extra)
+		})
+	}
+
+	pLen := lhaCodeLengths(pFreq)
+	var pCode []int
+	if pLen == nil {
+		sym := 0
+		for s, f := range pFreq {
+			if f != 0 {
+				sym = s
+			}
+		}
+		bw.put(lh5PBits, 0)
+		bw.put(lh5PBits, sym)
+		pLen = make([]int, lh5NP)
+		pCode = make([]int, lh5NP)
+	} else {
+		lh5WritePtLen(bw, pLen, lh5PBits, -1)
+		pCode = lhaCodes(pLen)
+	}
+
+	for _, c := range codes {
+		sym := c.cSymbol()
+		bw.put(cLen[sym], cCode[sym])
+		if c.match {
+			pc := lh5OffsetCode(c.offset)
+			bw.put(pLen[pc], pCode[pc])
+			if pc > 1 {
+				bw.put(pc-1, c.offset&(1<<uint(pc-1)-1))
+			}
+		}
+	}
+}
+
+func (c lh5Code) cSymbol() int {
+	if c.match {
+		return c.val - lh5Threshold + 256
+	}
+	return c.val
+}
+
+func lh5Encode(data []byte) []byte {
+	codes := lh5Matches(data)
+	var bw lhaBitWriter
+	for start := 0; start < len(codes); start += lh5BlockSize {
+		end := start + lh5BlockSize
+		if end > len(codes) {
+			end = len(codes)
+		}
+		lh5WriteBlock(&bw, codes[start:end])
+	}
+	return bw.flush()
+}
@@ -0,0 +1,545 @@
+package ymp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const NumYmRegs = 14
+
+// Raw data type loaded from a file.
+// Contains 14 arrays of raw register data, plus information about
+// the machine the tune was recorded from.
+type RawRegisters struct {
+	Data      [NumYmRegs]ByteSlice
+	ClockHz   int // master clock of the PSG
+	PlayHz    int // register frames per second
+	LoopFrame int
+	Title     string
+	Author    string
+	Comment   string
+	Messages  []string // notes and warnings from loading, for display
+}
+
+// Machine defaults for formats that don't record them.
+const defaultClockHz = ClockAtariST
+const defaultPlayHz = 50
+
+// Limits on what a file can unpack to, so that a corrupt or hostile
+// file fails rather than using all memory. maxFrames is nearly 6
+// hours at 50Hz.
+const maxFileSize = 64 * 1024 * 1024
+const maxFrames = 1 << 20
+
+func readFromYM3(data []byte) (*RawRegisters, error) {
+	// There are 14 regs in the original file
+	dataSize := len(data) - 4
+	if dataSize%NumYmRegs != 0 {
+		return &RawRegisters{}, errors.New("unexpected data size")
+	}
+	// Convert to memory types
+	numVbls := dataSize / NumYmRegs
+	var rawRegs RawRegisters
+	rawRegs.ClockHz = defaultClockHz
+	rawRegs.PlayHz = defaultPlayHz
+
+	for reg := 0; reg < NumYmRegs; reg++ {
+		// Split register data
+		startPos := 4 + reg*numVbls
+		rawRegs.Data[reg] = data[startPos : startPos+numVbls]
+	}
+	return &rawRegs, nil
+}
+
+// VGM files are timed in samples at this rate.
+const vgmSampleRate = 44100
+
+// Offsets of the VGM header fields that we use.
+const (
+	vgmOffsetVersion  = 0x08
+	vgmOffsetLoop     = 0x1c
+	vgmOffsetRate     = 0x24
+	vgmOffsetData     = 0x34
+	vgmOffsetAyClock  = 0x74
+	vgmOffsetAyType   = 0x78
+	vgmOffsetAyFlags  = 0x79
+	vgmMinHeaderSize  = 0x80
+	vgmAyFlagHalfClk  = 0x10 // YM2149 pin 26 low, clock divided by 2
+	vgmAyClockMask    = 0x3fffffff
+	vgmDefaultDataPos = 0x40
+)
+
+var vgmChipTypes = map[byte]string{
+	0x00: "AY8910", 0x01: "AY8912", 0x02: "AY8913", 0x03: "AY8930",
+	0x04: "AY8914", 0x10: "YM2149", 0x11: "YM3439", 0x12: "YMZ284", 0x13: "YMZ294",
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data, err = io.ReadAll(io.LimitReader(zr, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFileSize {
+		return nil, errors.New("gzip data unpacks to more than 64MB")
+	}
+	return data, nil
+}
+
+// Number of operand bytes for the VGM commands we don't handle specially.
+func vgmOperandSize(cmd byte) int {
+	switch {
+	case cmd >= 0x30 && cmd <= 0x3f, cmd == 0x4f, cmd == 0x50:
+		return 1
+	case cmd >= 0x40 && cmd <= 0x4e, cmd >= 0x51 && cmd <= 0x5f, cmd >= 0xa0 && cmd <= 0xbf:
+		return 2
+	case cmd >= 0xc0 && cmd <= 0xdf:
+		return 3
+	case cmd >= 0xe0:
+		return 4
+	case cmd == 0x68:
+		return 11
+	case cmd == 0x90, cmd == 0x91, cmd == 0x95:
+		return 4
+	case cmd == 0x92:
+		return 5
+	case cmd == 0x93:
+		return 10
+	case cmd == 0x94:
+		return 1
+	}
+	return -1
+}
+
+// Read a VGM log of AY8910/YM2149 writes, sampling the register state
+// at the end of each frame. Writes to other chips are ignored.
+func readFromVGM(data []byte, frameHz int) (*RawRegisters, error) {
+	if len(data) < vgmMinHeaderSize {
+		return &RawRegisters{}, errors.New("VGM file too small for header")
+	}
+	le := binary.LittleEndian
+	version := le.Uint32(data[vgmOffsetVersion:])
+	ayClock := int(le.Uint32(data[vgmOffsetAyClock:]) & vgmAyClockMask)
+	if version < 0x151 || ayClock == 0 {
+		return &RawRegisters{}, errors.New("VGM file has no AY8910/YM2149 data")
+	}
+	if data[vgmOffsetAyFlags]&vgmAyFlagHalfClk != 0 {
+		ayClock /= 2
+	}
+	chip, ok := vgmChipTypes[data[vgmOffsetAyType]]
+	if !ok {
+		chip = fmt.Sprintf("unknown type $%02x", data[vgmOffsetAyType])
+	}
+	if frameHz == 0 {
+		frameHz = int(le.Uint32(data[vgmOffsetRate:]))
+	}
+	if frameHz == 0 {
+		frameHz = defaultPlayHz
+	}
+
+	dataPos := vgmDefaultDataPos
+	if dataOffset := int(le.Uint32(data[vgmOffsetData:])); dataOffset != 0 {
+		dataPos = vgmOffsetData + dataOffset
+	}
+	loopPos := -1
+	if loopOffset := int(le.Uint32(data[vgmOffsetLoop:])); loopOffset != 0 {
+		loopPos = vgmOffsetLoop + loopOffset
+	}
+
+	var rawRegs RawRegisters
+	rawRegs.Messages = append(rawRegs.Messages,
+		fmt.Sprintf("VGM: %s at %d Hz, sampled at %d frames per second", chip, ayClock, frameHz))
+	rawRegs.ClockHz = ayClock
+	rawRegs.PlayHz = frameHz
+	var regs [NumYmRegs]byte
+	envWritten := false
+	written := false // any writes since the last frame
+	secondChip := false
+	samplePos := int64(0)
+	numFrames := 0
+	frameStart := func(frame int) int64 {
+		return int64(frame) * vgmSampleRate / int64(frameHz)
+	}
+	emitFrame := func() {
+		for reg := 0; reg < NumYmRegs; reg++ {
+			val := regs[reg]
+			if reg == 13 && !envWritten {
+				val = 0xff
+			}
+			rawRegs.Data[reg] = append(rawRegs.Data[reg], val)
+		}
+		envWritten = false
+		written = false
+		numFrames++
+	}
+	wait := func(samples int) {
+		samplePos += int64(samples)
+		for samplePos >= frameStart(numFrames+1) && numFrames <= maxFrames {
+			emitFrame()
+		}
+	}
+
+	head := dataPos
+	for {
+		if numFrames > maxFrames {
+			return &RawRegisters{}, errors.New("VGM file has too many frames")
+		}
+		if head == loopPos {
+			rawRegs.LoopFrame = numFrames
+		}
+		if head >= len(data) {
+			return &RawRegisters{}, errors.New("VGM data ends without an end command")
+		}
+		cmd := data[head]
+		head++
+		switch {
+		case cmd == 0x66:
+			// End of data. Keep a final partial frame if it has writes.
+			if samplePos > frameStart(numFrames) || written {
+				emitFrame()
+			}
+			if secondChip {
+				rawRegs.Messages = append(rawRegs.Messages, "WARNING: ignored writes to a second AY chip")
+			}
+			if numFrames == 0 {
+				return &RawRegisters{}, errors.New("VGM file contains no frames")
+			}
+			return &rawRegs, nil
+		case cmd == 0xa0:
+			if head+2 > len(data) {
+				return &RawRegisters{}, errors.New("truncated VGM data")
+			}
+			reg, val := data[head], data[head+1]
+			head += 2
+			if reg&0x80 != 0 {
+				secondChip = true
+			} else if reg < NumYmRegs {
+				regs[reg] = val
+				written = true
+				if reg == 13 {
+					envWritten = true
+				}
+			}
+		case cmd == 0x61:
+			if head+2 > len(data) {
+				return &RawRegisters{}, errors.New("truncated VGM data")
+			}
+			wait(int(le.Uint16(data[head:])))
+			head += 2
+		case cmd == 0x62:
+			wait(735)
+		case cmd == 0x63:
+			wait(882)
+		case cmd >= 0x70 && cmd <= 0x7f:
+			wait(int(cmd&0xf) + 1)
+		case cmd >= 0x80 && cmd <= 0x8f:
+			// YM2612 DAC write from the data bank, which is ignored,
+			// then a wait of 0-15 samples
+			wait(int(cmd & 0xf))
+		case cmd == 0x67:
+			// Data block: 0x66, type, 32-bit size, data
+			if head+6 > len(data) {
+				return &RawRegisters{}, errors.New("truncated VGM data block")
+			}
+			head += 6 + int(le.Uint32(data[head+2:]))
+		default:
+			size := vgmOperandSize(cmd)
+			if size < 0 {
+				return &RawRegisters{}, fmt.Errorf("unknown VGM command $%02x at offset %d", cmd, head-1)
+			}
+			head += size
+		}
+	}
+}
+
+// Commands in a .psg register dump.
+const (
+	psgHeaderSize = 16
+	psgCmdFrame   = 0xff // end of a frame
+	psgCmdSkip    = 0xfe // followed by N, skip N*4 frames
+	psgCmdEnd     = 0xfd
+)
+
+// Read a .psg dump from a Spectrum emulator. These only contain the
+// register writes for each frame, so the full register state is
+// rebuilt frame by frame.
+func readFromPSG(data []byte) (*RawRegisters, error) {
+	if len(data) < psgHeaderSize {
+		return &RawRegisters{}, errors.New("PSG file too small for header")
+	}
+	var rawRegs RawRegisters
+	rawRegs.ClockHz = ClockSpectrum
+	rawRegs.PlayHz = defaultPlayHz
+	var regs [NumYmRegs]byte
+	envWritten := false
+	written := false // any writes since the last frame
+	emitFrames := func(count int) {
+		for i := 0; i < count; i++ {
+			for reg := 0; reg < NumYmRegs; reg++ {
+				val := regs[reg]
+				if reg == 13 && !envWritten {
+					val = 0xff
+				}
+				rawRegs.Data[reg] = append(rawRegs.Data[reg], val)
+			}
+			envWritten = false
+			written = false
+		}
+	}
+
+	head := psgHeaderSize
+	// Most dumps start with a frame marker, which doesn't end a frame
+	if head < len(data) && data[head] == psgCmdFrame {
+		head++
+	}
+	for head < len(data) {
+		if len(rawRegs.Data[0]) > maxFrames {
+			return &RawRegisters{}, errors.New("PSG file has too many frames")
+		}
+		cmd := data[head]
+		head++
+		if cmd == psgCmdEnd {
+			break
+		}
+		switch cmd {
+		case psgCmdFrame:
+			emitFrames(1)
+		case psgCmdSkip:
+			if head >= len(data) {
+				return &RawRegisters{}, errors.New("truncated PSG data")
+			}
+			emitFrames(int(data[head]) * 4)
+			head++
+		default:
+			if head >= len(data) {
+				return &RawRegisters{}, errors.New("truncated PSG data")
+			}
+			if cmd > 15 {
+				return &RawRegisters{}, fmt.Errorf("bad PSG register %d at offset %d", cmd, head-1)
+			}
+			val := data[head]
+			head++
+			// Registers 14 and 15 are the I/O ports
+			if cmd < NumYmRegs {
+				regs[cmd] = val
+				written = true
+				if cmd == 13 {
+					envWritten = true
+				}
+			}
+		}
+	}
+	if written {
+		emitFrames(1)
+	}
+	if len(rawRegs.Data[0]) == 0 {
+		return &RawRegisters{}, errors.New("PSG file contains no frames")
+	}
+	return &rawRegs, nil
+}
+
+func ym5ReadStrings(r io.ByteReader) ([3]string, error) {
+	// Read 3 strings: tune, author, notes
+	var strs [3]string
+	for i := 0; i < 3; i++ {
+		var sb strings.Builder
+		for {
+			v, err := r.ReadByte()
+			if err != nil {
+				return strs, err
+			}
+			if v == 0 {
+				break
+			}
+			sb.WriteByte(v)
+		}
+		strs[i] = sb.String()
+	}
+	return strs, nil
+}
+
+func ym5SkipDigidrums(r *bytes.Reader, digiCount uint16) error {
+	for dd := uint16(0); dd < digiCount; dd++ {
+		// Read
+		var ddSize uint32
+		err := binary.Read(r, binary.BigEndian, &ddSize)
+		if err != nil {
+			return err
+		}
+		_, err = r.Seek(int64(ddSize), io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// YM5/YM6 files store 16 registers per frame; the last 2 hold
+// special effect data.
+const ym56NumRegs = 16
+
+// Song attribute: data is stored register by register
+const ymAttrInterleaved = 1
+
+type YM56Header struct {
+	Header     uint32  // File ID "YM5!" "YM6!"
+	Leonard    [8]byte // Check string "LeOnArD!"
+	FrameCount uint32  // Nb of frame in the file
+	Attr       uint32  // Song attributes
+	DigiCount  uint16  // Nb of digidrum samples in file (can be 0)
+	ClockHz    uint32  // YM master clock implementation in Hz .(ex:2000000 for ATARI-ST version, 1773400 for ZX-SPECTRUM)
+	PlayHertz  uint16  // Original player frame in Hz (traditionnaly 50)
+	LoopFrame  uint32  // Loop frame (traditionnaly 0 to loop at the beginning)
+	SkipBytes  uint16  // Number of bytes to skip next
+}
+
+func readFromYM56(data []byte) (*RawRegisters, error) {
+	r := bytes.NewReader(data)
+	var info YM56Header
+	err := binary.Read(r, binary.BigEndian, &info)
+	if err != nil {
+		return &RawRegisters{}, err
+	}
+
+	// Skip the optional data
+	r.Seek(int64(info.SkipBytes), io.SeekCurrent)
+
+	// Skip the digidrums
+	err = ym5SkipDigidrums(r, info.DigiCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the name/author/comment
+	strs, err := ym5ReadStrings(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill out the actual YM data we want
+	var rawRegs RawRegisters
+	if info.DigiCount != 0 {
+		rawRegs.Messages = append(rawRegs.Messages, "WARNING: can't correctly encode tunes with digidrum data")
+	}
+	rawRegs.Title, rawRegs.Author, rawRegs.Comment = strs[0], strs[1], strs[2]
+	rawRegs.ClockHz = int(info.ClockHz)
+	rawRegs.PlayHz = int(info.PlayHertz)
+	rawRegs.LoopFrame = int(info.LoopFrame)
+	if rawRegs.ClockHz == 0 {
+		rawRegs.ClockHz = defaultClockHz
+	}
+	if rawRegs.PlayHz == 0 {
+		rawRegs.PlayHz = defaultPlayHz
+	}
+	// Check the frame count against the file, before allocating
+	if int64(info.FrameCount)*NumYmRegs > int64(r.Len()) {
+		return &RawRegisters{}, fmt.Errorf("YM file too short for %d frames", info.FrameCount)
+	}
+	if info.Attr&ymAttrInterleaved == 0 {
+		// All 16 registers for each frame in turn
+		frames := make([]byte, int(info.FrameCount)*ym56NumRegs)
+		_, err := io.ReadFull(r, frames)
+		if err != nil {
+			return &RawRegisters{}, err
+		}
+		for reg := 0; reg < NumYmRegs; reg++ {
+			rawRegs.Data[reg] = make([]byte, info.FrameCount)
+			for frame := range rawRegs.Data[reg] {
+				rawRegs.Data[reg][frame] = frames[frame*ym56NumRegs+reg]
+			}
+		}
+		return &rawRegs, nil
+	}
+	for reg := 0; reg < NumYmRegs; reg++ {
+		rawRegs.Data[reg] = make([]byte, info.FrameCount)
+		_, err := io.ReadFull(r, rawRegs.Data[reg])
+		if err != nil {
+			return &RawRegisters{}, err
+		}
+	}
+	return &rawRegs, nil
+}
+
+// Options for formats that aren't simple lists of frames.
+type LoadOptions struct {
+	LogRate int // frames per second to sample register logs (VGM) at, 0 for the log's rate
+	Subtune int // SNDH subtune, 0 for the first
+	Seconds int // SNDH length to record, 0 for the length in the header
+}
+
+// Split the file data array and create simple individual streams for the registers.
+func LoadRawRegisters(data []byte, opts LoadOptions) (*RawRegisters, error) {
+	if len(data) < 4 {
+		return &RawRegisters{}, errors.New("not a YM-stream file, too small for header")
+	}
+	var err error
+	if isGzipData(data) {
+		// gzip-compressed, e.g. .vgz
+		data, err = gunzip(data)
+	} else if IsLhaData(data) {
+		// Most YM files are distributed LHA-compressed
+		data, err = LhaUnpack(data)
+	} else {
+		return loadUnpacked(data, opts)
+	}
+	if err != nil {
+		return &RawRegisters{}, err
+	}
+	// Only one level is unpacked, so a file that unpacks to itself
+	// can't recurse forever
+	if isGzipData(data) || IsLhaData(data) {
+		return &RawRegisters{}, errors.New("compressed file contains more compressed data")
+	}
+	if len(data) < 4 {
+		return &RawRegisters{}, errors.New("not a YM-stream file, too small for header")
+	}
+	return loadUnpacked(data, opts)
+}
+
+func isGzipData(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Load data that has already been decompressed, by its header.
+func loadUnpacked(data []byte, opts LoadOptions) (*RawRegisters, error) {
+	if len(data) >= 16 && string(data[12:16]) == "SNDH" || string(data[:4]) == "ICE!" {
+		return readFromSNDH(data, opts.Subtune, opts.Seconds)
+	}
+	if IsPt3Data(data) {
+		return readFromPT3(data)
+	}
+	r := bytes.NewReader(data)
+	var fileHeader uint32
+	err := binary.Read(r, binary.BigEndian, &fileHeader)
+	if err == nil {
+		switch fileHeader {
+		case 0x594d3321:
+			return readFromYM3(data)
+		case 0x594d3521, 0x594d3621:
+			return readFromYM56(data)
+		case 0x56676d20:
+			return readFromVGM(data, opts.LogRate)
+		case 0x5053471a:
+			return readFromPSG(data)
+		}
+	}
+	return &RawRegisters{}, errors.New("not a supported YM-stream file")
+}
+
+// As LoadRawRegisters, reading the whole file from r.
+func ReadRawRegisters(r io.Reader, opts LoadOptions) (*RawRegisters, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return LoadRawRegisters(data, opts)
+}
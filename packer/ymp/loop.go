@@ -0,0 +1,111 @@
+package ymp
+
+// A section repeated at the end of a tune, as found by DetectLoop.
+type LoopInfo struct {
+	Start    int // first frame of the loop
+	Length   int // frames in one playthrough of the loop
+	Repeated int // frames after the first playthrough which repeat it
+}
+
+// Number of playthroughs of the loop in the data, including the first.
+func (li *LoopInfo) Playthroughs() float64 {
+	return 1 + float64(li.Repeated)/float64(li.Length)
+}
+
+// Find the longest repetition at the end of the register data, such
+// as a dump that kept recording after the tune looped. Frames must be
+// exactly equal; to find repeats that only sound the same, pass data
+// with the unused register bits cleared.
+//
+// The loop is at least minLength frames long and is repeated in full
+// at least once. Of the loops that start earliest the shortest is
+// returned, so a tune recorded three times gives its real loop, not
+// two playthroughs of it. Loops of nothing but silence are ignored.
+// Returns false if there is no loop.
+func DetectLoop(rawRegs *RawRegisters, minLength int) (LoopInfo, bool) {
+	numFrames := len(rawRegs.Data[0])
+	if minLength < 1 {
+		minLength = 1
+	}
+
+	// Give each distinct frame an ID, in reverse order, so that the
+	// Z-function gives the length of the repeat at the end for every
+	// loop length at once.
+	ids := make(map[[NumYmRegs]byte]int)
+	rev := make([]int, numFrames)
+	for i := range rev {
+		var frame [NumYmRegs]byte
+		for reg := 0; reg < NumYmRegs; reg++ {
+			frame[reg] = rawRegs.Data[reg][numFrames-1-i]
+		}
+		id, ok := ids[frame]
+		if !ok {
+			id = len(ids)
+			ids[frame] = id
+		}
+		rev[i] = id
+	}
+	repeated := zFunction(rev)
+
+	// Running count of silent frames, to skip silent loops
+	silent := make([]int, numFrames+1)
+	for frame := 0; frame < numFrames; frame++ {
+		silent[frame+1] = silent[frame]
+		if isSilentFrame(rawRegs, frame) {
+			silent[frame+1]++
+		}
+	}
+
+	var best LoopInfo
+	found := false
+	for length := minLength; 2*length <= numFrames; length++ {
+		if repeated[length] < length {
+			continue
+		}
+		start := numFrames - repeated[length] - length
+		if silent[start+length]-silent[start] == length {
+			continue
+		}
+		if !found || start < best.Start {
+			best = LoopInfo{Start: start, Length: length, Repeated: repeated[length]}
+			found = true
+		}
+	}
+	return best, found
+}
+
+// For each i, the length of the longest common prefix of s and s[i:].
+func zFunction(s []int) []int {
+	z := make([]int, len(s))
+	if len(s) == 0 {
+		return z
+	}
+	z[0] = len(s)
+	left, right := 0, 0
+	for i := 1; i < len(s); i++ {
+		if i < right {
+			z[i] = z[i-left]
+			if z[i] > right-i {
+				z[i] = right - i
+			}
+		}
+		for i+z[i] < len(s) && s[z[i]] == s[i+z[i]] {
+			z[i]++
+		}
+		if i+z[i] > right {
+			left, right = i, i+z[i]
+		}
+	}
+	return z
+}
+
+// Returns the register data cut to a single playthrough of the loop,
+// with the loop frame set to its start.
+func TrimToLoop(rawRegs *RawRegisters, loop LoopInfo) (*RawRegisters, error) {
+	out, err := CutRegisters(rawRegs, 0, loop.Start+loop.Length)
+	if err != nil {
+		return nil, err
+	}
+	out.LoopFrame = loop.Start
+	return out, nil
+}
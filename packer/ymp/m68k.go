@@ -0,0 +1,1326 @@
+package ymp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The memory bus seen by the 68000. Addresses are 24-bit.
+type M68kBus interface {
+	Read8(addr uint32) byte
+	Write8(addr uint32, val byte)
+}
+
+// Status register bits
+const (
+	flagC = 1 << 0
+	flagV = 1 << 1
+	flagZ = 1 << 2
+	flagN = 1 << 3
+	flagX = 1 << 4
+	flagS = 1 << 13
+	flagT = 1 << 15
+)
+
+// Exception vector numbers
+const (
+	vecIllegal   = 4
+	vecZeroDiv   = 5
+	vecChk       = 6
+	vecTrapV     = 7
+	vecPrivilege = 8
+	vecLineA     = 10
+	vecLineF     = 11
+	vecTrap0     = 32
+)
+
+var errM68kStopped = errors.New("68000 executed STOP")
+
+// A simple interpreter for the 68000 instruction set. There is no
+// cycle timing; it is only used to run music drivers and capture
+// their register writes.
+type M68k struct {
+	d       [8]uint32
+	a       [8]uint32 // a[7] is the active stack pointer
+	pc      uint32
+	sr      uint16
+	otherSp uint32 // USP in supervisor mode, SSP in user mode
+	bus     M68kBus
+	stopped bool
+}
+
+// The operand types returned by decoding an effective address
+const (
+	opDreg = iota
+	opAreg
+	opMem
+	opImm
+)
+
+type m68kOperand struct {
+	kind int
+	reg  int
+	addr uint32
+	val  uint32 // immediate value
+}
+
+func NewM68k(bus M68kBus) *M68k {
+	return &M68k{bus: bus, sr: flagS | 0x0700}
+}
+
+func sizeMask(size int) uint32 {
+	switch size {
+	case 1:
+		return 0xff
+	case 2:
+		return 0xffff
+	}
+	return 0xffffffff
+}
+
+func sizeMsb(size int) uint32 {
+	return 1 << (uint(size)*8 - 1)
+}
+
+func signExtend(val uint32, size int) uint32 {
+	switch size {
+	case 1:
+		return uint32(int32(int8(val)))
+	case 2:
+		return uint32(int32(int16(val)))
+	}
+	return val
+}
+
+// Decode the 2-bit size field used by most instructions.
+func m68kSize(bits uint16) int {
+	switch bits & 3 {
+	case 0:
+		return 1
+	case 1:
+		return 2
+	}
+	return 4
+}
+
+func (c *M68k) read(addr uint32, size int) uint32 {
+	addr &= 0xffffff
+	switch size {
+	case 1:
+		return uint32(c.bus.Read8(addr))
+	case 2:
+		return uint32(c.bus.Read8(addr))<<8 | uint32(c.bus.Read8((addr+1)&0xffffff))
+	}
+	return c.read(addr, 2)<<16 | c.read(addr+2, 2)
+}
+
+func (c *M68k) write(addr uint32, size int, val uint32) {
+	addr &= 0xffffff
+	switch size {
+	case 1:
+		c.bus.Write8(addr, byte(val))
+	case 2:
+		c.bus.Write8(addr, byte(val>>8))
+		c.bus.Write8((addr+1)&0xffffff, byte(val))
+	default:
+		c.write(addr, 2, val>>16)
+		c.write(addr+2, 2, val)
+	}
+}
+
+func (c *M68k) fetch16() uint32 {
+	val := c.read(c.pc, 2)
+	c.pc += 2
+	return val
+}
+
+func (c *M68k) fetch32() uint32 {
+	val := c.read(c.pc, 4)
+	c.pc += 4
+	return val
+}
+
+func (c *M68k) push(size int, val uint32) {
+	c.a[7] -= uint32(size)
+	c.write(c.a[7], size, val)
+}
+
+func (c *M68k) pop(size int) uint32 {
+	val := c.read(c.a[7], size)
+	c.a[7] += uint32(size)
+	return val
+}
+
+// Set the whole status register, swapping stack pointers if the
+// supervisor bit changes.
+func (c *M68k) setSR(val uint16) {
+	val &= 0xa71f
+	if (val^c.sr)&flagS != 0 {
+		c.a[7], c.otherSp = c.otherSp, c.a[7]
+	}
+	c.sr = val
+}
+
+func (c *M68k) setCCR(val uint16) {
+	c.sr = c.sr&0xff00 | val&0x1f
+}
+
+func (c *M68k) flag(f uint16) bool {
+	return c.sr&f != 0
+}
+
+func (c *M68k) setFlag(f uint16, on bool) {
+	if on {
+		c.sr |= f
+	} else {
+		c.sr &^= f
+	}
+}
+
+// Set N and Z from a result, clearing V and C.
+func (c *M68k) setNZ(val uint32, size int) {
+	c.sr &^= flagN | flagZ | flagV | flagC
+	if val&sizeMask(size) == 0 {
+		c.sr |= flagZ
+	}
+	if val&sizeMsb(size) != 0 {
+		c.sr |= flagN
+	}
+}
+
+// Raise an exception, entering supervisor mode.
+func (c *M68k) exception(vector int) {
+	oldSR := c.sr
+	c.setSR((c.sr | flagS) &^ flagT)
+	c.push(4, c.pc)
+	c.push(2, uint32(oldSR))
+	c.pc = c.read(uint32(vector)*4, 4)
+}
+
+// Evaluate a condition code.
+func (c *M68k) test(cond uint16) bool {
+	n, z, v, cf := c.flag(flagN), c.flag(flagZ), c.flag(flagV), c.flag(flagC)
+	switch cond & 0xf {
+	case 0:
+		return true
+	case 1:
+		return false
+	case 2:
+		return !cf && !z // HI
+	case 3:
+		return cf || z // LS
+	case 4:
+		return !cf // CC
+	case 5:
+		return cf // CS
+	case 6:
+		return !z // NE
+	case 7:
+		return z // EQ
+	case 8:
+		return !v // VC
+	case 9:
+		return v // VS
+	case 10:
+		return !n // PL
+	case 11:
+		return n // MI
+	case 12:
+		return n == v // GE
+	case 13:
+		return n != v // LT
+	case 14:
+		return !z && n == v // GT
+	}
+	return z || n != v // LE
+}
+
+// Calculate a (d8,base,Xn) address from the extension word.
+func (c *M68k) indexed(base uint32) uint32 {
+	ext := c.fetch16()
+	reg := (ext >> 12) & 7
+	var idx uint32
+	if ext&0x8000 != 0 {
+		idx = c.a[reg]
+	} else {
+		idx = c.d[reg]
+	}
+	if ext&0x0800 == 0 {
+		idx = signExtend(idx, 2)
+	}
+	return base + signExtend(ext, 1) + idx
+}
+
+// Decode an effective address, performing any pre-decrement or
+// post-increment and fetching extension words.
+func (c *M68k) ea(mode uint16, reg uint16, size int) (m68kOperand, error) {
+	r := int(reg & 7)
+	inc := uint32(size)
+	if r == 7 && size == 1 {
+		// Keep the stack pointer word-aligned
+		inc = 2
+	}
+	switch mode & 7 {
+	case 0:
+		return m68kOperand{kind: opDreg, reg: r}, nil
+	case 1:
+		return m68kOperand{kind: opAreg, reg: r}, nil
+	case 2:
+		return m68kOperand{kind: opMem, addr: c.a[r]}, nil
+	case 3:
+		addr := c.a[r]
+		c.a[r] += inc
+		return m68kOperand{kind: opMem, addr: addr}, nil
+	case 4:
+		c.a[r] -= inc
+		return m68kOperand{kind: opMem, addr: c.a[r]}, nil
+	case 5:
+		base := c.a[r]
+		return m68kOperand{kind: opMem, addr: base + signExtend(c.fetch16(), 2)}, nil
+	case 6:
+		return m68kOperand{kind: opMem, addr: c.indexed(c.a[r])}, nil
+	}
+	switch r {
+	case 0:
+		return m68kOperand{kind: opMem, addr: signExtend(c.fetch16(), 2)}, nil
+	case 1:
+		return m68kOperand{kind: opMem, addr: c.fetch32()}, nil
+	case 2:
+		base := c.pc
+		return m68kOperand{kind: opMem, addr: base + signExtend(c.fetch16(), 2)}, nil
+	case 3:
+		return m68kOperand{kind: opMem, addr: c.indexed(c.pc)}, nil
+	case 4:
+		if size == 4 {
+			return m68kOperand{kind: opImm, val: c.fetch32()}, nil
+		}
+		return m68kOperand{kind: opImm, val: c.fetch16() & sizeMask(size)}, nil
+	}
+	return m68kOperand{}, fmt.Errorf("bad addressing mode 7:%d", r)
+}
+
+func (c *M68k) readOp(op m68kOperand, size int) uint32 {
+	switch op.kind {
+	case opDreg:
+		return c.d[op.reg] & sizeMask(size)
+	case opAreg:
+		return c.a[op.reg] & sizeMask(size)
+	case opMem:
+		return c.read(op.addr, size)
+	}
+	return op.val
+}
+
+func (c *M68k) writeOp(op m68kOperand, size int, val uint32) {
+	switch op.kind {
+	case opDreg:
+		mask := sizeMask(size)
+		c.d[op.reg] = c.d[op.reg]&^mask | val&mask
+	case opAreg:
+		c.a[op.reg] = val
+	case opMem:
+		c.write(op.addr, size, val)
+	}
+}
+
+// Decode the effective address in the bottom 6 bits of the opcode.
+func (c *M68k) eaLow(opcode uint16, size int) (m68kOperand, error) {
+	return c.ea((opcode>>3)&7, opcode&7, size)
+}
+
+// Addition and subtraction with flags. "x" is the extend bit for
+// ADDX/SUBX. CMP uses sub with setX false.
+func (c *M68k) add(s, d uint32, x uint32, size int, setX bool) uint32 {
+	mask := sizeMask(size)
+	msb := sizeMsb(size)
+	s &= mask
+	d &= mask
+	r := (s + d + x) & mask
+	carry := uint64(s)+uint64(d)+uint64(x) > uint64(mask)
+	c.setNZ(r, size)
+	c.setFlag(flagV, (s^r)&(d^r)&msb != 0)
+	c.setFlag(flagC, carry)
+	if setX {
+		c.setFlag(flagX, carry)
+	}
+	return r
+}
+
+func (c *M68k) sub(s, d uint32, x uint32, size int, setX bool) uint32 {
+	mask := sizeMask(size)
+	msb := sizeMsb(size)
+	s &= mask
+	d &= mask
+	r := (d - s - x) & mask
+	borrow := uint64(d) < uint64(s)+uint64(x)
+	c.setNZ(r, size)
+	c.setFlag(flagV, (s^d)&(r^d)&msb != 0)
+	c.setFlag(flagC, borrow)
+	if setX {
+		c.setFlag(flagX, borrow)
+	}
+	return r
+}
+
+// Run a single instruction.
+func (c *M68k) Step() error {
+	if c.stopped {
+		return errM68kStopped
+	}
+	opcode := uint16(c.fetch16())
+	switch opcode >> 12 {
+	case 0x0:
+		return c.execGroup0(opcode)
+	case 0x1, 0x2, 0x3:
+		return c.execMove(opcode)
+	case 0x4:
+		return c.execGroup4(opcode)
+	case 0x5:
+		return c.execGroup5(opcode)
+	case 0x6:
+		return c.execBranch(opcode)
+	case 0x7:
+		if opcode&0x100 != 0 {
+			c.exception(vecIllegal)
+			return nil
+		}
+		val := signExtend(uint32(opcode), 1)
+		c.d[(opcode>>9)&7] = val
+		c.setNZ(val, 4)
+		return nil
+	case 0x8, 0xc:
+		return c.execLogicMulDiv(opcode)
+	case 0x9, 0xd:
+		return c.execAddSub(opcode)
+	case 0xa:
+		c.pc -= 2
+		c.exception(vecLineA)
+		return nil
+	case 0xb:
+		return c.execCmpEor(opcode)
+	case 0xe:
+		return c.execShift(opcode)
+	}
+	c.pc -= 2
+	c.exception(vecLineF)
+	return nil
+}
+
+// Bit operations, MOVEP and immediate arithmetic.
+func (c *M68k) execGroup0(opcode uint16) error {
+	mode := (opcode >> 3) & 7
+	if opcode&0x100 != 0 {
+		if mode == 1 {
+			return c.execMovep(opcode)
+		}
+		return c.execBitOp(opcode, c.d[(opcode>>9)&7])
+	}
+	kind := (opcode >> 9) & 7
+	if kind == 4 {
+		return c.execBitOp(opcode, c.fetch16()&0xff)
+	}
+	if kind == 7 || opcode&0xc0 == 0xc0 {
+		c.pc -= 2
+		c.exception(vecIllegal)
+		return nil
+	}
+	size := m68kSize(opcode >> 6)
+
+	// Immediate to CCR/SR
+	if opcode&0x3f == 0x3c && (kind == 0 || kind == 1 || kind == 5) {
+		imm := uint16(c.fetch16())
+		if size == 2 && !c.flag(flagS) {
+			c.pc -= 4
+			c.exception(vecPrivilege)
+			return nil
+		}
+		val := c.sr
+		switch kind {
+		case 0:
+			val |= imm
+		case 1:
+			val &= imm
+		case 5:
+			val ^= imm
+		}
+		if size == 1 {
+			c.setCCR(val)
+		} else {
+			c.setSR(val)
+		}
+		return nil
+	}
+
+	var imm uint32
+	if size == 4 {
+		imm = c.fetch32()
+	} else {
+		imm = c.fetch16() & sizeMask(size)
+	}
+	dst, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	d := c.readOp(dst, size)
+	switch kind {
+	case 0:
+		d |= imm
+		c.setNZ(d, size)
+	case 1:
+		d &= imm
+		c.setNZ(d, size)
+	case 2:
+		d = c.sub(imm, d, 0, size, true)
+	case 3:
+		d = c.add(imm, d, 0, size, true)
+	case 5:
+		d ^= imm
+		c.setNZ(d, size)
+	case 6:
+		c.sub(imm, d, 0, size, false)
+		return nil
+	}
+	c.writeOp(dst, size, d)
+	return nil
+}
+
+// BTST, BCHG, BCLR and BSET.
+func (c *M68k) execBitOp(opcode uint16, bit uint32) error {
+	size := 1
+	if (opcode>>3)&7 == 0 {
+		size = 4
+	}
+	dst, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	bit &= uint32(size*8 - 1)
+	val := c.readOp(dst, size)
+	c.setFlag(flagZ, val&(1<<bit) == 0)
+	switch (opcode >> 6) & 3 {
+	case 0:
+		return nil
+	case 1:
+		val ^= 1 << bit
+	case 2:
+		val &^= 1 << bit
+	case 3:
+		val |= 1 << bit
+	}
+	c.writeOp(dst, size, val)
+	return nil
+}
+
+func (c *M68k) execMovep(opcode uint16) error {
+	dreg := (opcode >> 9) & 7
+	addr := c.a[opcode&7] + signExtend(c.fetch16(), 2)
+	count := 2
+	if opcode&0x40 != 0 {
+		count = 4
+	}
+	if opcode&0x80 != 0 {
+		// Register to memory
+		for i := 0; i < count; i++ {
+			c.write(addr, 1, c.d[dreg]>>(uint(count-1-i)*8))
+			addr += 2
+		}
+		return nil
+	}
+	var val uint32
+	for i := 0; i < count; i++ {
+		val = val<<8 | c.read(addr, 1)
+		addr += 2
+	}
+	c.writeOp(m68kOperand{kind: opDreg, reg: int(dreg)}, count, val)
+	return nil
+}
+
+func (c *M68k) execMove(opcode uint16) error {
+	var size int
+	switch opcode >> 12 {
+	case 1:
+		size = 1
+	case 2:
+		size = 4
+	default:
+		size = 2
+	}
+	src, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	val := c.readOp(src, size)
+	dstMode := (opcode >> 6) & 7
+	dstReg := (opcode >> 9) & 7
+	if dstMode == 1 {
+		// MOVEA
+		c.a[dstReg] = signExtend(val, size)
+		return nil
+	}
+	dst, err := c.ea(dstMode, dstReg, size)
+	if err != nil {
+		return err
+	}
+	c.writeOp(dst, size, val)
+	c.setNZ(val, size)
+	return nil
+}
+
+// Miscellaneous instructions.
+func (c *M68k) execGroup4(opcode uint16) error {
+	switch {
+	case opcode == 0x4afc:
+		c.pc -= 2
+		c.exception(vecIllegal)
+		return nil
+	case opcode&0xfff0 == 0x4e40:
+		c.exception(vecTrap0 + int(opcode&0xf))
+		return nil
+	case opcode&0xfff8 == 0x4e50:
+		// LINK
+		reg := opcode & 7
+		disp := signExtend(c.fetch16(), 2)
+		c.push(4, c.a[reg])
+		c.a[reg] = c.a[7]
+		c.a[7] += disp
+		return nil
+	case opcode&0xfff8 == 0x4e58:
+		// UNLK
+		reg := opcode & 7
+		c.a[7] = c.a[reg]
+		c.a[reg] = c.pop(4)
+		return nil
+	case opcode&0xfff0 == 0x4e60:
+		// MOVE USP
+		if !c.flag(flagS) {
+			c.pc -= 2
+			c.exception(vecPrivilege)
+			return nil
+		}
+		if opcode&8 != 0 {
+			c.a[opcode&7] = c.otherSp
+		} else {
+			c.otherSp = c.a[opcode&7]
+		}
+		return nil
+	case opcode == 0x4e70, opcode == 0x4e71:
+		// RESET, NOP
+		return nil
+	case opcode == 0x4e72:
+		imm := uint16(c.fetch16())
+		if !c.flag(flagS) {
+			c.pc -= 4
+			c.exception(vecPrivilege)
+			return nil
+		}
+		c.setSR(imm)
+		c.stopped = true
+		return errM68kStopped
+	case opcode == 0x4e73:
+		// RTE
+		if !c.flag(flagS) {
+			c.pc -= 2
+			c.exception(vecPrivilege)
+			return nil
+		}
+		sr := uint16(c.pop(2))
+		c.pc = c.pop(4)
+		c.setSR(sr)
+		return nil
+	case opcode == 0x4e75:
+		c.pc = c.pop(4)
+		return nil
+	case opcode == 0x4e76:
+		if c.flag(flagV) {
+			c.exception(vecTrapV)
+		}
+		return nil
+	case opcode == 0x4e77:
+		// RTR
+		c.setCCR(uint16(c.pop(2)))
+		c.pc = c.pop(4)
+		return nil
+	case opcode&0xffc0 == 0x4e80, opcode&0xffc0 == 0x4ec0:
+		// JSR, JMP
+		dst, err := c.eaLow(opcode, 4)
+		if err != nil {
+			return err
+		}
+		if dst.kind != opMem {
+			return fmt.Errorf("bad jump target at $%06x", c.pc)
+		}
+		if opcode&0x40 == 0 {
+			c.push(4, c.pc)
+		}
+		c.pc = dst.addr
+		return nil
+	case opcode&0xf1c0 == 0x41c0:
+		// LEA
+		src, err := c.eaLow(opcode, 4)
+		if err != nil {
+			return err
+		}
+		c.a[(opcode>>9)&7] = src.addr
+		return nil
+	case opcode&0xf1c0 == 0x4180:
+		// CHK
+		src, err := c.eaLow(opcode, 2)
+		if err != nil {
+			return err
+		}
+		bound := int16(c.readOp(src, 2))
+		val := int16(c.d[(opcode>>9)&7])
+		if val < 0 || val > bound {
+			c.setFlag(flagN, val < 0)
+			c.exception(vecChk)
+		}
+		return nil
+	case opcode&0xffc0 == 0x40c0:
+		// MOVE from SR
+		dst, err := c.eaLow(opcode, 2)
+		if err != nil {
+			return err
+		}
+		c.writeOp(dst, 2, uint32(c.sr))
+		return nil
+	case opcode&0xffc0 == 0x44c0, opcode&0xffc0 == 0x46c0:
+		// MOVE to CCR, MOVE to SR
+		toSR := opcode&0x200 != 0
+		if toSR && !c.flag(flagS) {
+			c.pc -= 2
+			c.exception(vecPrivilege)
+			return nil
+		}
+		src, err := c.eaLow(opcode, 2)
+		if err != nil {
+			return err
+		}
+		val := uint16(c.readOp(src, 2))
+		if toSR {
+			c.setSR(val)
+		} else {
+			c.setCCR(val)
+		}
+		return nil
+	case opcode&0xffc0 == 0x4800:
+		// NBCD
+		dst, err := c.eaLow(opcode, 1)
+		if err != nil {
+			return err
+		}
+		c.writeOp(dst, 1, c.sbcd(c.readOp(dst, 1), 0))
+		return nil
+	case opcode&0xfff8 == 0x4840:
+		// SWAP
+		reg := opcode & 7
+		val := c.d[reg]>>16 | c.d[reg]<<16
+		c.d[reg] = val
+		c.setNZ(val, 4)
+		return nil
+	case opcode&0xffc0 == 0x4840:
+		// PEA
+		src, err := c.eaLow(opcode, 4)
+		if err != nil {
+			return err
+		}
+		c.push(4, src.addr)
+		return nil
+	case opcode&0xfff8 == 0x4880:
+		// EXT.W
+		reg := opcode & 7
+		val := signExtend(c.d[reg], 1)
+		c.d[reg] = c.d[reg]&0xffff0000 | val&0xffff
+		c.setNZ(val, 2)
+		return nil
+	case opcode&0xfff8 == 0x48c0:
+		// EXT.L
+		reg := opcode & 7
+		c.d[reg] = signExtend(c.d[reg], 2)
+		c.setNZ(c.d[reg], 4)
+		return nil
+	case opcode&0xfb80 == 0x4880:
+		return c.execMovem(opcode)
+	case opcode&0xffc0 == 0x4ac0:
+		// TAS
+		dst, err := c.eaLow(opcode, 1)
+		if err != nil {
+			return err
+		}
+		val := c.readOp(dst, 1)
+		c.setNZ(val, 1)
+		c.writeOp(dst, 1, val|0x80)
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	if opcode&0xc0 == 0xc0 {
+		c.pc -= 2
+		c.exception(vecIllegal)
+		return nil
+	}
+	dst, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	switch opcode & 0xff00 {
+	case 0x4000:
+		// NEGX
+		x := uint32(0)
+		if c.flag(flagX) {
+			x = 1
+		}
+		z := c.flag(flagZ)
+		val := c.sub(c.readOp(dst, size), 0, x, size, true)
+		c.setFlag(flagZ, z && val == 0)
+		c.writeOp(dst, size, val)
+	case 0x4200:
+		// CLR
+		c.writeOp(dst, size, 0)
+		c.setNZ(0, size)
+	case 0x4400:
+		// NEG
+		c.writeOp(dst, size, c.sub(c.readOp(dst, size), 0, 0, size, true))
+	case 0x4600:
+		// NOT
+		val := ^c.readOp(dst, size)
+		c.setNZ(val, size)
+		c.writeOp(dst, size, val)
+	case 0x4a00:
+		// TST
+		c.setNZ(c.readOp(dst, size), size)
+	default:
+		c.pc -= 2
+		c.exception(vecIllegal)
+	}
+	return nil
+}
+
+func (c *M68k) execMovem(opcode uint16) error {
+	size := 2
+	if opcode&0x40 != 0 {
+		size = 4
+	}
+	mask := c.fetch16()
+	mode := (opcode >> 3) & 7
+	reg := opcode & 7
+	regPtr := func(i int) *uint32 {
+		if i < 8 {
+			return &c.d[i]
+		}
+		return &c.a[i-8]
+	}
+
+	if opcode&0x400 == 0 {
+		// Registers to memory
+		if mode == 4 {
+			// Pre-decrement stores A7 first, and the mask is reversed
+			addr := c.a[reg]
+			for i := 15; i >= 0; i-- {
+				if mask&(1<<uint(15-i)) != 0 {
+					addr -= uint32(size)
+					c.write(addr, size, *regPtr(i))
+				}
+			}
+			c.a[reg] = addr
+			return nil
+		}
+		dst, err := c.ea(mode, reg, size)
+		if err != nil {
+			return err
+		}
+		addr := dst.addr
+		for i := 0; i < 16; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				c.write(addr, size, *regPtr(i))
+				addr += uint32(size)
+			}
+		}
+		return nil
+	}
+
+	// Memory to registers
+	var addr uint32
+	if mode == 3 {
+		addr = c.a[reg]
+	} else {
+		src, err := c.ea(mode, reg, size)
+		if err != nil {
+			return err
+		}
+		addr = src.addr
+	}
+	for i := 0; i < 16; i++ {
+		if mask&(1<<uint(i)) != 0 {
+			*regPtr(i) = signExtend(c.read(addr, size), size)
+			addr += uint32(size)
+		}
+	}
+	if mode == 3 {
+		c.a[reg] = addr
+	}
+	return nil
+}
+
+// ADDQ, SUBQ, Scc and DBcc.
+func (c *M68k) execGroup5(opcode uint16) error {
+	mode := (opcode >> 3) & 7
+	cond := (opcode >> 8) & 0xf
+	if opcode&0xc0 == 0xc0 {
+		if mode == 1 {
+			// DBcc
+			reg := opcode & 7
+			base := c.pc
+			disp := signExtend(c.fetch16(), 2)
+			if !c.test(cond) {
+				count := uint16(c.d[reg]) - 1
+				c.d[reg] = c.d[reg]&0xffff0000 | uint32(count)
+				if count != 0xffff {
+					c.pc = base + disp
+				}
+			}
+			return nil
+		}
+		// Scc
+		dst, err := c.eaLow(opcode, 1)
+		if err != nil {
+			return err
+		}
+		val := uint32(0)
+		if c.test(cond) {
+			val = 0xff
+		}
+		c.writeOp(dst, 1, val)
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	data := uint32((opcode >> 9) & 7)
+	if data == 0 {
+		data = 8
+	}
+	isSub := opcode&0x100 != 0
+	if mode == 1 {
+		// Address registers are always changed as a long, with no flags
+		reg := opcode & 7
+		if isSub {
+			c.a[reg] -= data
+		} else {
+			c.a[reg] += data
+		}
+		return nil
+	}
+	dst, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	d := c.readOp(dst, size)
+	if isSub {
+		d = c.sub(data, d, 0, size, true)
+	} else {
+		d = c.add(data, d, 0, size, true)
+	}
+	c.writeOp(dst, size, d)
+	return nil
+}
+
+// Bcc, BRA and BSR.
+func (c *M68k) execBranch(opcode uint16) error {
+	cond := (opcode >> 8) & 0xf
+	base := c.pc
+	disp := signExtend(uint32(opcode), 1)
+	if disp == 0 {
+		disp = signExtend(c.fetch16(), 2)
+	}
+	if cond == 1 {
+		// BSR
+		c.push(4, c.pc)
+		c.pc = base + disp
+		return nil
+	}
+	if c.test(cond) {
+		c.pc = base + disp
+	}
+	return nil
+}
+
+// OR, AND, MULU, MULS, DIVU, DIVS, ABCD, SBCD and EXG.
+func (c *M68k) execLogicMulDiv(opcode uint16) error {
+	reg := (opcode >> 9) & 7
+	isAnd := opcode>>12 == 0xc
+
+	switch {
+	case opcode&0x1c0 == 0xc0, opcode&0x1c0 == 0x1c0:
+		src, err := c.eaLow(opcode, 2)
+		if err != nil {
+			return err
+		}
+		s := c.readOp(src, 2)
+		signed := opcode&0x100 != 0
+		if isAnd {
+			return c.mul(reg, s, signed)
+		}
+		return c.div(reg, s, signed)
+	case opcode&0x1f0 == 0x100:
+		// ABCD, SBCD
+		var src, dst m68kOperand
+		if opcode&8 != 0 {
+			src, _ = c.ea(4, opcode&7, 1)
+			dst, _ = c.ea(4, reg, 1)
+		} else {
+			src = m68kOperand{kind: opDreg, reg: int(opcode & 7)}
+			dst = m68kOperand{kind: opDreg, reg: int(reg)}
+		}
+		s := c.readOp(src, 1)
+		d := c.readOp(dst, 1)
+		if isAnd {
+			c.writeOp(dst, 1, c.abcd(s, d))
+		} else {
+			c.writeOp(dst, 1, c.sbcd(s, d))
+		}
+		return nil
+	case isAnd && opcode&0x130 == 0x100:
+		// EXG
+		rx := reg
+		ry := opcode & 7
+		switch opcode & 0xf8 {
+		case 0x40:
+			c.d[rx], c.d[ry] = c.d[ry], c.d[rx]
+		case 0x48:
+			c.a[rx], c.a[ry] = c.a[ry], c.a[rx]
+		case 0x88:
+			c.d[rx], c.a[ry] = c.a[ry], c.d[rx]
+		default:
+			c.pc -= 2
+			c.exception(vecIllegal)
+		}
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	op, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	s := c.readOp(op, size)
+	d := c.d[reg]
+	var r uint32
+	if isAnd {
+		r = s & d
+	} else {
+		r = s | d
+	}
+	c.setNZ(r, size)
+	if opcode&0x100 != 0 {
+		c.writeOp(op, size, r)
+	} else {
+		c.writeOp(m68kOperand{kind: opDreg, reg: int(reg)}, size, r)
+	}
+	return nil
+}
+
+func (c *M68k) mul(reg uint16, s uint32, signed bool) error {
+	var r uint32
+	if signed {
+		r = uint32(int32(int16(s)) * int32(int16(c.d[reg])))
+	} else {
+		r = (s & 0xffff) * (c.d[reg] & 0xffff)
+	}
+	c.d[reg] = r
+	c.setNZ(r, 4)
+	return nil
+}
+
+func (c *M68k) div(reg uint16, s uint32, signed bool) error {
+	if s&0xffff == 0 {
+		c.exception(vecZeroDiv)
+		return nil
+	}
+	var quot, rem uint32
+	if signed {
+		dividend := int64(int32(c.d[reg]))
+		divisor := int64(int16(s))
+		q := dividend / divisor
+		if q < -0x8000 || q > 0x7fff {
+			c.setFlag(flagV, true)
+			c.setFlag(flagC, false)
+			return nil
+		}
+		quot = uint32(q)
+		rem = uint32(dividend % divisor)
+	} else {
+		dividend := c.d[reg]
+		divisor := s & 0xffff
+		q := dividend / divisor
+		if q > 0xffff {
+			c.setFlag(flagV, true)
+			c.setFlag(flagC, false)
+			return nil
+		}
+		quot = q
+		rem = dividend % divisor
+	}
+	c.d[reg] = rem<<16 | quot&0xffff
+	c.setNZ(quot, 2)
+	return nil
+}
+
+func (c *M68k) abcd(s, d uint32) uint32 {
+	x := uint32(0)
+	if c.flag(flagX) {
+		x = 1
+	}
+	r := s&0xf + d&0xf + x
+	if r > 9 {
+		r += 6
+	}
+	r += s&0xf0 + d&0xf0
+	carry := r > 0x99
+	if carry {
+		r -= 0xa0
+	}
+	c.setBcdFlags(r, carry)
+	return r & 0xff
+}
+
+func (c *M68k) sbcd(s, d uint32) uint32 {
+	x := uint32(0)
+	if c.flag(flagX) {
+		x = 1
+	}
+	r := d&0xf - s&0xf - x
+	if r > 9 {
+		r -= 6
+	}
+	r += d&0xf0 - s&0xf0
+	borrow := r > 0x99
+	if borrow {
+		r += 0xa0
+	}
+	c.setBcdFlags(r, borrow)
+	return r & 0xff
+}
+
+// BCD instructions only ever clear Z.
+func (c *M68k) setBcdFlags(r uint32, carry bool) {
+	c.setFlag(flagC, carry)
+	c.setFlag(flagX, carry)
+	c.setFlag(flagN, r&0x80 != 0)
+	c.setFlag(flagV, false)
+	if r&0xff != 0 {
+		c.setFlag(flagZ, false)
+	}
+}
+
+// ADD, ADDA, ADDX, SUB, SUBA and SUBX.
+func (c *M68k) execAddSub(opcode uint16) error {
+	reg := (opcode >> 9) & 7
+	isSub := opcode>>12 == 0x9
+	opmode := (opcode >> 6) & 7
+
+	if opmode == 3 || opmode == 7 {
+		// ADDA/SUBA, no flags
+		size := 2
+		if opmode == 7 {
+			size = 4
+		}
+		src, err := c.eaLow(opcode, size)
+		if err != nil {
+			return err
+		}
+		s := signExtend(c.readOp(src, size), size)
+		if isSub {
+			c.a[reg] -= s
+		} else {
+			c.a[reg] += s
+		}
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	if opcode&0x130 == 0x100 {
+		// ADDX/SUBX
+		var src, dst m68kOperand
+		if opcode&8 != 0 {
+			src, _ = c.ea(4, opcode&7, size)
+			dst, _ = c.ea(4, reg, size)
+		} else {
+			src = m68kOperand{kind: opDreg, reg: int(opcode & 7)}
+			dst = m68kOperand{kind: opDreg, reg: int(reg)}
+		}
+		x := uint32(0)
+		if c.flag(flagX) {
+			x = 1
+		}
+		z := c.flag(flagZ)
+		s := c.readOp(src, size)
+		d := c.readOp(dst, size)
+		var r uint32
+		if isSub {
+			r = c.sub(s, d, x, size, true)
+		} else {
+			r = c.add(s, d, x, size, true)
+		}
+		c.setFlag(flagZ, z && r == 0)
+		c.writeOp(dst, size, r)
+		return nil
+	}
+
+	op, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	var s, d uint32
+	toEa := opcode&0x100 != 0
+	if toEa {
+		s = c.d[reg]
+		d = c.readOp(op, size)
+	} else {
+		s = c.readOp(op, size)
+		d = c.d[reg]
+	}
+	var r uint32
+	if isSub {
+		r = c.sub(s, d, 0, size, true)
+	} else {
+		r = c.add(s, d, 0, size, true)
+	}
+	if toEa {
+		c.writeOp(op, size, r)
+	} else {
+		c.writeOp(m68kOperand{kind: opDreg, reg: int(reg)}, size, r)
+	}
+	return nil
+}
+
+// CMP, CMPA, CMPM and EOR.
+func (c *M68k) execCmpEor(opcode uint16) error {
+	reg := (opcode >> 9) & 7
+	opmode := (opcode >> 6) & 7
+
+	if opmode == 3 || opmode == 7 {
+		// CMPA
+		size := 2
+		if opmode == 7 {
+			size = 4
+		}
+		src, err := c.eaLow(opcode, size)
+		if err != nil {
+			return err
+		}
+		c.sub(signExtend(c.readOp(src, size), size), c.a[reg], 0, 4, false)
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	if opcode&0x138 == 0x108 {
+		// CMPM
+		src, _ := c.ea(3, opcode&7, size)
+		s := c.readOp(src, size)
+		dst, _ := c.ea(3, reg, size)
+		c.sub(s, c.readOp(dst, size), 0, size, false)
+		return nil
+	}
+
+	op, err := c.eaLow(opcode, size)
+	if err != nil {
+		return err
+	}
+	if opcode&0x100 != 0 {
+		// EOR
+		r := c.readOp(op, size) ^ c.d[reg]
+		c.setNZ(r, size)
+		c.writeOp(op, size, r)
+		return nil
+	}
+	c.sub(c.readOp(op, size), c.d[reg], 0, size, false)
+	return nil
+}
+
+// Shift and rotate instructions.
+func (c *M68k) execShift(opcode uint16) error {
+	left := opcode&0x100 != 0
+	if opcode&0xc0 == 0xc0 {
+		// Memory shift by one bit
+		dst, err := c.eaLow(opcode, 2)
+		if err != nil {
+			return err
+		}
+		kind := (opcode >> 9) & 3
+		c.writeOp(dst, 2, c.shift(c.readOp(dst, 2), 2, 1, kind, left))
+		return nil
+	}
+
+	size := m68kSize(opcode >> 6)
+	reg := opcode & 7
+	count := uint32((opcode >> 9) & 7)
+	if opcode&0x20 != 0 {
+		count = c.d[count] & 63
+	} else if count == 0 {
+		count = 8
+	}
+	kind := (opcode >> 3) & 3
+	r := c.shift(c.d[reg], size, count, kind, left)
+	c.writeOp(m68kOperand{kind: opDreg, reg: int(reg)}, size, r)
+	return nil
+}
+
+// Shift a value one bit at a time, for kinds AS, LS, ROX and RO.
+func (c *M68k) shift(val uint32, size int, count uint32, kind uint16, left bool) uint32 {
+	mask := sizeMask(size)
+	msb := sizeMsb(size)
+	val &= mask
+	x := c.flag(flagX)
+	carry := false
+	overflow := false
+	if kind == 2 {
+		// ROX with a zero count copies X to C
+		carry = x
+	}
+	for i := uint32(0); i < count; i++ {
+		var out bool
+		if left {
+			out = val&msb != 0
+			val = (val << 1) & mask
+			switch kind {
+			case 2:
+				if x {
+					val |= 1
+				}
+			case 3:
+				if out {
+					val |= 1
+				}
+			}
+			if kind == 0 && (val&msb != 0) != out {
+				overflow = true
+			}
+		} else {
+			out = val&1 != 0
+			top := uint32(0)
+			switch kind {
+			case 0:
+				top = val & msb
+			case 2:
+				if x {
+					top = msb
+				}
+			case 3:
+				if out {
+					top = msb
+				}
+			}
+			val = val>>1 | top
+		}
+		carry = out
+		if kind != 3 {
+			x = out
+		}
+	}
+	c.setNZ(val, size)
+	c.setFlag(flagC, carry)
+	c.setFlag(flagV, overflow)
+	if kind != 3 && count != 0 {
+		c.setFlag(flagX, x)
+	}
+	return val
+}
@@ -0,0 +1,519 @@
+package ymp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// This is the number of registers - 1, since the mixer
+// register data is mixed into the channel volume register streams.
+const NumStreams = 13
+
+var StreamNames = [NumStreams]string{
+	"A period lo", "A period hi",
+	"B period lo", "B period hi",
+	"C period lo", "C period hi",
+	"Noise period",
+	"A volume + mixer",
+	"B volume + mixer",
+	"C volume + mixer",
+	"Env period lo", "Env period hi",
+	"Env shape"}
+
+// Contains a single stream of packed or unpacked data.
+type ByteSlice []byte
+
+func EncByte(output []byte, value byte) []byte {
+	return append(output, value)
+}
+
+func EncWord(output []byte, value uint16) []byte {
+	output = append(output, byte(value>>8))
+	return append(output, byte(value&255))
+}
+
+func EncLong(output []byte, value uint32) []byte {
+	output = append(output, byte(value>>24)&255)
+	output = append(output, byte(value>>16)&255)
+	output = append(output, byte(value>>8)&255)
+	return append(output, byte(value&255))
+}
+
+// Little-endian versions, for Z80 targets
+func EncWordLE(output []byte, value uint16) []byte {
+	output = append(output, byte(value&255))
+	return append(output, byte(value>>8))
+}
+
+func EncLongLE(output []byte, value uint32) []byte {
+	output = EncWordLE(output, uint16(value&0xffff))
+	return EncWordLE(output, uint16(value>>16))
+}
+
+// Raw unpacked data for all the registers, plus tune length.
+type YmStreams struct {
+	// A binary array for each streamData stream to pack
+	StreamData [NumStreams][]byte
+	NumVbls    int // size of each packedstream
+	DataSize   int // sum of sizes of all register arrays
+}
+
+// Describes packing config for a single register stream
+type StreamPackCfg struct {
+	BufferSize int            // cache size for just this stream
+	Stats      *TokenizeStats // if not nil, filled in by the tokenizer
+}
+
+// Counts of the tokenizer's decisions for one stream, for -verbose output.
+type TokenizeStats struct {
+	MatchBytes   int
+	LitBytes     int
+	UsedMatch    int // lazy: matches taken
+	UsedMatchLit int // lazy: matches replaced by cheaper literals
+	UsedSecond   int // lazy: literals taken for a better match on the next byte
+}
+
+func FindLongestMatch(data []byte, head int, distance int) Match {
+	bestOffset := -1
+	bestLength := 0
+	maxDist := distance
+	if head < distance {
+		maxDist = head
+	}
+
+	for offset := 1; offset <= maxDist; offset++ {
+		length := 0
+		checkPos := head - offset
+		for head+length < len(data) &&
+			data[checkPos+length] == data[head+length] &&
+			length < 0xff00 {
+			length++
+		}
+		if length >= 3 && length > bestLength {
+			bestLength = length
+			bestOffset = offset
+		}
+	}
+	return Match{Len: bestLength, Off: bestOffset}
+}
+
+func FindCheapestMatch(enc Encoder, data []byte, head int, distance int) Match {
+	bestMatch := Match{0, 0}
+	// Any pack rate of less than 8 bits/byte is automatically useless
+	var bestCost float64 = 8.0
+	maxDist := distance
+	if head < distance {
+		maxDist = head
+	}
+	for offset := 1; offset <= maxDist; offset++ {
+		length := 0
+		checkPos := head - offset
+		for head+length < len(data) &&
+			data[checkPos+length] == data[head+length] &&
+			length < 0xff00 {
+			length++
+		}
+		if length >= 3 {
+			m := Match{Len: length, Off: offset}
+			mc := float64(enc.Cost(0, m)) / float64(length)
+			if mc < bestCost {
+				bestCost = mc
+				bestMatch = m
+			}
+		}
+	}
+	return bestMatch
+}
+
+// Add a number of literals to a set of tokens.
+// If the last entry was a match, create a new token to
+// represent them
+func AddLiterals(tokens []Token, count int, pos int) []Token {
+	lastIndex := len(tokens) - 1
+
+	// We also split literals at just before 64K to avoid runtime
+	// 16-bit overflow
+	if lastIndex >= 0 &&
+		!tokens[lastIndex].IsMatch &&
+		tokens[lastIndex].Len < 0xfff0 {
+		tokens[lastIndex].Len++
+	} else {
+		return append(tokens, Token{false, count, pos})
+	}
+	return tokens
+}
+
+func TokenizeGreedy(enc Encoder, data []byte, cfg StreamPackCfg) []Token {
+	var tokens []Token
+	var stats TokenizeStats
+
+	head := 0
+	for head < len(data) {
+		best := FindLongestMatch(data, head, cfg.BufferSize)
+		if best.Len != 0 {
+			head += best.Len
+			tokens = append(tokens, Token{true, best.Len, best.Off})
+			stats.MatchBytes += best.Len
+		} else {
+			// Literal
+			tokens = AddLiterals(tokens, 1, head)
+			head++ // literal
+			stats.LitBytes++
+		}
+	}
+	if cfg.Stats != nil {
+		*cfg.Stats = stats
+	}
+	return tokens
+}
+
+func TokenizeLazy(enc Encoder, data []byte, useCheapest bool, cfg StreamPackCfg) []Token {
+	var tokens []Token
+	var stats TokenizeStats
+	head := 0
+
+	var best0 Match
+	var best1 Match
+	bufferSize := cfg.BufferSize
+	for head < len(data) {
+		if useCheapest {
+			best0 = FindCheapestMatch(enc, data, head, bufferSize)
+		} else {
+			best0 = FindLongestMatch(data, head, bufferSize)
+		}
+		chooseLit := best0.Len == 0
+
+		// We have 2 choices really
+		// Apply 0 (as a match or a literal)
+		// Apply literal 0 (and check the next byte for a match)
+		if !chooseLit {
+			// See if doing N literals is smaller
+			cost0 := enc.Cost(0, best0)
+			costLit := enc.Cost(best0.Len, Match{})
+			if costLit < cost0 {
+				chooseLit = true
+				stats.UsedMatchLit++
+			}
+		}
+
+		if !chooseLit {
+			stats.UsedMatch++
+			// We only need to decide to choose the second match, if both
+			// 0 and 1 are matches rather than literals.
+			if best0.Len != 0 && head+1 < len(data) {
+				if useCheapest {
+					best1 = FindCheapestMatch(enc, data, head+1, bufferSize)
+				} else {
+					best1 = FindLongestMatch(data, head+1, bufferSize)
+				}
+				if best1.Len != 0 {
+					cost0 := enc.Cost(0, best0)
+					cost1 := enc.Cost(1, best1)
+					rate0 := float32(cost0) / float32(best0.Len)
+					rate1 := float32(cost1) / float32(1+best1.Len)
+					if rate1 < rate0 {
+						chooseLit = true
+						stats.UsedMatch--
+						stats.UsedSecond++
+					}
+				}
+			}
+		}
+
+		// Add the decision to the token stream,
+		// and update the encoder's state so it can update future encoding costs.
+		if chooseLit {
+			// Literal
+			tokens = AddLiterals(tokens, 1, head)
+			head++
+			enc.ApplyLit(1)
+			stats.LitBytes++
+		} else {
+			head += best0.Len
+			tokens = append(tokens, Token{true, best0.Len, best0.Off})
+			stats.UsedMatch++
+			enc.ApplyMatch(best0)
+			stats.MatchBytes += best0.Len
+		}
+	}
+	if cfg.Stats != nil {
+		*cfg.Stats = stats
+	}
+	return tokens
+}
+
+// Take the 14 raw register arrays and multiplex the mixer bits
+// into the final YmStreams representation.
+// NOTE: this overwrites contents of some of the original
+// RawRegisters byte slices (for the volume channels)
+func RemapFromRaw(rawRegs *RawRegisters) (*YmStreams, error) {
+	// Pull out mixer bits and write into the volume streams
+	for channel := 0; channel < 3; channel++ {
+		target_channel := 8 + channel
+		tone_bit := channel
+		noise_bit := channel + 3
+
+		for i, val := range rawRegs.Data[7] {
+			volVal := rawRegs.Data[target_channel][i]
+			if (volVal & 0xc0) != 0 {
+				return nil, fmt.Errorf("Bad volume register value: %x", volVal)
+			}
+			// Put the tone and noise mixer bits into bits
+			// 6 and 7 of the volume
+			var acc byte = 0
+			if val&(1<<tone_bit) != 0 {
+				acc |= 1 << 6
+			}
+			if val&(1<<noise_bit) != 0 {
+				acc |= 1 << 7
+			}
+			rawRegs.Data[target_channel][i] |= acc
+		}
+	}
+	var ymStr YmStreams
+	ymStr.NumVbls = len(rawRegs.Data[0])
+	ymStr.DataSize = 0
+	// Remap the final set
+	for strm := 0; strm < NumStreams; strm++ {
+		if strm < 7 {
+			ymStr.StreamData[strm] = rawRegs.Data[strm]
+		} else {
+			ymStr.StreamData[strm] = rawRegs.Data[strm+1]
+		}
+		// Accumulate data size
+		ymStr.DataSize += len(ymStr.StreamData[strm])
+	}
+	return &ymStr, nil
+}
+
+type TokenStreams [][]Token
+
+type PackResults struct {
+	PackedData  []byte
+	Tokens      *TokenStreams
+	HeaderSize  int // size of header, including the cache set data
+	CacheSize   int // total cache size required by the player
+	NumVbls     int
+	PaddingSize int             // zero bytes added at the end for the cache
+	LitBits     [NumStreams]int // encoded size of each stream's literal tokens
+	MatchBits   [NumStreams]int // encoded size of each stream's match tokens
+	Sets        []CacheSet      // in file order
+	TokenStats  [NumStreams]TokenizeStats
+}
+
+// Version byte in the .ymp header. The top bit is set if the header
+// words are little-endian.
+const ympVersion = 0x3
+const ympLittleEndianFlag = 0x80
+
+// Size of the .ymp header before the cache set data.
+const YmpFixedHeaderSize = 2 + 2 + 4 + NumStreams + 1
+
+// Settings for packing a whole file.
+type PackConfig struct {
+	CacheSizes []int  // cache size for each individual stream
+	Encoder    int    // encoder ID, see GetEncoder
+	Target     string // playback machine, see targetProfiles
+	Padding    bool   // add zero bytes for the cache at the end
+}
+
+// Core function to pack register streams and return the encoded .ymp data.
+func PackAll(ymStr *YmStreams, cfg PackConfig) (*PackResults, error) {
+	// Compression settings
+	useCheapest := false
+
+	streamCfg := StreamPackCfg{}
+
+	// Records the tokens needed
+	tokensPerStream := make(TokenStreams, NumStreams)
+	encInfo, err := GetEncoderInfo(cfg.Encoder)
+	if err != nil {
+		return nil, err
+	}
+	// The file format has nowhere to put a separate bit stream yet
+	if encInfo.BitChannel {
+		return nil, fmt.Errorf("encoder '%s' needs bit output, which .ymp files can't hold", encInfo.Name)
+	}
+	enc := encInfo.New()
+	if len(cfg.CacheSizes) != NumStreams {
+		return nil, fmt.Errorf("need %d cache sizes, got %d", NumStreams, len(cfg.CacheSizes))
+	}
+	for strmIdx, size := range cfg.CacheSizes {
+		if size < 1 {
+			return nil, fmt.Errorf("stream %d: cache size %d is too small", strmIdx, size)
+		}
+		if size > encInfo.MaxOffset {
+			return nil, fmt.Errorf("stream %d: cache size %d is larger than the '%s' encoder's maximum offset %d",
+				strmIdx, size, encInfo.Name, encInfo.MaxOffset)
+		}
+	}
+	target, err := GetTargetProfile(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	// Header values are big-endian, unless the target prefers otherwise
+	encWord, encLong := EncWord, EncLong
+	var version byte = ympVersion
+	if target.LittleEndian {
+		encWord, encLong = EncWordLE, EncLongLE
+		version |= ympLittleEndianFlag
+	}
+
+	var tokenStats [NumStreams]TokenizeStats
+	for strmIdx := 0; strmIdx < NumStreams; strmIdx++ {
+		streamCfg.BufferSize = cfg.CacheSizes[strmIdx]
+		streamCfg.Stats = &tokenStats[strmIdx]
+		// Pack
+		regData := ymStr.StreamData[strmIdx]
+		tokens := TokenizeLazy(enc, regData, useCheapest, streamCfg)
+		tokensPerStream[strmIdx] = tokens
+	}
+
+	// Group the registers into sets with the same size
+	sets := make(map[int][]int)
+	var setSizes []int
+	for strmIdx := 0; strmIdx < NumStreams; strmIdx++ {
+		size := cfg.CacheSizes[strmIdx]
+		if sets[size] == nil {
+			setSizes = append(setSizes, size)
+		}
+		sets[size] = append(sets[size], strmIdx)
+	}
+	// Smallest cache first, so the output doesn't depend on map order
+	sort.Ints(setSizes)
+
+	// Calc mapping of YM reg->stream in the file
+	// and generate the header data for them.
+
+	// We will output the registers to the file, ordered by set
+	// and flattened.
+	regOrder := make([]byte, NumStreams)
+	// The inverse order is used at runtime to map from YM reg
+	// to depacked stream in the file.
+	inverseRegOrder := make([]byte, NumStreams)
+
+	// Data repreesenting the set configuration
+	setHeaderData := []byte{}
+	var setList []CacheSet
+	var streamId byte = 0
+	for _, cacheSize := range setSizes {
+		set := sets[cacheSize]
+		setList = append(setList, CacheSet{CacheSize: cacheSize, Streams: set})
+		setHeaderData = encWord(setHeaderData, uint16(len(set)-1))
+		setHeaderData = encWord(setHeaderData, uint16(cacheSize))
+		for _, reg := range set {
+			inverseRegOrder[reg] = streamId
+			regOrder[streamId] = byte(reg)
+			streamId++
+		}
+	}
+
+	// Flag end of cache set
+	setHeaderData = encWord(setHeaderData, uint16(0xffff))
+
+	// Number of bytes required by the set data
+	// 4 bytes per set -- loop count, cache size
+	// 2 bytes -- end sentinel
+	if len(setHeaderData) != 2+(4*len(sets)) {
+		return nil, fmt.Errorf("cache set header is %d bytes, expected %d", len(setHeaderData), 2+(4*len(sets)))
+	}
+
+	// Do the final interleaving of the encoded tokens into a single stream,
+	// knowing the order-per-frame that they will be depacked in
+	p := NewPackStream()
+	nextTokenFrame := make([]int, NumStreams) // frame number when next token gets used
+	nextTokenIndex := make([]int, NumStreams) // index in tokensPerStream[x]
+	var litBits, matchBits [NumStreams]int
+
+	// Use a dumb loop to check the next token.
+	// We could use a constantly-sorted list (mapped by lower position+lower reg order),
+	// but there seems little need for the complexity since matches tend to be
+	// short.
+	for frameIdx := 0; frameIdx < ymStr.NumVbls; frameIdx++ {
+		for r := 0; r < NumStreams; r++ {
+			strmIdx := regOrder[r]
+			if nextTokenFrame[strmIdx] == frameIdx {
+				// Read the next token from the packed data
+				tIdx := nextTokenIndex[strmIdx]
+				t := tokensPerStream[strmIdx][tIdx]
+				bitsBefore := p.BitCount()
+				if err := enc.Encode(&t, p, ymStr.StreamData[strmIdx]); err != nil {
+					return nil, fmt.Errorf("stream %d, frame %d: %v", strmIdx, frameIdx, err)
+				}
+				if t.IsMatch {
+					matchBits[strmIdx] += p.BitCount() - bitsBefore
+				} else {
+					litBits[strmIdx] += p.BitCount() - bitsBefore
+				}
+
+				// Move on to the next tokem in this stream
+				nextTokenIndex[strmIdx]++
+				nextTokenFrame[strmIdx] += t.Len
+			}
+		}
+	}
+
+	// Generate the final data
+	outputData := make([]byte, 0)
+
+	// Calc overall header size
+	headerSize := YmpFixedHeaderSize + // header, cache size, num vbls, register order, encoder ID
+		len(setHeaderData) // set information
+
+	// Header: "Y" + 0x3 (version)
+	outputData = EncByte(outputData, 'Y')
+	outputData = EncByte(outputData, version)
+
+	// 0) Output required cache size (for user reference)
+	cacheSize := 0
+	for _, size := range cfg.CacheSizes {
+		cacheSize += size
+	}
+	outputData = encWord(outputData, uint16(cacheSize))
+
+	// 1) Output size in VBLs
+	outputData = encLong(outputData, uint32(ymStr.NumVbls))
+
+	// 2) Order of registers
+	outputData = append(outputData, inverseRegOrder...)
+	// 3) Encoder ID, in what was the padding byte. Players skip it.
+	outputData = EncByte(outputData, byte(encInfo.ID))
+
+	// Set data
+	outputData = append(outputData, setHeaderData...)
+
+	if len(outputData) != headerSize {
+		return nil, fmt.Errorf("header is %d bytes, expected %d", len(outputData), headerSize)
+	}
+
+	// ... then the data
+	outputData = append(outputData, p.byteData...)
+
+	// Add optional padding for the cache
+	paddingSize := 0
+	if cfg.Padding {
+		paddingSize = cacheSize
+		outputData = append(outputData, make([]byte, cacheSize)...)
+	}
+
+	pr := PackResults{
+		PackedData:  outputData,
+		Tokens:      &tokensPerStream,
+		HeaderSize:  headerSize,
+		CacheSize:   cacheSize,
+		NumVbls:     ymStr.NumVbls,
+		PaddingSize: paddingSize,
+		LitBits:     litBits,
+		MatchBits:   matchBits,
+		Sets:        setList,
+		TokenStats:  tokenStats,
+	}
+	return &pr, nil
+}
+
+// Write the packed .ymp data, including any padding, to w.
+func (pr *PackResults) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(pr.PackedData)
+	return int64(n), err
+}
@@ -1,4 +1,4 @@
-package main
+package ymp
 
 type PackStream struct {
 	byteData []byte // Data added as bytes
@@ -0,0 +1,311 @@
+package ymp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Master clocks for the machines we know about, in Hz.
+const (
+	ClockAtariST  = 2000000
+	ClockSpectrum = 1773400
+	ClockCPC      = 1000000
+)
+
+// The YM2149 has a 32-step logarithmic volume DAC, with roughly
+// 1.5dB between steps. Fixed (non-envelope) volumes use the odd
+// entries only, so volume 15 == step 31.
+var ymVolumeTable [32]float32
+
+func init() {
+	for step := 1; step < 32; step++ {
+		ymVolumeTable[step] = float32(math.Pow(10.0, float64(step-31)*1.5/20.0))
+	}
+	ymVolumeTable[0] = 0.0
+}
+
+// Parse a user-supplied clock description. This can either be a
+// machine name or a frequency in Hz.
+func ParseClock(desc string) (int, error) {
+	switch strings.ToLower(desc) {
+	case "st", "atari":
+		return ClockAtariST, nil
+	case "spectrum", "zx":
+		return ClockSpectrum, nil
+	case "cpc", "amstrad":
+		return ClockCPC, nil
+	}
+	hz, err := strconv.Atoi(desc)
+	if err != nil || hz <= 0 {
+		return 0, fmt.Errorf("unknown clock: '%s' (use st|spectrum|cpc or a value in Hz)", desc)
+	}
+	return hz, nil
+}
+
+// Emulation of the YM2149/AY-3-8910 sound generator.
+// Internally this ticks at (master clock / 8), which is the rate
+// the YM envelope generator steps at.
+type PSG struct {
+	regs [16]byte
+
+	// Tone generators
+	toneCount  [3]int
+	toneOutput [3]int
+
+	// Noise generator
+	noiseCount  int
+	noiseOutput int
+	noiseLfsr   uint32
+	noiseHalf   bool // noise is clocked at half the tone rate
+
+	// Envelope generator (see setEnvShape)
+	envCount   int
+	envStep    int
+	envAttack  int
+	envHold    bool
+	envAlt     bool
+	envHolding bool
+
+	// Converts from PSG ticks to output samples
+	tickRate   float64 // PSG ticks per second
+	sampleRate int
+	tickAccum  float64 // fractional ticks carried between samples
+}
+
+// Create a PSG emulator running from the given master clock,
+// that generates output at sampleRate.
+func NewPSG(clockHz int, sampleRate int) *PSG {
+	p := PSG{
+		tickRate:   float64(clockHz) / 8.0,
+		sampleRate: sampleRate,
+		noiseLfsr:  1,
+	}
+	p.setEnvShape(0)
+	return &p
+}
+
+func (p *PSG) tonePeriod(channel int) int {
+	period := int(p.regs[channel*2]) | int(p.regs[channel*2+1]&0xf)<<8
+	if period == 0 {
+		period = 1
+	}
+	return period
+}
+
+func (p *PSG) noisePeriod() int {
+	period := int(p.regs[6] & 0x1f)
+	if period == 0 {
+		period = 1
+	}
+	return period
+}
+
+func (p *PSG) envPeriod() int {
+	period := int(p.regs[11]) | int(p.regs[12])<<8
+	if period == 0 {
+		period = 1
+	}
+	return period
+}
+
+// Restart the envelope with a new shape.
+func (p *PSG) setEnvShape(shape byte) {
+	const mask = 0x1f
+	if shape&4 != 0 {
+		p.envAttack = mask
+	} else {
+		p.envAttack = 0
+	}
+	if shape&8 == 0 {
+		// Shapes 0-7 all hold at zero after the first cycle
+		p.envHold = true
+		p.envAlt = p.envAttack != 0
+	} else {
+		p.envHold = shape&1 != 0
+		p.envAlt = shape&2 != 0
+	}
+	p.envStep = mask
+	p.envHolding = false
+	p.envCount = 0
+}
+
+// Write a value to a PSG register.
+// Writing register 13 restarts the envelope.
+func (p *PSG) WriteReg(reg int, val byte) {
+	if reg < 0 || reg >= 16 {
+		return
+	}
+	p.regs[reg] = val
+	if reg == 13 {
+		p.setEnvShape(val & 0xf)
+	}
+}
+
+// Write a frame's worth of register data, in YM-file order.
+// As with the YM file formats, a value of 0xff for the envelope
+// shape means "not written", so the envelope does not restart.
+func (p *PSG) WriteFrame(frameRegs *[NumYmRegs]byte) {
+	for reg := 0; reg < 13; reg++ {
+		p.WriteReg(reg, frameRegs[reg])
+	}
+	if frameRegs[13] != 0xff {
+		p.WriteReg(13, frameRegs[13])
+	}
+}
+
+// Advance the generators by a single tick.
+func (p *PSG) tick() {
+	for ch := 0; ch < 3; ch++ {
+		p.toneCount[ch]++
+		if p.toneCount[ch] >= p.tonePeriod(ch) {
+			p.toneCount[ch] = 0
+			p.toneOutput[ch] ^= 1
+		}
+	}
+
+	p.noiseHalf = !p.noiseHalf
+	if p.noiseHalf {
+		p.noiseCount++
+		if p.noiseCount >= p.noisePeriod() {
+			p.noiseCount = 0
+			// 17-bit LFSR, taps on bits 0 and 3
+			bit := (p.noiseLfsr ^ (p.noiseLfsr >> 3)) & 1
+			p.noiseLfsr = (p.noiseLfsr >> 1) | (bit << 16)
+			p.noiseOutput = int(p.noiseLfsr & 1)
+		}
+	}
+
+	p.envCount++
+	if p.envCount >= p.envPeriod() {
+		p.envCount = 0
+		if !p.envHolding {
+			p.envStep--
+			if p.envStep < 0 {
+				if p.envHold {
+					if p.envAlt {
+						p.envAttack ^= 0x1f
+					}
+					p.envHolding = true
+					p.envStep = 0
+				} else {
+					if p.envAlt && (p.envStep&0x20) != 0 {
+						p.envAttack ^= 0x1f
+					}
+					p.envStep &= 0x1f
+				}
+			}
+		}
+	}
+}
+
+// Returns the current output level of a single channel, 0.0 to 1.0
+func (p *PSG) channelLevel(ch int) float32 {
+	mixer := p.regs[7]
+	toneOff := (mixer>>ch)&1 != 0
+	noiseOff := (mixer>>(ch+3))&1 != 0
+	if !((toneOff || p.toneOutput[ch] != 0) && (noiseOff || p.noiseOutput != 0)) {
+		return 0.0
+	}
+	vol := p.regs[8+ch]
+	if vol&0x10 != 0 {
+		return ymVolumeTable[p.envStep^p.envAttack]
+	}
+	vol &= 0xf
+	if vol == 0 {
+		return 0.0
+	}
+	return ymVolumeTable[vol*2+1]
+}
+
+// Generate numSamples of output, appending the level of each channel
+// (averaged over the sample period) to the "channels" slices.
+func (p *PSG) Render(numSamples int, channels *[3][]float32) {
+	ticksPerSample := p.tickRate / float64(p.sampleRate)
+	for i := 0; i < numSamples; i++ {
+		p.tickAccum += ticksPerSample
+		numTicks := int(p.tickAccum)
+		p.tickAccum -= float64(numTicks)
+
+		var acc [3]float32
+		for t := 0; t < numTicks; t++ {
+			p.tick()
+			for ch := 0; ch < 3; ch++ {
+				acc[ch] += p.channelLevel(ch)
+			}
+		}
+		for ch := 0; ch < 3; ch++ {
+			if numTicks != 0 {
+				acc[ch] /= float32(numTicks)
+			}
+			channels[ch] = append(channels[ch], acc[ch])
+		}
+	}
+}
+
+// Settings for rendering a full tune to audio.
+type RenderConfig struct {
+	ClockHz    int
+	SampleRate int
+	FrameRate  float64 // register updates per second
+}
+
+// Audio output of a whole tune, with each channel kept separate.
+type RenderedAudio struct {
+	Channels     [3][]float32
+	FrameOffsets []int // index of the first sample of each frame
+	SampleRate   int
+}
+
+// Play the register data through the PSG emulator.
+func RenderRegisters(rawRegs *RawRegisters, cfg RenderConfig) (*RenderedAudio, error) {
+	if cfg.FrameRate <= 0 || cfg.SampleRate <= 0 || cfg.ClockHz <= 0 {
+		return nil, fmt.Errorf("invalid render settings (clock %d, rate %.2f, sample rate %d)",
+			cfg.ClockHz, cfg.FrameRate, cfg.SampleRate)
+	}
+	numFrames := len(rawRegs.Data[0])
+	samplesPerFrame := float64(cfg.SampleRate) / cfg.FrameRate
+	audio := RenderedAudio{SampleRate: cfg.SampleRate}
+	for ch := 0; ch < 3; ch++ {
+		audio.Channels[ch] = make([]float32, 0, int(samplesPerFrame*float64(numFrames))+1)
+	}
+
+	psg := NewPSG(cfg.ClockHz, cfg.SampleRate)
+	var frameRegs [NumYmRegs]byte
+	frameEnd := 0.0
+	for frame := 0; frame < numFrames; frame++ {
+		for reg := 0; reg < NumYmRegs; reg++ {
+			frameRegs[reg] = rawRegs.Data[reg][frame]
+		}
+		psg.WriteFrame(&frameRegs)
+
+		audio.FrameOffsets = append(audio.FrameOffsets, len(audio.Channels[0]))
+		frameEnd += samplesPerFrame
+		psg.Render(int(frameEnd)-len(audio.Channels[0]), &audio.Channels)
+	}
+	return &audio, nil
+}
+
+// Mix the channels down to signed 16-bit mono, removing the DC offset
+// that comes from the PSG's unipolar output.
+func (a *RenderedAudio) MixMono() []int16 {
+	numSamples := len(a.Channels[0])
+	output := make([]int16, numSamples)
+	// Simple one-pole DC-blocking filter
+	var prevIn, prevOut float64
+	for i := 0; i < numSamples; i++ {
+		in := float64(a.Channels[0][i]+a.Channels[1][i]+a.Channels[2][i]) / 3.0
+		out := in - prevIn + 0.995*prevOut
+		prevIn = in
+		prevOut = out
+		sample := out * 32767.0
+		if sample > 32767 {
+			sample = 32767
+		} else if sample < -32768 {
+			sample = -32768
+		}
+		output[i] = int16(sample)
+	}
+	return output
+}
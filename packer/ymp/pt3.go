@@ -0,0 +1,599 @@
+package ymp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Offsets in the PT3 module header.
+const (
+	pt3OffsetVersion   = 13
+	pt3OffsetTitle     = 30
+	pt3OffsetAuthor    = 66
+	pt3OffsetToneTable = 99
+	pt3OffsetDelay     = 100
+	pt3OffsetNumPos    = 101
+	pt3OffsetLoopPos   = 102
+	pt3OffsetPatterns  = 103
+	pt3OffsetSamples   = 105
+	pt3OffsetOrnaments = 169
+	pt3OffsetPositions = 201
+	pt3MaxFrames       = 50 * 60 * 30 // stop runaway modules after 30 minutes
+)
+
+// Tone tables are built the same way as the Z80 player does: the
+// first octave is halved for each higher octave, either truncating
+// or rounding, and then a few entries are nudged by one.
+type pt3ToneTableDesc struct {
+	base        [12]uint16 // periods of the lowest octave
+	round       bool
+	corrections []int // note index, negative to decrement (-1 - index)
+}
+
+// Lowest octaves of the tables. The "real" table is the Pro Tracker
+// table shifted by one note.
+var pt3BaseProTracker = [12]uint16{0x0c22, 0x0b73, 0x0acf, 0x0a33, 0x09a1, 0x0917, 0x0894, 0x0819, 0x07a4, 0x0737, 0x06cf, 0x066d}
+var pt3BaseSoundTracker = [12]uint16{0x0ef8, 0x0e10, 0x0d60, 0x0c80, 0x0bd8, 0x0b28, 0x0a88, 0x09f0, 0x0960, 0x08e0, 0x0858, 0x07e0}
+var pt3BaseAsmOld = [12]uint16{0x0d3e, 0x0c80, 0x0bcc, 0x0b22, 0x0a82, 0x09ec, 0x095c, 0x08d6, 0x0858, 0x07e0, 0x076e, 0x0704}
+var pt3BaseAsm = [12]uint16{0x0d10, 0x0c55, 0x0ba4, 0x0afc, 0x0a5f, 0x09ca, 0x093d, 0x08b8, 0x083b, 0x07c5, 0x0755, 0x06ec}
+var pt3BaseReal = [12]uint16{0x0cda, 0x0c22, 0x0b73, 0x0acf, 0x0a33, 0x09a1, 0x0917, 0x0894, 0x0819, 0x07a4, 0x0737, 0x06cf}
+
+func pt3Dec(notes ...int) []int {
+	var out []int
+	for _, n := range notes {
+		out = append(out, -1-n)
+	}
+	return out
+}
+
+// Indexed by [table number][new], where "new" is for versions 3.4 and later.
+var pt3ToneTables = [4][2]pt3ToneTableDesc{
+	{
+		{pt3BaseProTracker, false, pt3Dec(0, 2, 4, 5, 6, 7, 9, 10, 12, 18, 30)},
+		{pt3BaseProTracker, true, pt3Dec(14, 16, 17, 19, 21, 22, 24, 42, 94, 95)},
+	},
+	{
+		{pt3BaseSoundTracker, false, pt3Dec(46)},
+		{pt3BaseSoundTracker, false, pt3Dec(46)},
+	},
+	{
+		{pt3BaseAsmOld, true, append(pt3Dec(24, 27, 38, 41, 47, 56), 65, 70, 78, 79, 80, 83, 84, 85, 86, 87, 87)},
+		{pt3BaseAsm, true, pt3Dec(13, 16, 18, 20, 21, 29, 38, 47, 93, 94, 95)},
+	},
+	{
+		{pt3BaseReal, true, pt3Dec(15, 17, 18, 20, 22, 23, 25, 95)},
+		{pt3BaseReal, true, pt3Dec(43, 15, 17, 18, 20, 22, 23, 25, 95)},
+	},
+}
+
+// Build the 96-note tone table for a table number and module version.
+func pt3ToneTable(table int, version int) [96]uint16 {
+	isNew := 0
+	if version >= 4 {
+		isNew = 1
+	}
+	desc := pt3ToneTables[table&3][isNew]
+	var notes [96]uint16
+	for octave := 0; octave < 8; octave++ {
+		for n := 0; n < 12; n++ {
+			period := desc.base[n] >> uint(octave)
+			if desc.round && octave > 0 && (desc.base[n]>>uint(octave-1))&1 != 0 {
+				period++
+			}
+			notes[octave*12+n] = period
+		}
+	}
+	if table&3 == 1 {
+		// Quirk of the original table
+		notes[23] = notes[23]&0xff00 | 0xfd
+	}
+	// Corrections only change the low byte
+	for _, c := range desc.corrections {
+		n, delta := c, uint16(1)
+		if c < 0 {
+			n, delta = -1-c, 0xffff
+		}
+		notes[n] = notes[n]&0xff00 | (notes[n]+delta)&0xff
+	}
+	return notes
+}
+
+// Build the volume table, which scales sample amplitudes by the
+// channel volume. Versions before 3.5 truncate, later ones round.
+func pt3VolumeTable(version int) [16][16]byte {
+	var table [16][16]byte
+	step, acc := 0x11, 0
+	if version < 5 {
+		step, acc = 0x10, 0x10
+	}
+	for vol := 1; vol < 16; vol++ {
+		acc += step
+		sum := 0
+		for amp := 0; amp < 16; amp++ {
+			val := sum >> 8
+			if version >= 5 && sum&0x80 != 0 {
+				val++
+			}
+			table[vol][amp] = byte(val)
+			sum += acc
+		}
+		if acc&0xff == 0x77 {
+			acc++
+		}
+	}
+	return table
+}
+
+// State of one channel of the player.
+type pt3Channel struct {
+	patternPos     int
+	ornamentPtr    int
+	ornamentLoop   int
+	ornamentLen    int
+	ornamentPos    int
+	samplePtr      int
+	sampleLoop     int
+	sampleLen      int
+	samplePos      int
+	volume         int
+	notesToSkip    int
+	skipCounter    int8
+	note           int
+	slideToNote    int
+	amplitude      byte
+	envEnabled     bool
+	enabled        bool
+	simpleGliss    bool
+	ampSliding     int
+	noiseSliding   byte
+	envSliding     byte
+	toneSlideCount int
+	onOff          int
+	onOffDelay     int
+	offOnDelay     int
+	toneSlideDelay int
+	toneSliding    int16
+	toneAcc        uint16
+	toneSlideStep  int16
+	toneDelta      int
+	tone           uint16
+}
+
+// A Pro Tracker 3 replayer, following the behaviour of the Z80 player.
+type pt3Player struct {
+	module      []byte
+	version     int
+	tones       [96]uint16
+	volumes     [16][16]byte
+	numPos      int
+	loopPos     int
+	patterns    int
+	delay       int
+	delayCount  int
+	position    int
+	envBase     uint16
+	envSlide    int16
+	envSlideAdd int16
+	envDelay    int8
+	envDelayCnt int8
+	noiseBase   byte
+	addToNoise  byte
+	envShape    byte // 0xff if not written this frame
+	chans       [3]pt3Channel
+	err         error
+}
+
+func (p *pt3Player) byteAt(off int) byte {
+	if off < 0 || off >= len(p.module) {
+		if p.err == nil {
+			p.err = fmt.Errorf("PT3 data out of range at offset %d", off)
+		}
+		return 0
+	}
+	return p.module[off]
+}
+
+func (p *pt3Player) wordAt(off int) uint16 {
+	return uint16(p.byteAt(off)) | uint16(p.byteAt(off+1))<<8
+}
+
+func (p *pt3Player) setSample(ch *pt3Channel, num int) {
+	ch.samplePtr = int(p.wordAt(pt3OffsetSamples + (num&31)*2))
+	ch.sampleLoop = int(p.byteAt(ch.samplePtr))
+	ch.sampleLen = int(p.byteAt(ch.samplePtr + 1))
+	ch.samplePtr += 2
+}
+
+func (p *pt3Player) setOrnament(ch *pt3Channel, num int) {
+	ch.ornamentPtr = int(p.wordAt(pt3OffsetOrnaments + (num&15)*2))
+	ch.ornamentLoop = int(p.byteAt(ch.ornamentPtr))
+	ch.ornamentLen = int(p.byteAt(ch.ornamentPtr + 1))
+	ch.ornamentPtr += 2
+}
+
+// Point the channels at the patterns for the current position.
+func (p *pt3Player) startPosition() {
+	pattern := int(p.byteAt(pt3OffsetPositions + p.position))
+	for i := range p.chans {
+		p.chans[i].patternPos = int(p.wordAt(p.patterns + pattern*2 + i*2))
+	}
+}
+
+func newPt3Player(module []byte) (*pt3Player, error) {
+	if len(module) < pt3OffsetPositions+1 {
+		return nil, errors.New("PT3 file too small for header")
+	}
+	p := &pt3Player{module: module}
+	p.version = 6
+	if v := module[pt3OffsetVersion]; v >= '0' && v <= '9' {
+		p.version = int(v - '0')
+	}
+	p.tones = pt3ToneTable(int(module[pt3OffsetToneTable]), p.version)
+	p.volumes = pt3VolumeTable(p.version)
+	p.numPos = int(module[pt3OffsetNumPos])
+	p.loopPos = int(module[pt3OffsetLoopPos])
+	p.patterns = int(p.wordAt(pt3OffsetPatterns))
+	p.delay = int(module[pt3OffsetDelay])
+	p.delayCount = 1
+	if p.numPos == 0 || p.loopPos >= p.numPos {
+		return nil, fmt.Errorf("bad PT3 position count %d or loop position %d", p.numPos, p.loopPos)
+	}
+
+	for i := range p.chans {
+		ch := &p.chans[i]
+		p.setOrnament(ch, 0)
+		p.setSample(ch, 1)
+		ch.volume = 15
+		ch.notesToSkip = 1
+		ch.skipCounter = 1
+	}
+	p.startPosition()
+	return p, p.err
+}
+
+// Read pattern data for a channel up to its next note.
+func (p *pt3Player) interpretPattern(ch *pt3Channel) {
+	prevNote := ch.note
+	prevSliding := ch.toneSliding
+	// Effect parameters follow the note, in reverse order of the commands
+	var effects []byte
+
+	for quit := false; !quit && p.err == nil; ch.patternPos++ {
+		val := p.byteAt(ch.patternPos)
+		switch {
+		case val >= 0xf0:
+			p.setOrnament(ch, int(val-0xf0))
+			ch.patternPos++
+			p.setSample(ch, int(p.byteAt(ch.patternPos))/2)
+			ch.envEnabled = false
+			ch.ornamentPos = 0
+		case val >= 0xd1:
+			p.setSample(ch, int(val-0xd0))
+		case val == 0xd0:
+			quit = true
+		case val >= 0xc1:
+			ch.volume = int(val - 0xc0)
+		case val == 0xc0 || val >= 0x50 && val <= 0xaf:
+			// Rest or note
+			ch.samplePos = 0
+			ch.ampSliding = 0
+			ch.noiseSliding = 0
+			ch.envSliding = 0
+			ch.ornamentPos = 0
+			ch.toneSlideCount = 0
+			ch.toneSliding = 0
+			ch.toneAcc = 0
+			ch.onOff = 0
+			ch.enabled = val != 0xc0
+			if ch.enabled {
+				ch.note = int(val - 0x50)
+			}
+			quit = true
+		case val >= 0xb2:
+			ch.envEnabled = true
+			p.envShape = val - 0xb1
+			p.envBase = uint16(p.byteAt(ch.patternPos+1))<<8 | uint16(p.byteAt(ch.patternPos+2))
+			ch.patternPos += 2
+			ch.ornamentPos = 0
+			p.envSlide = 0
+			p.envDelayCnt = 0
+		case val == 0xb1:
+			ch.patternPos++
+			ch.notesToSkip = int(p.byteAt(ch.patternPos))
+		case val == 0xb0:
+			ch.envEnabled = false
+			ch.ornamentPos = 0
+		case val >= 0x40:
+			p.setOrnament(ch, int(val-0x40))
+			ch.ornamentPos = 0
+		case val >= 0x20:
+			p.noiseBase = val - 0x20
+		case val >= 0x10:
+			if val == 0x10 {
+				ch.envEnabled = false
+			} else {
+				p.envShape = val - 0x10
+				p.envBase = uint16(p.byteAt(ch.patternPos+1))<<8 | uint16(p.byteAt(ch.patternPos+2))
+				ch.patternPos += 2
+				ch.envEnabled = true
+				p.envSlide = 0
+				p.envDelayCnt = 0
+			}
+			ch.patternPos++
+			p.setSample(ch, int(p.byteAt(ch.patternPos))/2)
+			ch.ornamentPos = 0
+		case val >= 1 && val <= 9:
+			effects = append(effects, val)
+		}
+	}
+
+	for i := len(effects) - 1; i >= 0 && p.err == nil; i-- {
+		pos := ch.patternPos
+		switch effects[i] {
+		case 1:
+			// Glissando
+			ch.toneSlideDelay = int(p.byteAt(pos))
+			ch.toneSlideCount = ch.toneSlideDelay
+			ch.toneSlideStep = int16(p.wordAt(pos + 1))
+			ch.patternPos += 3
+			ch.simpleGliss = true
+			ch.onOff = 0
+			if ch.toneSlideCount == 0 && p.version >= 7 {
+				ch.toneSlideCount++
+			}
+		case 2:
+			// Portamento to the new note
+			ch.simpleGliss = false
+			ch.onOff = 0
+			ch.toneSlideDelay = int(p.byteAt(pos))
+			ch.toneSlideCount = ch.toneSlideDelay
+			step := int16(p.wordAt(pos + 3))
+			if step < 0 {
+				step = -step
+			}
+			ch.toneSlideStep = step
+			ch.patternPos += 5
+			ch.toneDelta = int(p.tones[ch.note]) - int(p.tones[prevNote])
+			ch.slideToNote = ch.note
+			ch.note = prevNote
+			if p.version >= 6 {
+				ch.toneSliding = prevSliding
+			}
+			if ch.toneDelta-int(ch.toneSliding) < 0 {
+				ch.toneSlideStep = -ch.toneSlideStep
+			}
+		case 3:
+			ch.samplePos = int(p.byteAt(pos))
+			ch.patternPos++
+		case 4:
+			ch.ornamentPos = int(p.byteAt(pos))
+			ch.patternPos++
+		case 5:
+			ch.onOffDelay = int(p.byteAt(pos))
+			ch.offOnDelay = int(p.byteAt(pos + 1))
+			ch.onOff = ch.onOffDelay
+			ch.patternPos += 2
+			ch.toneSlideCount = 0
+			ch.toneSliding = 0
+		case 8:
+			p.envDelay = int8(p.byteAt(pos))
+			p.envDelayCnt = p.envDelay
+			p.envSlideAdd = int16(p.wordAt(pos + 1))
+			ch.patternPos += 3
+		case 9:
+			p.delay = int(p.byteAt(pos))
+			ch.patternPos++
+		}
+	}
+	ch.skipCounter = int8(ch.notesToSkip)
+}
+
+// Work out the register values for one channel for this tick.
+func (p *pt3Player) updateChannel(ch *pt3Channel, addToEnv *int, mixer *byte) {
+	if ch.enabled {
+		entry := ch.samplePtr + ch.samplePos*4
+		b0 := p.byteAt(entry)
+		b1 := p.byteAt(entry + 1)
+		ch.tone = p.wordAt(entry+2) + ch.toneAcc
+		if b1&0x40 != 0 {
+			ch.toneAcc = ch.tone
+		}
+		note := int8(byte(ch.note) + p.byteAt(ch.ornamentPtr+ch.ornamentPos))
+		if note < 0 {
+			note = 0
+		} else if note > 95 {
+			note = 95
+		}
+		ch.tone = (ch.tone + uint16(ch.toneSliding) + p.tones[note]) & 0xfff
+
+		if ch.toneSlideCount > 0 {
+			ch.toneSlideCount--
+			if ch.toneSlideCount == 0 {
+				ch.toneSliding += ch.toneSlideStep
+				ch.toneSlideCount = ch.toneSlideDelay
+				if !ch.simpleGliss {
+					if (ch.toneSlideStep < 0 && int(ch.toneSliding) <= ch.toneDelta) ||
+						(ch.toneSlideStep >= 0 && int(ch.toneSliding) >= ch.toneDelta) {
+						// Portamento has reached the target note
+						ch.note = ch.slideToNote
+						ch.toneSlideCount = 0
+						ch.toneSliding = 0
+					}
+				}
+			}
+		}
+
+		if b0&0x80 != 0 {
+			if b0&0x40 != 0 {
+				if ch.ampSliding < 15 {
+					ch.ampSliding++
+				}
+			} else if ch.ampSliding > -15 {
+				ch.ampSliding--
+			}
+		}
+		amp := int(b1&0xf) + ch.ampSliding
+		if amp < 0 {
+			amp = 0
+		} else if amp > 15 {
+			amp = 15
+		}
+		ch.amplitude = p.volumes[ch.volume][amp]
+		if b0&1 == 0 && ch.envEnabled {
+			ch.amplitude |= 0x10
+		}
+
+		if b1&0x80 != 0 {
+			// Envelope offset
+			var offset byte
+			if b0&0x20 != 0 {
+				offset = (b0>>1 | 0xf0) + ch.envSliding
+			} else {
+				offset = (b0>>1)&0xf + ch.envSliding
+			}
+			if b1&0x20 != 0 {
+				ch.envSliding = offset
+			}
+			*addToEnv += int(int8(offset))
+		} else {
+			// Noise offset
+			p.addToNoise = b0>>1 + ch.noiseSliding
+			if b1&0x20 != 0 {
+				ch.noiseSliding = p.addToNoise
+			}
+		}
+		*mixer |= (b1 >> 1) & 0x48
+
+		ch.samplePos++
+		if ch.samplePos >= ch.sampleLen {
+			ch.samplePos = ch.sampleLoop
+		}
+		ch.ornamentPos++
+		if ch.ornamentPos >= ch.ornamentLen {
+			ch.ornamentPos = ch.ornamentLoop
+		}
+	} else {
+		ch.amplitude = 0
+	}
+	*mixer >>= 1
+
+	if ch.onOff > 0 {
+		ch.onOff--
+		if ch.onOff == 0 {
+			ch.enabled = !ch.enabled
+			if ch.enabled {
+				ch.onOff = ch.onOffDelay
+			} else {
+				ch.onOff = ch.offOnDelay
+			}
+		}
+	}
+}
+
+// Run one tick of the player. Returns false when the module has
+// reached the end of its position list.
+func (p *pt3Player) tick(regs *[NumYmRegs]byte) bool {
+	p.envShape = 0xff
+	p.delayCount--
+	if p.delayCount == 0 {
+		chA := &p.chans[0]
+		chA.skipCounter--
+		if chA.skipCounter == 0 {
+			if p.byteAt(chA.patternPos) == 0 {
+				p.position++
+				if p.position == p.numPos {
+					return false
+				}
+				p.startPosition()
+				p.noiseBase = 0
+			}
+			p.interpretPattern(chA)
+		}
+		for i := 1; i < 3; i++ {
+			ch := &p.chans[i]
+			ch.skipCounter--
+			if ch.skipCounter == 0 {
+				p.interpretPattern(ch)
+			}
+		}
+		p.delayCount = p.delay
+	}
+
+	addToEnv := 0
+	var mixer byte
+	for i := range p.chans {
+		p.updateChannel(&p.chans[i], &addToEnv, &mixer)
+	}
+
+	for i, ch := range p.chans {
+		regs[i*2] = byte(ch.tone)
+		regs[i*2+1] = byte(ch.tone >> 8)
+		regs[8+i] = ch.amplitude
+	}
+	regs[6] = (p.noiseBase + p.addToNoise) & 0x1f
+	regs[7] = mixer
+	env := uint16(addToEnv) + uint16(p.envSlide) + p.envBase
+	regs[11] = byte(env)
+	regs[12] = byte(env >> 8)
+	regs[13] = p.envShape
+
+	if p.envDelayCnt > 0 {
+		p.envDelayCnt--
+		if p.envDelayCnt == 0 {
+			p.envDelayCnt = p.envDelay
+			p.envSlide += p.envSlideAdd
+		}
+	}
+	return true
+}
+
+// Returns true if the data looks like a PT3 module.
+func IsPt3Data(data []byte) bool {
+	return len(data) > pt3OffsetPositions &&
+		(strings.HasPrefix(string(data[:16]), "ProTracker 3.") ||
+			strings.HasPrefix(string(data[:17]), "Vortex Tracker II"))
+}
+
+// Play a PT3 module once through its position list, recording the
+// registers every tick. The loop frame is where the loop position starts.
+func readFromPT3(data []byte) (*RawRegisters, error) {
+	p, err := newPt3Player(data)
+	if err != nil {
+		return &RawRegisters{}, err
+	}
+	title := strings.TrimSpace(string(data[pt3OffsetTitle : pt3OffsetTitle+32]))
+	author := strings.TrimSpace(string(data[pt3OffsetAuthor : pt3OffsetAuthor+32]))
+
+	var rawRegs RawRegisters
+	rawRegs.Messages = append(rawRegs.Messages, fmt.Sprintf("PT3: '%s' by '%s', version 3.%d, tone table %d",
+		title, author, p.version, data[pt3OffsetToneTable]))
+	rawRegs.ClockHz = ClockSpectrum
+	rawRegs.PlayHz = defaultPlayHz
+	rawRegs.Title = title
+	rawRegs.Author = author
+	var regs [NumYmRegs]byte
+	lastPos := 0
+	for frame := 0; ; frame++ {
+		if frame >= pt3MaxFrames {
+			return &RawRegisters{}, errors.New("PT3 module did not end")
+		}
+		if !p.tick(&regs) {
+			break
+		}
+		if p.err != nil {
+			return &RawRegisters{}, p.err
+		}
+		if p.position != lastPos && p.position == p.loopPos {
+			rawRegs.LoopFrame = frame
+		}
+		lastPos = p.position
+		for reg := 0; reg < NumYmRegs; reg++ {
+			rawRegs.Data[reg] = append(rawRegs.Data[reg], regs[reg])
+		}
+	}
+	if len(rawRegs.Data[0]) == 0 {
+		return &RawRegisters{}, errors.New("PT3 module contains no frames")
+	}
+	return &rawRegs, nil
+}
@@ -0,0 +1,104 @@
+package ymp
+
+import "errors"
+
+// Index of the envelope shape stream, where 0xff means "not written"
+const envShapeStream = 12
+
+// Returns true for the 3 streams holding volume + mixer bits
+func isVolumeStream(strm int) bool {
+	return strm >= 7 && strm <= 9
+}
+
+// Loudness of a volume stream value, for comparing volumes.
+// Envelope mode counts as louder than any fixed volume.
+func volumeLevel(val byte) int {
+	if val&0x10 != 0 {
+		return 16
+	}
+	return int(val & 0xf)
+}
+
+// Convert the register streams to a different frame rate.
+//
+// Each output frame takes the source frames that start during it:
+//   - most streams use the value from the first of those frames, so
+//     timing stays aligned to the start of the output frame
+//   - volume streams use the loudest of those frames, so that short
+//     accents and drums are not lost when frames are dropped
+//   - envelope shape writes are kept exactly once: the last write in
+//     the frames is used, since each write restarts the envelope.
+//
+// When there are no source frames for an output frame (increasing the
+// rate), the previous values are held, and the envelope is not rewritten.
+func ResampleStreams(ymStr *YmStreams, fromHz int, toHz int) (*YmStreams, error) {
+	if fromHz <= 0 || toHz <= 0 {
+		return nil, errors.New("frame rates must be positive")
+	}
+	// Output frame for each source frame is floor(src * toHz / fromHz)
+	numOut := int((int64(ymStr.NumVbls)*int64(toHz) + int64(fromHz) - 1) / int64(fromHz))
+	var out YmStreams
+	out.NumVbls = numOut
+	for strm := 0; strm < NumStreams; strm++ {
+		out.StreamData[strm] = make([]byte, numOut)
+	}
+
+	src := 0
+	for frame := 0; frame < numOut; frame++ {
+		// Find the source frames starting in this output frame
+		start := src
+		for src < ymStr.NumVbls && int(int64(src)*int64(toHz)/int64(fromHz)) == frame {
+			src++
+		}
+		end := src
+
+		for strm := 0; strm < NumStreams; strm++ {
+			data := ymStr.StreamData[strm]
+			var val byte
+			switch {
+			case start == end:
+				// No new frames, hold the last state
+				val = data[start-1]
+				if strm == envShapeStream {
+					val = 0xff
+				}
+			case strm == envShapeStream:
+				val = 0xff
+				for i := start; i < end; i++ {
+					if data[i] != 0xff {
+						val = data[i]
+					}
+				}
+			case isVolumeStream(strm):
+				val = data[start]
+				for i := start + 1; i < end; i++ {
+					if volumeLevel(data[i]) > volumeLevel(val) {
+						val = data[i]
+					}
+				}
+			default:
+				val = data[start]
+			}
+			out.StreamData[strm][frame] = val
+		}
+	}
+
+	for strm := 0; strm < NumStreams; strm++ {
+		out.DataSize += len(out.StreamData[strm])
+	}
+	return &out, nil
+}
+
+// Choose the number of register updates to keep per frame for
+// "multi-speed" output, where the player calls the update several
+// times per frame. Returns 1 if the tune isn't multi-speed.
+func MultiSpeedFactor(fromHz int, toHz int) int {
+	factor := (fromHz + toHz/2) / toHz
+	if factor < 2 {
+		return 1
+	}
+	if factor > 4 {
+		factor = 4
+	}
+	return factor
+}
@@ -0,0 +1,250 @@
+package ymp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Memory layout used when running SNDH drivers.
+const (
+	stRamSize       = 4 * 1024 * 1024
+	stVectorStub    = 0x500 // RTE, used for all exception vectors
+	stReturnAddr    = 0x600 // return address for init/play calls
+	stStackTop      = 0x10000
+	stLoadAddr      = 0x10000 // where the SNDH file is loaded
+	stHardwareBase  = 0xff8000
+	stYmBase        = 0xff8800
+	stYmEnd         = 0xff8900
+	stMfpIerA       = 0xfffa07
+	stMfpIerB       = 0xfffa09
+	sndhInitSteps   = 50000000
+	sndhPlaySteps   = 2000000
+	sndhDefaultSecs = 180
+	sndhHeaderLimit = 2048 // maximum size of the tag area we scan
+)
+
+// A minimal Atari ST memory map: RAM, plus the YM2149 select and
+// data ports at $ff8800/$ff8802. Other hardware registers just
+// store what is written to them.
+type stMachine struct {
+	ram        []byte
+	hardware   []byte
+	ymSelect   byte
+	ymRegs     [16]byte
+	envWritten bool
+	timersUsed bool // MFP interrupts were enabled
+}
+
+func newStMachine() *stMachine {
+	return &stMachine{
+		ram:      make([]byte, stRamSize),
+		hardware: make([]byte, 0x1000000-stHardwareBase),
+	}
+}
+
+func (st *stMachine) Read8(addr uint32) byte {
+	switch {
+	case addr < stRamSize:
+		return st.ram[addr]
+	case addr >= stYmBase && addr < stYmEnd:
+		// Only the select port can be read back
+		if addr&3 == 0 {
+			return st.ymRegs[st.ymSelect]
+		}
+		return 0xff
+	case addr >= stHardwareBase:
+		return st.hardware[addr-stHardwareBase]
+	}
+	return 0
+}
+
+func (st *stMachine) Write8(addr uint32, val byte) {
+	switch {
+	case addr < stRamSize:
+		st.ram[addr] = val
+	case addr >= stYmBase && addr < stYmEnd:
+		// The ports are mirrored every 4 bytes
+		switch addr & 3 {
+		case 0:
+			st.ymSelect = val & 0xf
+		case 2:
+			st.ymRegs[st.ymSelect] = val
+			if st.ymSelect == 13 {
+				st.envWritten = true
+			}
+		}
+	case addr >= stHardwareBase:
+		if (addr == stMfpIerA || addr == stMfpIerB) && val != 0 {
+			st.timersUsed = true
+		}
+		st.hardware[addr-stHardwareBase] = val
+	}
+}
+
+// Information from the tags in an SNDH header.
+type SndhInfo struct {
+	Title    string
+	Composer string
+	Subtunes int
+	TimerHz  int
+	Seconds  []int // per subtune, 0 if unknown
+}
+
+// Read a null-terminated string, returning it and the offset after it.
+func sndhString(data []byte, pos int) (string, int) {
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return string(data[pos:]), len(data)
+	}
+	return string(data[pos : pos+end]), pos + end + 1
+}
+
+// Read the decimal number at the start of a string, e.g. "50" from "TC50".
+func sndhNumber(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	val, _ := strconv.Atoi(s[:end])
+	return val
+}
+
+// Parse the tags in an SNDH header. Unknown tags are skipped.
+func ParseSndhHeader(data []byte) (*SndhInfo, error) {
+	if len(data) >= 4 && string(data[:4]) == "ICE!" {
+		return nil, errors.New("SNDH file is ICE! packed, please unpack it first")
+	}
+	if len(data) < 16 || string(data[12:16]) != "SNDH" {
+		return nil, errors.New("not an SNDH file")
+	}
+	info := SndhInfo{Subtunes: 1, TimerHz: defaultPlayHz}
+	limit := len(data)
+	if limit > sndhHeaderLimit {
+		limit = sndhHeaderLimit
+	}
+
+	pos := 16
+	for pos+4 <= limit {
+		tag := string(data[pos : pos+4])
+		switch {
+		case tag == "HDNS":
+			pos = limit
+		case tag == "TITL":
+			info.Title, pos = sndhString(data, pos+4)
+		case tag == "COMM":
+			info.Composer, pos = sndhString(data, pos+4)
+		case tag == "RIPP", tag == "CONV", tag == "YEAR", tag == "FLAG":
+			_, pos = sndhString(data, pos+4)
+		case tag[:2] == "##":
+			info.Subtunes = sndhNumber(tag[2:])
+			if info.Subtunes == 0 {
+				info.Subtunes = 1
+			}
+			pos += 4
+		case tag[:2] == "TA", tag[:2] == "TB", tag[:2] == "TC", tag[:2] == "TD", tag[:2] == "!V":
+			var value string
+			value, pos = sndhString(data, pos+2)
+			if hz := sndhNumber(value); hz != 0 {
+				info.TimerHz = hz
+			}
+		case tag == "TIME":
+			pos += 4
+			for i := 0; i < info.Subtunes && pos+2 <= len(data); i++ {
+				info.Seconds = append(info.Seconds, int(data[pos])<<8|int(data[pos+1]))
+				pos += 2
+			}
+		default:
+			pos++
+		}
+	}
+	return &info, nil
+}
+
+// Call a subroutine in the driver and run it until it returns.
+func sndhCall(cpu *M68k, addr uint32, maxSteps int) error {
+	cpu.push(4, stReturnAddr)
+	cpu.pc = addr
+	for step := 0; step < maxSteps; step++ {
+		if cpu.pc == stReturnAddr {
+			return nil
+		}
+		if err := cpu.Step(); err != nil {
+			return fmt.Errorf("%v at $%06x", err, cpu.pc)
+		}
+	}
+	return fmt.Errorf("driver did not return after %d instructions", maxSteps)
+}
+
+// Run the 68000 driver in an SNDH file and record the YM registers
+// after every call to the play routine.
+// A subtune of 0 selects the first; seconds of 0 uses the time in the
+// header, or sndhDefaultSecs.
+func readFromSNDH(data []byte, subtune int, seconds int) (*RawRegisters, error) {
+	info, err := ParseSndhHeader(data)
+	if err != nil {
+		return &RawRegisters{}, err
+	}
+	if subtune == 0 {
+		subtune = 1
+	}
+	if subtune > info.Subtunes {
+		return &RawRegisters{}, fmt.Errorf("subtune %d requested, but file only has %d", subtune, info.Subtunes)
+	}
+	if seconds == 0 && subtune <= len(info.Seconds) {
+		seconds = info.Seconds[subtune-1]
+	}
+	if seconds == 0 {
+		seconds = sndhDefaultSecs
+	}
+	if len(data) > stRamSize-stLoadAddr {
+		return &RawRegisters{}, errors.New("SNDH file too large")
+	}
+
+	st := newStMachine()
+	copy(st.ram[stLoadAddr:], data)
+	cpu := NewM68k(st)
+	// Point every exception vector at an RTE, so traps to the OS return
+	for vec := uint32(0); vec < 256; vec++ {
+		cpu.write(vec*4, 4, stVectorStub)
+	}
+	cpu.write(stVectorStub, 2, 0x4e73)
+
+	cpu.a[7] = stStackTop
+	cpu.d[0] = uint32(subtune)
+	if err := sndhCall(cpu, stLoadAddr, sndhInitSteps); err != nil {
+		return &RawRegisters{}, fmt.Errorf("SNDH init: %v", err)
+	}
+
+	var rawRegs RawRegisters
+	rawRegs.Messages = append(rawRegs.Messages, fmt.Sprintf("SNDH: '%s' by '%s', subtune %d of %d, %d seconds at %d Hz",
+		info.Title, info.Composer, subtune, info.Subtunes, seconds, info.TimerHz))
+	rawRegs.ClockHz = ClockAtariST
+	rawRegs.PlayHz = info.TimerHz
+	rawRegs.Title = info.Title
+	rawRegs.Author = info.Composer
+	numFrames := seconds * info.TimerHz
+	if numFrames > maxFrames {
+		return &RawRegisters{}, fmt.Errorf("SNDH tune too long, %d seconds at %d Hz", seconds, info.TimerHz)
+	}
+	for frame := 0; frame < numFrames; frame++ {
+		cpu.a[7] = stStackTop
+		if err := sndhCall(cpu, stLoadAddr+8, sndhPlaySteps); err != nil {
+			return &RawRegisters{}, fmt.Errorf("SNDH play, frame %d: %v", frame, err)
+		}
+		for reg := 0; reg < NumYmRegs; reg++ {
+			val := st.ymRegs[reg]
+			if reg == 13 && !st.envWritten {
+				val = 0xff
+			}
+			rawRegs.Data[reg] = append(rawRegs.Data[reg], val)
+		}
+		st.envWritten = false
+	}
+	if st.timersUsed {
+		rawRegs.Messages = append(rawRegs.Messages,
+			"WARNING: tune enables MFP timers (SID or digi effects), these are not captured")
+	}
+	return &rawRegs, nil
+}
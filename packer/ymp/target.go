@@ -0,0 +1,74 @@
+package ymp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describes a machine that packed files are played back on.
+type TargetProfile struct {
+	Name         string
+	Desc         string
+	ClockHz      int
+	LittleEndian bool // header words are little-endian, for Z80 players
+	AyRegisters  bool // clear register bits that the AY-3-8910 doesn't have
+}
+
+var targetProfiles = []TargetProfile{
+	{"st", "Atari ST, YM2149 at 2MHz", ClockAtariST, false, false},
+	{"spectrum", "ZX Spectrum 128, AY-3-8910 at 1.7734MHz", ClockSpectrum, true, true},
+	{"cpc", "Amstrad CPC, AY-3-8910 at 1MHz", ClockCPC, true, true},
+}
+
+// Returns the names of all the targets, for help text.
+func TargetNames() string {
+	names := []string{}
+	for _, t := range targetProfiles {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, "|")
+}
+
+func GetTargetProfile(name string) (*TargetProfile, error) {
+	if name == "" {
+		return &targetProfiles[0], nil
+	}
+	for i := range targetProfiles {
+		if targetProfiles[i].Name == name {
+			return &targetProfiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown target '%s' (use %s)", name, TargetNames())
+}
+
+// The bits of each register which are used by the AY-3-8910.
+// Register 13 is handled separately, since 0xff means "not written".
+var ayRegisterMasks = [NumYmRegs]byte{
+	0xff, 0x0f, // A period
+	0xff, 0x0f, // B period
+	0xff, 0x0f, // C period
+	0x1f,             // Noise period
+	0x3f,             // Mixer (I/O port bits are left to the player)
+	0x1f, 0x1f, 0x1f, // Volumes
+	0xff, 0xff, // Env period
+	0x0f, // Env shape
+}
+
+// Clear any register bits which are not valid for the AY chip.
+// Returns the number of values changed.
+func MaskAyRegisters(rawRegs *RawRegisters) int {
+	numChanged := 0
+	for reg := 0; reg < NumYmRegs; reg++ {
+		mask := ayRegisterMasks[reg]
+		for i, val := range rawRegs.Data[reg] {
+			if reg == 13 && val == 0xff {
+				continue
+			}
+			if val&mask != val {
+				rawRegs.Data[reg][i] = val & mask
+				numChanged++
+			}
+		}
+	}
+	return numChanged
+}
@@ -0,0 +1,271 @@
+package ymp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A set of streams in a .ymp file that share the same cache size.
+type CacheSet struct {
+	CacheSize int
+	Streams   []int // logical stream indices, in file order
+}
+
+// The parsed header of a .ymp file.
+type YmpHeader struct {
+	Version      byte
+	LittleEndian bool // header words are little-endian
+	CacheSize    int  // total cache size declared in the header
+	NumVbls      int
+	Encoder      int              // encoder ID, or 0 for files from before it was recorded
+	Remap        [NumStreams]byte // logical stream -> position in file
+	RegOrder     [NumStreams]byte // position in file -> logical stream
+	Sets         []CacheSet
+	DataOffset   int // start of the interleaved token data
+}
+
+// Read and validate the header and cache set data of a .ymp file.
+func ParseYmpHeader(data []byte) (*YmpHeader, error) {
+	// Fixed-size part of header
+	if len(data) < YmpFixedHeaderSize+2 {
+		return nil, errors.New("not a .ymp file, too small for header")
+	}
+	if !IsYmpData(data) {
+		return nil, errors.New("not a .ymp file, bad header marker")
+	}
+	var hdr YmpHeader
+	hdr.Version = data[1] &^ ympLittleEndianFlag
+	hdr.LittleEndian = data[1]&ympLittleEndianFlag != 0
+	var order binary.ByteOrder = binary.BigEndian
+	if hdr.LittleEndian {
+		order = binary.LittleEndian
+	}
+	hdr.CacheSize = int(order.Uint16(data[2:]))
+	hdr.NumVbls = int(order.Uint32(data[4:]))
+
+	var used [NumStreams]bool
+	for strm := 0; strm < NumStreams; strm++ {
+		pos := data[8+strm]
+		if int(pos) >= NumStreams || used[pos] {
+			return nil, fmt.Errorf("bad remap table entry for stream %d (%d)", strm, pos)
+		}
+		used[pos] = true
+		hdr.Remap[strm] = pos
+		hdr.RegOrder[pos] = byte(strm)
+	}
+	hdr.Encoder = int(data[8+NumStreams])
+
+	// Cache set list, terminated with 0xffff
+	head := YmpFixedHeaderSize
+	filePos := 0
+	setCacheTotal := 0
+	for {
+		if head+2 > len(data) {
+			return nil, errors.New("truncated cache set data")
+		}
+		count := order.Uint16(data[head:])
+		head += 2
+		if count == 0xffff {
+			break
+		}
+		if head+2 > len(data) {
+			return nil, errors.New("truncated cache set data")
+		}
+		cacheSize := int(order.Uint16(data[head:]))
+		head += 2
+		numInSet := int(count) + 1
+		if filePos+numInSet > NumStreams {
+			return nil, errors.New("cache sets contain too many streams")
+		}
+		if cacheSize == 0 {
+			return nil, errors.New("cache set has zero size")
+		}
+		set := CacheSet{CacheSize: cacheSize}
+		for i := 0; i < numInSet; i++ {
+			set.Streams = append(set.Streams, int(hdr.RegOrder[filePos]))
+			filePos++
+		}
+		setCacheTotal += cacheSize * numInSet
+		hdr.Sets = append(hdr.Sets, set)
+	}
+	if filePos != NumStreams {
+		return nil, fmt.Errorf("cache sets only cover %d of %d streams", filePos, NumStreams)
+	}
+	// The header only has 16 bits for the total
+	if setCacheTotal&0xffff != hdr.CacheSize {
+		return nil, fmt.Errorf("cache size in header (%d) does not match cache sets (%d)",
+			hdr.CacheSize, setCacheTotal)
+	}
+	hdr.DataOffset = head
+	return &hdr, nil
+}
+
+// Returns the size of the cache used by a logical stream.
+func (hdr *YmpHeader) StreamCacheSize(strm int) int {
+	for _, set := range hdr.Sets {
+		for _, s := range set.Streams {
+			if s == strm {
+				return set.CacheSize
+			}
+		}
+	}
+	return 0
+}
+
+// Returns a new encoder for the file: the one recorded in the header,
+// or if the file doesn't record it, the one with ID "fallback".
+func (hdr *YmpHeader) NewEncoder(fallback int) (Encoder, error) {
+	id := hdr.Encoder
+	if id == 0 {
+		if fallback == 0 {
+			return nil, errors.New("the .ymp file does not record its encoder")
+		}
+		id = fallback
+	}
+	return GetEncoder(id)
+}
+
+// Called for each token read from a .ymp file, with the frame it
+// starts on and its offset in the file.
+type YmpTokenVisitor func(frame int, strm int, t Token, offset int)
+
+// Unpack a full .ymp file back to its register streams.
+// This follows the same interleaving and cache rules as the player.
+// If enc is nil, the encoder recorded in the header is used.
+// Returns the streams plus the offset of the end of the token data,
+// so that callers can check for trailing padding.
+func DecodeYmp(data []byte, enc Encoder) (*YmStreams, int, error) {
+	return WalkYmp(data, enc, nil)
+}
+
+// As DecodeYmp, reading the whole .ymp file from r.
+func ReadYmp(r io.Reader, enc Encoder) (*YmStreams, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ymStr, _, err := DecodeYmp(data, enc)
+	return ymStr, err
+}
+
+// As DecodeYmp, but also calls "visit" (if not nil) for every token.
+func WalkYmp(data []byte, enc Encoder, visit YmpTokenVisitor) (*YmStreams, int, error) {
+	hdr, err := ParseYmpHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hdr.NumVbls > maxFrames {
+		return nil, 0, fmt.Errorf("too many frames (%d)", hdr.NumVbls)
+	}
+	if enc == nil {
+		if enc, err = hdr.NewEncoder(0); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var cacheSizes [NumStreams]int
+	for strm := 0; strm < NumStreams; strm++ {
+		cacheSizes[strm] = hdr.StreamCacheSize(strm)
+	}
+
+	var ymStr YmStreams
+	ymStr.NumVbls = hdr.NumVbls
+	var tokens [NumStreams]Token
+	var remaining [NumStreams]int // bytes left to copy in the current token
+	var copyPos [NumStreams]int   // next byte to copy, within the token
+
+	head := hdr.DataOffset
+	for frame := 0; frame < hdr.NumVbls; frame++ {
+		for filePos := 0; filePos < NumStreams; filePos++ {
+			strm := hdr.RegOrder[filePos]
+			output := ymStr.StreamData[strm]
+			if remaining[strm] == 0 {
+				if head >= len(data) {
+					return nil, 0, fmt.Errorf("packed data ends early at frame %d", frame)
+				}
+				t, next, err := enc.DecodeToken(data, head)
+				if err != nil {
+					return nil, 0, fmt.Errorf("%v at frame %d", err, frame)
+				}
+				if t.Len == 0 {
+					return nil, 0, fmt.Errorf("zero-length token at offset %d", head)
+				}
+				if t.IsMatch {
+					if t.Off == 0 || t.Off > len(output) || t.Off > cacheSizes[strm] {
+						return nil, 0, fmt.Errorf("bad match offset %d for stream %d at frame %d",
+							t.Off, strm, frame)
+					}
+					copyPos[strm] = len(output) - t.Off
+				} else {
+					if next > len(data) {
+						return nil, 0, fmt.Errorf("literals run past end of data at frame %d", frame)
+					}
+					copyPos[strm] = t.Off
+				}
+				if visit != nil {
+					visit(frame, int(strm), t, head)
+				}
+				tokens[strm] = t
+				remaining[strm] = t.Len
+				head = next
+			}
+
+			// Copy a single byte, like the player does each frame
+			var val byte
+			if tokens[strm].IsMatch {
+				val = output[copyPos[strm]]
+			} else {
+				val = data[copyPos[strm]]
+			}
+			copyPos[strm]++
+			remaining[strm]--
+			ymStr.StreamData[strm] = append(output, val)
+		}
+	}
+
+	for strm := 0; strm < NumStreams; strm++ {
+		if remaining[strm] != 0 {
+			return nil, 0, fmt.Errorf("stream %d has a token running past the last frame", strm)
+		}
+		ymStr.DataSize += len(ymStr.StreamData[strm])
+	}
+	return &ymStr, head, nil
+}
+
+// The inverse of RemapFromRaw. Rebuild the 14 YM registers from the
+// packed streams, by pulling the mixer bits back out of the volumes.
+func RemapToRaw(ymStr *YmStreams) *RawRegisters {
+	var rawRegs RawRegisters
+	rawRegs.ClockHz = defaultClockHz
+	rawRegs.PlayHz = defaultPlayHz
+	for strm := 0; strm < NumStreams; strm++ {
+		reg := strm
+		if strm >= 7 {
+			reg = strm + 1
+		}
+		rawRegs.Data[reg] = make([]byte, ymStr.NumVbls)
+		copy(rawRegs.Data[reg], ymStr.StreamData[strm])
+	}
+
+	rawRegs.Data[7] = make([]byte, ymStr.NumVbls)
+	for channel := 0; channel < 3; channel++ {
+		volumes := rawRegs.Data[8+channel]
+		for i, val := range volumes {
+			if val&(1<<6) != 0 {
+				rawRegs.Data[7][i] |= 1 << channel
+			}
+			if val&(1<<7) != 0 {
+				rawRegs.Data[7][i] |= 1 << (channel + 3)
+			}
+			volumes[i] = val & 0x3f
+		}
+	}
+	return &rawRegs
+}
+
+// Returns true if the data looks like a packed .ymp file.
+func IsYmpData(data []byte) bool {
+	return len(data) >= 2 && data[0] == 'Y' && data[1]&^ympLittleEndianFlag == ympVersion
+}
@@ -0,0 +1,1045 @@
+package ymp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func check(condition bool, t *testing.T, msg string, args ...any) {
+	if !condition {
+		t.Errorf("FAIL: " + fmt.Sprintf(msg, args...))
+	}
+}
+
+func costsForMatches(enc Encoder, test *testing.T) {
+	var t Token
+	var m Match
+
+	input := make([]byte, 512)
+	t.IsMatch = true
+	for tlen := 1; tlen < 512; tlen++ {
+		m.Len = tlen
+		t.Len = tlen
+		for toff := 1; toff < 512; toff++ {
+			m.Off = toff
+			t.Off = toff
+			cost := enc.Cost(0, m)
+			encoded := NewPackStream()
+			if err := enc.Encode(&t, encoded, input); err != nil {
+				test.Fatal(err)
+			}
+			if encoded.BitCount() != cost {
+				test.Errorf("match_cost failure, len %d off %d: got %d, want %d",
+					tlen, toff, encoded.BitCount(), cost)
+			}
+		}
+	}
+}
+
+func costsForLits(enc Encoder, test *testing.T) {
+	var t Token
+	var m Match
+
+	input := make([]byte, 512)
+
+	t.IsMatch = false
+	for tlen := 1; tlen < 512; tlen++ {
+		cost := enc.Cost(tlen, m)
+		t.Len = tlen
+		encoded := NewPackStream()
+		if err := enc.Encode(&t, encoded, input); err != nil {
+			test.Fatal(err)
+		}
+		if encoded.BitCount() != cost {
+			test.Errorf("lit_cost failure: len %d: result %d, expected %d", tlen, encoded.BitCount(), cost)
+		}
+		enc.Reset()
+	}
+}
+
+func TestEncV2(t *testing.T) {
+	var costs = []struct {
+		lit                int
+		matchlen, matchoff int
+		want               int
+	}{
+		{1, 0, 0, 2 * 8}, // 1 literal == 1 byte + 1 lit
+		{2, 0, 0, 3 * 8},
+		{15, 0, 0, (15 + 1) * 8},
+		{16, 0, 0, (16 + 2) * 8},
+		{255, 0, 0, (255 + 2) * 8},
+		{256, 0, 0, (256 + 4) * 8}, // 00 00 00 256
+
+		{0, 1, 1, 1 * 8}, // match of 1,1 -> 1 byte
+	}
+	var e Encoder_v2
+	for _, tt := range costs {
+		e.numLiterals = 0 // reset
+		ans := e.Cost(tt.lit, Match{tt.matchlen, tt.matchoff})
+		if ans != tt.want {
+			t.Errorf("cost failure: got %d, want %d", ans, tt.want)
+		}
+
+		if tt.lit != 0 {
+			testname := fmt.Sprintf("lit_cost %d", tt.lit)
+			t.Run(testname, func(t *testing.T) {
+				ans := e.litCost(tt.lit)
+				if ans != tt.want {
+					t.Errorf("lit_cost failure: got %d, want %d", ans, tt.want)
+				}
+			})
+		}
+		if tt.matchlen != 0 {
+			testname := fmt.Sprintf("match_cost %d,%d", tt.matchlen, tt.matchoff)
+			t.Run(testname, func(t *testing.T) {
+				m := Match{tt.matchlen, tt.matchoff}
+				ans := e.matchCost(m)
+				if ans != tt.want {
+					t.Errorf("match_cost failure: got %d, want %d", ans, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// Counts around the points where the encoders change how they store
+// lengths and offsets, plus the tokenizers' literal split at 0xfff0
+// and the 16-bit maximum.
+var conformanceLengths = []int{1, 2, 0xe, 0xf, 0x10, 0x7f, 0x80, 0xff, 0x100, 0x101, 0xfff0, 0xfff1, 0xffff}
+var conformanceOffsets = []int{1, 2, 0xf, 0x10, 0xfe, 0xff, 0x100, 0x101, 0x1fe, 0x1ff, 0xfffe, 0xffff}
+
+// Checks that every encoder must pass, run for each registered one.
+// "newEnc" returns an encoder in its initial state.
+func TestEncoderConformance(t *testing.T) {
+	for _, info := range Encoders() {
+		info := info
+		newEnc := info.New
+		t.Run(fmt.Sprintf("encoder %d %s", info.ID, info.Name), func(t *testing.T) {
+			check(info.MaxMatchLen >= 0xfff0, t, "maximum length %d is below the tokenizers' 0xfff0", info.MaxMatchLen)
+			costsForMatches(newEnc(), t)
+			costsForLits(newEnc(), t)
+			conformanceLiteralRuns(t, newEnc)
+			conformanceReset(t, newEnc)
+			conformanceBoundaries(t, newEnc(), &info)
+			conformanceLimits(t, newEnc(), &info)
+			conformanceTokenizers(t, newEnc)
+			conformanceRandomTokens(t, newEnc(), int64(info.ID))
+		})
+	}
+}
+
+func TestEncoderRegistry(t *testing.T) {
+	for _, name := range []string{"v2", "2"} {
+		info, err := LookupEncoder(name)
+		check(err == nil && info.ID == 2, t, "lookup %s: %+v, %v", name, info, err)
+	}
+	for _, name := range []string{"v9", "0", ""} {
+		_, err := LookupEncoder(name)
+		check(err != nil, t, "lookup '%s' accepted", name)
+	}
+	_, err := GetEncoder(0)
+	check(err != nil, t, "encoder 0 accepted")
+	check(EncoderNames() == "v1|v2", t, "names = %s", EncoderNames())
+
+	// PackAll keeps within the encoder's limits
+	cfg := PackConfig{Encoder: 1}
+	for strm := 0; strm < NumStreams; strm++ {
+		cfg.CacheSizes = append(cfg.CacheSizes, 0x10000)
+	}
+	_, err = PackAll(&YmStreams{}, cfg)
+	check(err != nil, t, "cache larger than the maximum offset accepted")
+	for strm := range cfg.CacheSizes {
+		cfg.CacheSizes[strm] = 256
+	}
+	cfg.CacheSizes[3] = 0
+	_, err = PackAll(&YmStreams{}, cfg)
+	check(err != nil, t, "zero cache size accepted")
+
+	// Registering an ID or name twice is a programming error
+	saved := Encoders()
+	defer func() { encoders = saved }()
+	for _, info := range []EncoderInfo{{ID: 1, Name: "new"}, {ID: 99, Name: "v1"}, {ID: 256, Name: "big"}} {
+		func() {
+			defer func() {
+				check(recover() != nil, t, "registering %+v didn't panic", info)
+			}()
+			RegisterEncoder(info)
+		}()
+	}
+}
+
+// The cost of a literal run built up over several ApplyLit calls must
+// add up to the size of the encoded run, in steps of 1 or more.
+func conformanceLiteralRuns(t *testing.T, newEnc func() Encoder) {
+	input := make([]byte, 0xffff)
+	for _, step := range []int{1, 0x33} {
+		for _, runLen := range conformanceLengths {
+			enc := newEnc()
+			cost := 0
+			for done := 0; done < runLen; done += step {
+				count := step
+				if done+count > runLen {
+					count = runLen - done
+				}
+				cost += enc.Cost(count, Match{})
+				enc.ApplyLit(count)
+			}
+			p := NewPackStream()
+			if err := newEnc().Encode(&Token{false, runLen, 0}, p, input); err != nil {
+				t.Fatal(err)
+			}
+			check(p.BitCount() == cost, t, "literal run %d in steps of %d: cost %d, encoded %d bits",
+				runLen, step, cost, p.BitCount())
+		}
+	}
+
+	// A match ends the run
+	enc := newEnc()
+	enc.ApplyLit(0x80)
+	enc.ApplyMatch(Match{4, 1})
+	check(enc.Cost(1, Match{}) == newEnc().Cost(1, Match{}), t, "literal cost after a match differs from a new run")
+}
+
+// Reset must give the same costs as a new encoder.
+func conformanceReset(t *testing.T, newEnc func() Encoder) {
+	enc := newEnc()
+	enc.ApplyLit(0x123)
+	enc.Reset()
+	fresh := newEnc()
+	for _, count := range conformanceLengths {
+		check(enc.Cost(count, Match{}) == fresh.Cost(count, Match{}), t, "literal cost %d after Reset", count)
+		m := Match{count, conformanceOffsets[count%len(conformanceOffsets)]}
+		check(enc.Cost(0, m) == fresh.Cost(0, m), t, "match cost %d after Reset", count)
+	}
+}
+
+// Tokens at the boundary lengths and offsets must decode back to the
+// same token, ending where the encoded data ends.
+func conformanceBoundaries(t *testing.T, enc Encoder, info *EncoderInfo) {
+	input := make([]byte, 0xffff)
+	var tokens []Token
+	for _, length := range conformanceLengths {
+		if length > info.MaxMatchLen {
+			continue
+		}
+		tokens = append(tokens, Token{false, length, 0})
+		for _, off := range conformanceOffsets {
+			if off <= info.MaxOffset {
+				tokens = append(tokens, Token{true, length, off})
+			}
+		}
+	}
+	for _, tok := range tokens {
+		p := NewPackStream()
+		if err := enc.Encode(&tok, p, input); err != nil {
+			t.Fatalf("%+v: %v", tok, err)
+		}
+		if !info.BitChannel {
+			check(p.bitCount == 0, t, "%+v: wrote %d bits", tok, p.bitCount)
+		}
+		got, next, err := enc.DecodeToken(p.byteData, 0)
+		if err != nil {
+			t.Fatalf("%+v: %v", tok, err)
+		}
+		if !tok.IsMatch {
+			// Literal offsets are positions in the packed data
+			tok.Off = next - tok.Len
+		}
+		check(got == tok, t, "encoded %+v, decoded %+v", tok, got)
+		check(next == len(p.byteData), t, "%+v: decode ended at %d of %d", tok, next, len(p.byteData))
+	}
+}
+
+// Tokens just past the limits in the encoder's EncoderInfo must be
+// rejected.
+func conformanceLimits(t *testing.T, enc Encoder, info *EncoderInfo) {
+	input := make([]byte, info.MaxMatchLen+1)
+	bad := []Token{
+		{false, info.MaxMatchLen + 1, 0},
+		{true, info.MaxMatchLen + 1, 1},
+		{true, 1, info.MaxOffset + 1},
+		{true, 1, 0},
+		{false, 0, 0},
+	}
+	for _, tok := range bad {
+		check(enc.Encode(&tok, NewPackStream(), input) != nil, t, "%+v was encoded", tok)
+	}
+}
+
+// Long literal runs are split so the count stays within 16 bits, and
+// the tokenizers' output must round trip.
+func conformanceTokenizers(t *testing.T, newEnc func() Encoder) {
+	data := make([]byte, 0x20000)
+	rand.New(rand.NewSource(1)).Read(data)
+	cfg := StreamPackCfg{BufferSize: 4}
+	tokenizings := [][]Token{
+		TokenizeGreedy(newEnc(), data, cfg),
+		TokenizeLazy(newEnc(), data, false, cfg),
+	}
+	for i, tokens := range tokenizings {
+		enc := newEnc()
+		p := NewPackStream()
+		for _, tok := range tokens {
+			check(tok.Len <= 0xfff0, t, "tokenizer %d: token length %d", i, tok.Len)
+			if err := enc.Encode(&tok, p, data); err != nil {
+				t.Fatalf("tokenizer %d: %v", i, err)
+			}
+		}
+		unpacked, err := enc.Decode(p.byteData)
+		if err != nil {
+			t.Fatalf("tokenizer %d: %v", i, err)
+		}
+		check(bytes.Equal(unpacked, data), t, "tokenizer %d: round trip differs", i)
+	}
+}
+
+// A random mix of literals and matches must decode to the data it was
+// built from, and each token must cost what it encodes to.
+func conformanceRandomTokens(t *testing.T, enc Encoder, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+	var data []byte
+	var tokens []Token
+	for i := 0; i < 500; i++ {
+		length := 1 + rnd.Intn(300)
+		if rnd.Intn(25) == 0 {
+			length = conformanceLengths[rnd.Intn(len(conformanceLengths))]
+		}
+		if len(data) == 0 || rnd.Intn(3) == 0 {
+			tokens = append(tokens, Token{false, length, len(data)})
+			for j := 0; j < length; j++ {
+				data = append(data, byte(rnd.Intn(256)))
+			}
+			continue
+		}
+		off := 1 + rnd.Intn(len(data))
+		if off > 0xffff {
+			off = 0xffff
+		}
+		tokens = append(tokens, Token{true, length, off})
+		for j := 0; j < length; j++ {
+			data = append(data, data[len(data)-off])
+		}
+	}
+
+	p := NewPackStream()
+	for _, tok := range tokens {
+		var cost int
+		if tok.IsMatch {
+			cost = enc.Cost(0, Match{tok.Len, tok.Off})
+			enc.ApplyMatch(Match{tok.Len, tok.Off})
+		} else {
+			cost = enc.Cost(tok.Len, Match{})
+			enc.ApplyLit(tok.Len)
+		}
+		before := p.BitCount()
+		if err := enc.Encode(&tok, p, data); err != nil {
+			t.Fatal(err)
+		}
+		check(p.BitCount()-before == cost, t, "%+v: cost %d, encoded %d bits", tok, cost, p.BitCount()-before)
+		// Literal runs are costed from the start of the run, so the
+		// next literal token starts a new one
+		enc.ApplyMatch(Match{})
+	}
+	unpacked, err := enc.Decode(p.byteData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(bytes.Equal(unpacked, data), t, "random tokens: round trip differs")
+}
+
+func TestPackStreamBits(t *testing.T) {
+	p := NewPackStream()
+	check(len(p.bitData) == 0, t, "bitsize failure")
+	for i := 0; i < 8; i++ {
+		p.AddBit(1)
+		p.AddBit(0)
+	}
+	check(len(p.bitData) == 1, t, "bitsize failure")
+	for i := 0; i < 7; i++ {
+		p.AddBit(1)
+		p.AddBit(0)
+	}
+	check(len(p.bitData) == 2, t, "bitsize failure")
+	check(p.bitData[0] == 0xaaaa, t, "bitdata failure 0")
+	check(p.bitData[1] == 0xaaa8, t, "bitdata failure 1")
+	check(p.bitCount == 30, t, "bitcount = %d", p.bitCount)
+}
+
+func TestYmpRoundTrip(t *testing.T) {
+	for _, info := range Encoders() {
+		if info.BitChannel {
+			// Can't be written to a .ymp file
+			continue
+		}
+		encoder := info.ID
+		fh, err := os.Open("../../test_data/sanxion.ym")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawRegs, err := ReadRawRegisters(fh, LoadOptions{})
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ymStr, err := RemapFromRaw(rawRegs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := PackConfig{Encoder: encoder}
+		for strm := 0; strm < NumStreams; strm++ {
+			cfg.CacheSizes = append(cfg.CacheSizes, 256)
+		}
+		packResults, err := PackAll(ymStr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc := info.New()
+		unpacked, end, err := DecodeYmp(packResults.PackedData, enc)
+		if err != nil {
+			t.Fatalf("encoder %d: decode failed: %v", encoder, err)
+		}
+		check(end == len(packResults.PackedData), t, "encoder %d: decode ended at %d, want %d",
+			encoder, end, len(packResults.PackedData))
+		for strm := 0; strm < NumStreams; strm++ {
+			check(string(unpacked.StreamData[strm]) == string(ymStr.StreamData[strm]), t,
+				"encoder %d: stream %d mismatch", encoder, strm)
+			stats := packResults.TokenStats[strm]
+			check(stats.MatchBytes+stats.LitBytes == len(ymStr.StreamData[strm]), t,
+				"encoder %d: stream %d token stats %+v", encoder, strm, stats)
+		}
+
+		// The same through the io.Writer/io.Reader interfaces
+		var buf bytes.Buffer
+		n, err := packResults.WriteTo(&buf)
+		check(err == nil && n == int64(len(packResults.PackedData)), t, "WriteTo wrote %d, %v", n, err)
+		reread, err := ReadYmp(&buf, enc)
+		if err != nil {
+			t.Fatalf("encoder %d: ReadYmp failed: %v", encoder, err)
+		}
+		check(reread.NumVbls == ymStr.NumVbls, t, "encoder %d: ReadYmp frames %d", encoder, reread.NumVbls)
+
+		// The header records the encoder, so none needs to be given
+		hdr, err := ParseYmpHeader(packResults.PackedData)
+		check(err == nil && hdr.Encoder == encoder, t, "encoder %d: header records %d", encoder, hdr.Encoder)
+		_, _, err = DecodeYmp(packResults.PackedData, nil)
+		check(err == nil, t, "encoder %d: decode from header failed: %v", encoder, err)
+
+		// Older files have 0 there
+		old := append([]byte(nil), packResults.PackedData...)
+		old[YmpFixedHeaderSize-1] = 0
+		hdr, _ = ParseYmpHeader(old)
+		_, err = hdr.NewEncoder(0)
+		check(err != nil, t, "encoder %d: no encoder recorded or given, but no error", encoder)
+		enc, err = hdr.NewEncoder(encoder)
+		check(err == nil, t, "encoder %d: fallback failed: %v", encoder, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, info := range Encoders() {
+		encoder, enc := info.ID, info.New()
+		p := NewPackStream()
+		input := []byte{1}
+		check(enc.Encode(&Token{true, 4, 0}, p, input) != nil, t, "encoder %d: zero offset encoded", encoder)
+		check(enc.Encode(&Token{false, 2, 0}, p, input) != nil, t, "encoder %d: literals past end encoded", encoder)
+		check(enc.Encode(&Token{true, info.MaxMatchLen + 1, 1}, p, input) != nil, t, "encoder %d: long match encoded", encoder)
+
+		// A match before the start of the stream
+		p = NewPackStream()
+		check(enc.Encode(&Token{false, 1, 0}, p, input) == nil, t, "encoder %d: literal", encoder)
+		check(enc.Encode(&Token{true, 3, 2}, p, input) == nil, t, "encoder %d: match", encoder)
+		_, err := enc.Decode(p.byteData)
+		check(err != nil, t, "encoder %d: offset past start decoded", encoder)
+
+		// Every truncation of a packed file must fail cleanly
+		if info.BitChannel {
+			continue
+		}
+		var ymStr YmStreams
+		ymStr.NumVbls = 300
+		for strm := 0; strm < NumStreams; strm++ {
+			for frame := 0; frame < ymStr.NumVbls; frame++ {
+				ymStr.StreamData[strm] = append(ymStr.StreamData[strm], byte(frame*strm/7))
+			}
+		}
+		cfg := PackConfig{Encoder: encoder}
+		for strm := 0; strm < NumStreams; strm++ {
+			cfg.CacheSizes = append(cfg.CacheSizes, 64+strm)
+		}
+		pr, err := PackAll(&ymStr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for size := 0; size < len(pr.PackedData); size++ {
+			_, _, err := DecodeYmp(pr.PackedData[:size], enc)
+			check(err != nil, t, "encoder %d: truncated to %d bytes decoded", encoder, size)
+		}
+	}
+}
+
+func TestConvertClock(t *testing.T) {
+	var rawRegs RawRegisters
+	for reg := 0; reg < NumYmRegs; reg++ {
+		rawRegs.Data[reg] = make([]byte, 1)
+	}
+	rawRegs.ClockHz = ClockAtariST
+	rawRegs.Data[0][0], rawRegs.Data[1][0] = 0x01, 0x01 // 0x101 -> 0x81 (rounded)
+	rawRegs.Data[2][0], rawRegs.Data[3][0] = 0x03, 0x00 // 3 -> 2 (rounded)
+	rawRegs.Data[4][0], rawRegs.Data[5][0] = 0x00, 0x00 // unused, stays 0
+	rawRegs.Data[6][0] = 0x1f                           // 31 -> 16
+	rawRegs.Data[11][0], rawRegs.Data[12][0] = 0xff, 0xff
+
+	cc := ConvertClock(&rawRegs, ClockCPC)
+	check(rawRegs.Data[0][0] == 0x81 && rawRegs.Data[1][0] == 0, t, "tone A = %x %x", rawRegs.Data[1][0], rawRegs.Data[0][0])
+	check(rawRegs.Data[2][0] == 2, t, "tone B = %d", rawRegs.Data[2][0])
+	check(rawRegs.Data[4][0] == 0, t, "tone C = %d", rawRegs.Data[4][0])
+	check(rawRegs.Data[6][0] == 16, t, "noise = %d", rawRegs.Data[6][0])
+	check(rawRegs.Data[11][0] == 0x00 && rawRegs.Data[12][0] == 0x80, t, "env period wrong")
+	check(cc.NumClamped() == 0, t, "unexpected clamping")
+	check(rawRegs.ClockHz == ClockCPC, t, "clock not updated")
+
+	// Converting back up must clamp
+	cc = ConvertClock(&rawRegs, 4*ClockCPC)
+	check(cc.EnvClamped == 1 && cc.NoiseClamped == 1, t, "expected clamping, got %+v", cc)
+	check(rawRegs.Data[6][0] == 0x1f, t, "noise not clamped: %d", rawRegs.Data[6][0])
+}
+
+func TestResampleEnvelope(t *testing.T) {
+	var ymStr YmStreams
+	ymStr.NumVbls = 8
+	for strm := 0; strm < NumStreams; strm++ {
+		ymStr.StreamData[strm] = make([]byte, ymStr.NumVbls)
+	}
+	copy(ymStr.StreamData[envShapeStream], []byte{0xa, 0xff, 0xff, 0xe, 0xff, 0xff, 0xff, 0xff})
+	copy(ymStr.StreamData[7], []byte{1, 15, 2, 2, 3, 3, 0x10, 0})
+
+	// Halve the rate: retriggers must survive, and loud frames win
+	down, err := ResampleStreams(&ymStr, 100, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(down.NumVbls == 4, t, "numVbls = %d", down.NumVbls)
+	check(string(down.StreamData[envShapeStream]) == "\x0a\x0e\xff\xff", t,
+		"env = %x", down.StreamData[envShapeStream])
+	check(string(down.StreamData[7]) == "\x0f\x02\x03\x10", t, "volume = %x", down.StreamData[7])
+
+	// Double the rate: retriggers must not be duplicated
+	up, err := ResampleStreams(&ymStr, 50, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(up.NumVbls == 16, t, "numVbls = %d", up.NumVbls)
+	check(up.StreamData[envShapeStream][0] == 0xa && up.StreamData[envShapeStream][1] == 0xff, t,
+		"env = %x", up.StreamData[envShapeStream])
+	check(up.StreamData[envShapeStream][6] == 0xe && up.StreamData[envShapeStream][7] == 0xff, t,
+		"env = %x", up.StreamData[envShapeStream])
+	check(up.StreamData[7][2] == 15 && up.StreamData[7][3] == 15, t, "volume = %x", up.StreamData[7])
+}
+
+// A VGM log with two frames of AY writes.
+func testVGM() []byte {
+	header := make([]byte, 0x80)
+	copy(header, "Vgm ")
+	binary.LittleEndian.PutUint32(header[0x08:], 0x171)
+	binary.LittleEndian.PutUint32(header[0x34:], 0x80-0x34)
+	binary.LittleEndian.PutUint32(header[0x74:], ClockSpectrum)
+	header[0x78] = 0x00
+	vgm := append(header,
+		0xa0, 0, 0x12, // tone A
+		0xa0, 13, 0x0e, // envelope shape
+		0x50, 0x9f, // SN76489 write, ignored
+		0x62,          // one 60Hz frame
+		0xa0, 8, 0x0f, // volume A
+		0x61, 0xdf, 0x02, // 735 samples
+		0x66)
+	return vgm
+}
+
+func TestLoadVGM(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(testVGM())
+	zw.Close()
+
+	rawRegs, err := LoadRawRegisters(gz.Bytes(), LoadOptions{LogRate: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rawRegs.ClockHz == ClockSpectrum, t, "clock = %d", rawRegs.ClockHz)
+	check(rawRegs.PlayHz == 60, t, "rate = %d", rawRegs.PlayHz)
+	check(len(rawRegs.Data[0]) == 2, t, "frames = %d", len(rawRegs.Data[0]))
+	check(string(rawRegs.Data[0]) == "\x12\x12", t, "tone = %x", rawRegs.Data[0])
+	check(string(rawRegs.Data[8]) == "\x00\x0f", t, "volume = %x", rawRegs.Data[8])
+	check(string(rawRegs.Data[13]) == "\x0e\xff", t, "env = %x", rawRegs.Data[13])
+
+	// Only one level is unpacked, so a file that unpacks to itself
+	// can't recurse
+	var gz2 bytes.Buffer
+	zw = gzip.NewWriter(&gz2)
+	zw.Write(gz.Bytes())
+	zw.Close()
+	_, err = LoadRawRegisters(gz2.Bytes(), LoadOptions{})
+	check(err != nil, t, "gzip inside gzip accepted")
+	_, err = LoadRawRegisters(LhaPack("tune.vgz", gz.Bytes()), LoadOptions{})
+	check(err != nil, t, "gzip inside LHA accepted")
+
+	// DAC writes with waits of 15 samples, making up a whole frame
+	vgm := testVGM()
+	vgm = vgm[:len(vgm)-1]
+	vgm = append(vgm, bytes.Repeat([]byte{0x8f}, 49)...)
+	vgm = append(vgm, 0xa0, 8, 0x0a, 0x62, 0x66)
+	rawRegs, err = LoadRawRegisters(vgm, LoadOptions{LogRate: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(string(rawRegs.Data[8]) == "\x00\x0f\x0f\x0a", t, "volume with DAC waits = %x", rawRegs.Data[8])
+}
+
+// A PSG dump with six frames.
+func testPSG() []byte {
+	psg := make([]byte, 16)
+	copy(psg, "PSG\x1a")
+	psg = append(psg,
+		0xff,
+		0, 0x34, 13, 0x08, 8, 0x10, 0xff, // frame 0
+		0xfe, 1, // frames 1-4
+		1, 0x02, 0xff, // frame 5
+		0xfd)
+	return psg
+}
+
+func TestLoadPSG(t *testing.T) {
+	rawRegs, err := LoadRawRegisters(testPSG(), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rawRegs.ClockHz == ClockSpectrum, t, "clock = %d", rawRegs.ClockHz)
+	check(len(rawRegs.Data[0]) == 6, t, "frames = %d", len(rawRegs.Data[0]))
+	check(string(rawRegs.Data[0]) == "\x34\x34\x34\x34\x34\x34", t, "tone = %x", rawRegs.Data[0])
+	check(string(rawRegs.Data[1]) == "\x00\x00\x00\x00\x00\x02", t, "tone = %x", rawRegs.Data[1])
+	check(string(rawRegs.Data[13]) == "\x08\xff\xff\xff\xff\xff", t, "env = %x", rawRegs.Data[13])
+}
+
+// An SNDH file playing one second of a frame counter.
+func testSNDH() []byte {
+	sndh := []byte{
+		0x60, 0x00, 0x00, 0x22, // bra.w init
+		0x4e, 0x75, 0x4e, 0x71, // exit: rts
+		0x60, 0x00, 0x00, 0x2a, // bra.w play
+	}
+	sndh = append(sndh, "SNDHTC50\x00##01TIME\x00\x01HDNS\x00"...)
+	sndh = append(sndh,
+		// init: select mixer, write $38
+		0x41, 0xf8, 0x88, 0x00, // lea $ffff8800.w,a0
+		0x10, 0xbc, 0x00, 0x07, // move.b #7,(a0)
+		0x11, 0x7c, 0x00, 0x38, 0x00, 0x02, // move.b #$38,2(a0)
+		0x4e, 0x75, // rts
+		// play: write a frame counter to register 0
+		0x43, 0xfa, 0x00, 0x12, // lea counter(pc),a1
+		0x30, 0x11, // move.w (a1),d0
+		0x52, 0x51, // addq.w #1,(a1)
+		0x11, 0xfc, 0x00, 0x00, 0x88, 0x00, // move.b #0,$ffff8800.w
+		0x11, 0xc0, 0x88, 0x02, // move.b d0,$ffff8802.w
+		0x4e, 0x75, // rts
+		0x00, 0x00) // counter
+	return sndh
+}
+
+func TestLoadSNDH(t *testing.T) {
+	rawRegs, err := LoadRawRegisters(testSNDH(), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rawRegs.PlayHz == 50, t, "rate = %d", rawRegs.PlayHz)
+	check(len(rawRegs.Data[0]) == 50, t, "frames = %d", len(rawRegs.Data[0]))
+	for frame := 0; frame < len(rawRegs.Data[0]); frame++ {
+		check(rawRegs.Data[0][frame] == byte(frame), t, "frame %d: reg 0 = %d", frame, rawRegs.Data[0][frame])
+		check(rawRegs.Data[7][frame] == 0x38, t, "frame %d: mixer = %x", frame, rawRegs.Data[7][frame])
+		check(rawRegs.Data[13][frame] == 0xff, t, "frame %d: env = %x", frame, rawRegs.Data[13][frame])
+	}
+}
+
+// Run a short 68000 program and return the CPU state.
+func runM68k(t *testing.T, code []uint16) *M68k {
+	st := newStMachine()
+	cpu := NewM68k(st)
+	for i, w := range code {
+		cpu.write(stLoadAddr+uint32(i*2), 2, uint32(w))
+	}
+	cpu.write(stLoadAddr+uint32(len(code)*2), 2, 0x4e75)
+	cpu.a[7] = stStackTop
+	if err := sndhCall(cpu, stLoadAddr, 1000); err != nil {
+		t.Fatal(err)
+	}
+	return cpu
+}
+
+func TestM68kInstructions(t *testing.T) {
+	// moveq #100,d0; divu #7,d0
+	cpu := runM68k(t, []uint16{0x7064, 0x80fc, 0x0007})
+	check(cpu.d[0] == 0x2000e, t, "divu: d0 = %x", cpu.d[0])
+
+	// moveq #-3,d1; muls #5,d1
+	cpu = runM68k(t, []uint16{0x72fd, 0xc3fc, 0x0005})
+	check(cpu.d[1] == 0xfffffff1, t, "muls: d1 = %x", cpu.d[1])
+
+	// moveq #$19,d0; moveq #$28,d1; abcd d0,d1
+	cpu = runM68k(t, []uint16{0x7019, 0x7228, 0xc300})
+	check(cpu.d[1] == 0x47, t, "abcd: d1 = %x", cpu.d[1])
+
+	// moveq #-128,d0; asr.b #2,d0; roxl.w #1,d0
+	cpu = runM68k(t, []uint16{0x7080, 0xe400, 0xe350})
+	check(cpu.d[0] == 0xffffffc0 && cpu.flag(flagX), t, "shifts: d0 = %x", cpu.d[0])
+
+	// moveq #5,d0; loop: addq.l #2,d1; dbra d0,loop
+	cpu = runM68k(t, []uint16{0x7005, 0x5481, 0x51c8, 0xfffc})
+	check(cpu.d[1] == 12 && cpu.d[0]&0xffff == 0xffff, t, "dbra: d0 = %x d1 = %d", cpu.d[0], cpu.d[1])
+
+	// moveq #1,d0; moveq #2,d1; movem.l d0-d1,-(sp); movem.l (sp)+,d2-d3
+	cpu = runM68k(t, []uint16{0x7001, 0x7202, 0x48e7, 0xc000, 0x4cdf, 0x000c})
+	check(cpu.d[2] == 1 && cpu.d[3] == 2, t, "movem: d2 = %d d3 = %d", cpu.d[2], cpu.d[3])
+}
+
+func TestPt3Tables(t *testing.T) {
+	pt := pt3ToneTable(0, 6)
+	check(pt[0] == 0x0c22 && pt[14] == 0x0567 && pt[23] == 0x0337 && pt[95] == 0x000c, t,
+		"PT 3.6 table: %x %x %x %x", pt[0], pt[14], pt[23], pt[95])
+	old := pt3ToneTable(0, 3)
+	check(old[0] == 0x0c21 && old[12] == 0x0610 && old[18] == 0x0449, t,
+		"PT 3.3 table: %x %x %x", old[0], old[12], old[18])
+	asm := pt3ToneTable(2, 6)
+	check(asm[13] == 0x062a && asm[22] == 0x03ab, t, "ASM table: %x %x", asm[13], asm[22])
+	st := pt3ToneTable(1, 6)
+	check(st[12] == 0x077c && st[23] == 0x03fd, t, "ST table: %x %x", st[12], st[23])
+
+	for _, version := range []int{4, 5} {
+		vt := pt3VolumeTable(version)
+		for amp := 0; amp < 16; amp++ {
+			check(vt[15][amp] == byte(amp) && vt[0][amp] == 0, t, "volume table %d, amp %d", version, amp)
+		}
+	}
+	check(pt3VolumeTable(4)[1][15] == 1 && pt3VolumeTable(5)[1][15] == 1, t, "volume 1")
+}
+
+// A PT3 module playing one note over two positions.
+func testPT3() []byte {
+	module := make([]byte, 201)
+	copy(module, "ProTracker 3.6 compilation of test")
+	module[pt3OffsetDelay] = 3
+	module[pt3OffsetNumPos] = 2
+	module[pt3OffsetLoopPos] = 1
+	binary.LittleEndian.PutUint16(module[pt3OffsetPatterns:], 204)
+	binary.LittleEndian.PutUint16(module[pt3OffsetSamples+2:], 217)
+	binary.LittleEndian.PutUint16(module[pt3OffsetOrnaments:], 223)
+	module = append(module,
+		0, 0, 0xff, // positions: pattern 0 twice
+		210, 0, 213, 0, 215, 0, // pattern 0
+		0x80, 0xd0, 0x00, // channel A: C-4, empty row, end
+		0xc0, 0xd0, // channel B: rest
+		0xc0, 0xd0, // channel C: rest
+		0, 1, 0x00, 0x8f, 0x00, 0x00, // sample 1: volume 15, tone on
+		0, 1, 0) // ornament 0
+	return module
+}
+
+func TestLoadPT3(t *testing.T) {
+	rawRegs, err := LoadRawRegisters(testPT3(), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(rawRegs.Data[0]) == 12, t, "frames = %d", len(rawRegs.Data[0]))
+	check(rawRegs.LoopFrame == 6, t, "loop frame = %d", rawRegs.LoopFrame)
+	for frame := range rawRegs.Data[0] {
+		check(rawRegs.Data[0][frame] == 0xc2 && rawRegs.Data[1][frame] == 0, t, "frame %d: tone", frame)
+		check(rawRegs.Data[8][frame] == 15 && rawRegs.Data[9][frame] == 0, t, "frame %d: volume", frame)
+		check(rawRegs.Data[7][frame] == 0x08, t, "frame %d: mixer %x", frame, rawRegs.Data[7][frame])
+		check(rawRegs.Data[13][frame] == 0xff, t, "frame %d: env", frame)
+	}
+}
+
+// Register data where each frame's values are its frame number, with
+// channel A's volume at "volume" and a single envelope write.
+func testEditRegisters(numFrames int, volume byte) *RawRegisters {
+	rawRegs := RawRegisters{ClockHz: ClockAtariST, PlayHz: 50, LoopFrame: 4, Title: "edit"}
+	for reg := 0; reg < NumYmRegs; reg++ {
+		for frame := 0; frame < numFrames; frame++ {
+			rawRegs.Data[reg] = append(rawRegs.Data[reg], byte(frame))
+		}
+	}
+	for frame := 0; frame < numFrames; frame++ {
+		rawRegs.Data[8][frame] = volume
+		rawRegs.Data[9][frame] = 0
+		rawRegs.Data[10][frame] = 0
+		rawRegs.Data[13][frame] = 0xff
+	}
+	rawRegs.Data[13][1] = 0xa
+	return &rawRegs
+}
+
+func TestEditRegisters(t *testing.T) {
+	rawRegs := testEditRegisters(10, 15)
+	cut, err := CutRegisters(rawRegs, 3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(cut.Data[0]) == 5 && cut.Data[0][0] == 3, t, "cut frames %v", cut.Data[0])
+	check(cut.LoopFrame == 1 && cut.Title == "edit" && cut.PlayHz == 50, t, "cut metadata %+v", cut)
+	check(cut.Data[13][0] == 0xa && cut.Data[13][1] == 0xff, t, "envelope shape not carried over: %v", cut.Data[13])
+	check(rawRegs.Data[13][3] == 0xff, t, "cut changed the original")
+	cut, _ = CutRegisters(rawRegs, 5, 10)
+	check(cut.LoopFrame == 0, t, "loop frame before the cut = %d", cut.LoopFrame)
+	for _, r := range [][2]int{{-1, 5}, {5, 5}, {0, 11}} {
+		_, err = CutRegisters(rawRegs, r[0], r[1])
+		check(err != nil, t, "range %v accepted", r)
+	}
+
+	intro := testEditRegisters(6, 15)
+	joined, err := JoinRegisters(intro, rawRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(joined.Data[0]) == 16 && joined.Data[0][6] == 0, t, "joined frames %v", joined.Data[0])
+	check(joined.LoopFrame == 10, t, "joined loop frame = %d", joined.LoopFrame)
+	intro.PlayHz = 60
+	_, err = JoinRegisters(intro, rawRegs)
+	check(err != nil, t, "joined different frame rates")
+
+	// Silent, then envelope only, then a fixed volume, then silent
+	rawRegs = testEditRegisters(12, 0)
+	rawRegs.Data[10][4] = 0x10
+	for frame := 5; frame < 9; frame++ {
+		rawRegs.Data[8][frame] = 7
+	}
+	trimmed, start, end, err := TrimSilence(rawRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(start == 4 && end == 3, t, "trimmed %d and %d frames", start, end)
+	check(len(trimmed.Data[0]) == 5 && trimmed.Data[0][0] == 4, t, "trimmed frames %v", trimmed.Data[0])
+	_, _, _, err = TrimSilence(testEditRegisters(5, 0))
+	check(err != nil, t, "silent tune trimmed")
+}
+
+func TestDetectLoop(t *testing.T) {
+	// A 30 frame intro, then a 40 frame loop played 2.5 times
+	rawRegs := testEditRegisters(130, 15)
+	for frame := 70; frame < 130; frame++ {
+		for reg := 0; reg < NumYmRegs; reg++ {
+			rawRegs.Data[reg][frame] = rawRegs.Data[reg][frame-40]
+		}
+	}
+	loop, found := DetectLoop(rawRegs, 10)
+	check(found && loop == LoopInfo{30, 40, 60}, t, "loop %+v, found %v", loop, found)
+	check(loop.Playthroughs() == 2.5, t, "playthroughs = %f", loop.Playthroughs())
+	_, found = DetectLoop(rawRegs, 41)
+	check(!found, t, "found a loop longer than the repeat")
+
+	trimmed, err := TrimToLoop(rawRegs, loop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(trimmed.Data[0]) == 70 && trimmed.LoopFrame == 30, t, "trimmed to %d frames, loop frame %d",
+		len(trimmed.Data[0]), trimmed.LoopFrame)
+
+	// Silence at the end repeats, but isn't a loop
+	rawRegs = testEditRegisters(100, 15)
+	for frame := 60; frame < 100; frame++ {
+		for reg := 0; reg < NumYmRegs; reg++ {
+			rawRegs.Data[reg][frame] = 0
+		}
+	}
+	loop, found = DetectLoop(rawRegs, 4)
+	check(!found, t, "silent loop %+v", loop)
+}
+
+func TestWriteYM6(t *testing.T) {
+	data, err := os.ReadFile("../../test_data/motus.ym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawRegs, err := LoadRawRegisters(data, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawRegs.ClockHz = ClockSpectrum
+	rawRegs.PlayHz = 60
+	rawRegs.LoopFrame = 100
+	rawRegs.Title, rawRegs.Author, rawRegs.Comment = "Motus", "Mad Max", "test"
+
+	ym6 := EncodeYM6(rawRegs)
+	for _, lha := range []bool{false, true} {
+		file := ym6
+		if lha {
+			file = LhaPack("motus.ym", ym6)
+			check(len(file) < len(ym6)/2, t, "LHA output is %d bytes from %d", len(file), len(ym6))
+			unpacked, err := LhaUnpack(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(bytes.Equal(unpacked, ym6), t, "LHA round trip differs")
+		}
+		loaded, err := LoadRawRegisters(file, LoadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(loaded.ClockHz == ClockSpectrum && loaded.PlayHz == 60 && loaded.LoopFrame == 100, t,
+			"header = %d %d %d", loaded.ClockHz, loaded.PlayHz, loaded.LoopFrame)
+		check(loaded.Title == "Motus" && loaded.Author == "Mad Max" && loaded.Comment == "test", t,
+			"strings = %q %q %q", loaded.Title, loaded.Author, loaded.Comment)
+		for reg := 0; reg < NumYmRegs; reg++ {
+			check(bytes.Equal(loaded.Data[reg], rawRegs.Data[reg]), t, "lha %v: register %d differs", lha, reg)
+		}
+	}
+
+	// Short inputs and ones with a single symbol use special table forms
+	for _, input := range []string{"", "a", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "abcabcabcabd"} {
+		unpacked, err := LhaUnpack(LhaPack("x", []byte(input)))
+		check(err == nil && string(unpacked) == input, t, "LHA %q: got %q, %v", input, unpacked, err)
+	}
+}
+
+func TestLhaCrc(t *testing.T) {
+	input := []byte("YM3!\x01\x02\x03\x04")
+	archive := LhaPack("x", input)
+	crcPos := lhaLevel0 + 1
+	archive[crcPos] ^= 1
+	_, err := LhaUnpack(archive)
+	check(err != nil, t, "level 0 archive with bad CRC accepted")
+
+	// A stored file with a level 2 header
+	var level2 []byte
+	level2 = EncWordLE(level2, 26) // header size
+	level2 = append(level2, "-lh0-"...)
+	level2 = EncLongLE(level2, uint32(len(input)))
+	level2 = EncLongLE(level2, uint32(len(input)))
+	level2 = EncLongLE(level2, 0)    // time
+	level2 = append(level2, 0x20, 2) // reserved, level
+	level2 = EncWordLE(level2, lhaCrc16(input))
+	level2 = append(level2, 'U', 0, 0) // OS, no extended headers
+	level2 = append(level2, input...)
+	unpacked, err := LhaUnpack(level2)
+	check(err == nil && bytes.Equal(unpacked, input), t, "level 2 archive: got %q, %v", unpacked, err)
+	level2[len(level2)-1] ^= 1
+	_, err = LhaUnpack(level2)
+	check(err != nil, t, "level 2 archive with corrupt data accepted")
+}
+
+// Seed inputs for the loader fuzz tests: the test tunes, the example
+// .ymp and a small file in each of the other formats.
+func addLoaderSeeds(f *testing.F) {
+	for _, path := range []string{"../../test_data/led2.ym", "../../test_data/motus.ym",
+		"../../test_data/sanxion.ym", "../../player/example.ymp"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add(testVGM())
+	f.Add(testPSG())
+	f.Add(testSNDH())
+	f.Add(testPT3())
+}
+
+// Loaded register data must have the same number of frames in every
+// register, and no more than maxFrames.
+func checkRegisters(t *testing.T, rawRegs *RawRegisters) {
+	for reg := 0; reg < NumYmRegs; reg++ {
+		check(len(rawRegs.Data[reg]) == len(rawRegs.Data[0]), t, "register %d has %d frames, register 0 %d",
+			reg, len(rawRegs.Data[reg]), len(rawRegs.Data[0]))
+	}
+	check(len(rawRegs.Data[0]) <= maxFrames, t, "%d frames", len(rawRegs.Data[0]))
+}
+
+func FuzzLoadRawRegisters(f *testing.F) {
+	addLoaderSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rawRegs, err := LoadRawRegisters(data, LoadOptions{})
+		if err == nil {
+			checkRegisters(t, rawRegs)
+		}
+	})
+}
+
+// Fuzz the YM5/6 header fields separately, since random bytes rarely
+// make a valid header.
+func FuzzReadFromYM56(f *testing.F) {
+	f.Add(uint32(2), uint32(ymAttrInterleaved), uint16(0), uint16(0), []byte("t\x00a\x00c\x00"+strings.Repeat("\x01", 32)))
+	f.Add(uint32(1), uint32(0), uint16(1), uint16(2), []byte("\x00\x00\x00\x02dd\x00\x00\x00"+strings.Repeat("\x01", 16)))
+	f.Add(uint32(0xffffffff), uint32(0), uint16(0xffff), uint16(0xffff), []byte{})
+	f.Fuzz(func(t *testing.T, frameCount uint32, attr uint32, digiCount uint16, skipBytes uint16, rest []byte) {
+		var buf bytes.Buffer
+		header := YM56Header{FrameCount: frameCount, Attr: attr, DigiCount: digiCount, SkipBytes: skipBytes}
+		copy(header.Leonard[:], "LeOnArD!")
+		header.Header = 0x594d3621
+		binary.Write(&buf, binary.BigEndian, &header)
+		buf.Write(rest)
+		rawRegs, err := readFromYM56(buf.Bytes())
+		if err == nil {
+			checkRegisters(t, rawRegs)
+		}
+	})
+}
+
+// Both the single stream and full .ymp decoders must reject bad data
+// with an error.
+func FuzzDecode(f *testing.F) {
+	data, err := os.ReadFile("../../player/example.ymp")
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Just the start of the file, as the fuzzer is slow with large inputs
+	f.Add(data[:200])
+	f.Add([]byte{0x83, 1, 2, 3, 0x04, 0x03})
+	f.Add([]byte{0xf3, 1, 2, 3, 0x43, 0x20, 0x00, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, info := range Encoders() {
+			enc := info.New()
+			enc.Decode(data)
+			ymStr, _, err := DecodeYmp(data, enc)
+			if err == nil {
+				check(ymStr.NumVbls <= maxFrames, t, "%d frames", ymStr.NumVbls)
+			}
+		}
+	})
+}
+
+// Decoding the encoded tokens from every tokenizer must give back the
+// original data.
+func FuzzTokenizeRoundTrip(f *testing.F) {
+	f.Add([]byte("abcabcabcabcabd"), uint16(16))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1}, uint16(3))
+	f.Add(bytes.Repeat([]byte{1, 2, 3, 4, 5}, 100), uint16(300))
+	f.Fuzz(func(t *testing.T, data []byte, cacheSize uint16) {
+		cfg := StreamPackCfg{BufferSize: int(cacheSize) % 1024}
+		for _, info := range Encoders() {
+			enc, encoder := info.New(), info.ID
+			tokenizings := [][]Token{
+				TokenizeGreedy(enc, data, cfg),
+				TokenizeLazy(enc, data, false, cfg),
+				TokenizeLazy(enc, data, true, cfg),
+			}
+			for i, tokens := range tokenizings {
+				enc.Reset()
+				p := NewPackStream()
+				for _, tok := range tokens {
+					if err := enc.Encode(&tok, p, data); err != nil {
+						t.Fatalf("encoder %d, tokenizer %d: %v", encoder, i, err)
+					}
+				}
+				unpacked, err := enc.Decode(p.byteData)
+				if err != nil {
+					t.Fatalf("encoder %d, tokenizer %d: %v", encoder, i, err)
+				}
+				check(bytes.Equal(unpacked, data), t, "encoder %d, tokenizer %d: round trip differs", encoder, i)
+			}
+		}
+	})
+}
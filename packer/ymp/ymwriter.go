@@ -0,0 +1,61 @@
+package ymp
+
+import (
+	"io"
+	"strings"
+)
+
+// Create a YM3 file from register data: the "YM3!" header, then the
+// data for each register in turn.
+// YM3 has no other header fields, so the clock and frame rate are lost.
+func EncodeYM3(rawRegs *RawRegisters) []byte {
+	numFrames := len(rawRegs.Data[0])
+	output := make([]byte, 0, 4+NumYmRegs*numFrames)
+	output = append(output, "YM3!"...)
+	for reg := 0; reg < NumYmRegs; reg++ {
+		output = append(output, rawRegs.Data[reg]...)
+	}
+	return output
+}
+
+// Create an interleaved YM6 file from register data, keeping the
+// clock, frame rate, loop frame and the title/author/comment strings.
+// Registers 14 and 15 (special effects) are left empty.
+func EncodeYM6(rawRegs *RawRegisters) []byte {
+	numFrames := len(rawRegs.Data[0])
+	clockHz := rawRegs.ClockHz
+	if clockHz == 0 {
+		clockHz = defaultClockHz
+	}
+	playHz := rawRegs.PlayHz
+	if playHz == 0 {
+		playHz = defaultPlayHz
+	}
+
+	output := make([]byte, 0, 64+ym56NumRegs*numFrames)
+	output = append(output, "YM6!LeOnArD!"...)
+	output = EncLong(output, uint32(numFrames))
+	output = EncLong(output, ymAttrInterleaved)
+	output = EncWord(output, 0) // no digidrums
+	output = EncLong(output, uint32(clockHz))
+	output = EncWord(output, uint16(playHz))
+	output = EncLong(output, uint32(rawRegs.LoopFrame))
+	output = EncWord(output, 0) // no extra data
+	for _, s := range []string{rawRegs.Title, rawRegs.Author, rawRegs.Comment} {
+		output = append(output, strings.ReplaceAll(s, "\x00", "")...)
+		output = append(output, 0)
+	}
+	for reg := 0; reg < NumYmRegs; reg++ {
+		output = append(output, rawRegs.Data[reg]...)
+	}
+	for reg := NumYmRegs; reg < ym56NumRegs; reg++ {
+		output = append(output, make([]byte, numFrames)...)
+	}
+	return append(output, "End!"...)
+}
+
+// Write register data to w as a YM6 file.
+func WriteYM6(w io.Writer, rawRegs *RawRegisters) error {
+	_, err := w.Write(EncodeYM6(rawRegs))
+	return err
+}
@@ -1,6 +1,12 @@
 ; -----------------------------------------------------------------------
 ;	YMP PLAYER CODE
 ; -----------------------------------------------------------------------
+;
+; This only decodes files packed with the "v1" encoder (miny -encoder v1,
+; encoder ID 1 in the header), and with a big-endian header (version byte
+; 03h, from the default "-target st"). Files from other encoders need a
+; different depacker; "miny info" shows which encoder a file uses.
+;
 ; The number of packed data streams in the file.
 ; This is one less than the number of YM registers, since
 ; the Mixer register is encoded into the "volume" register
@@ -46,7 +52,7 @@ ymp_player_restart:
 	move.l	(a1)+,ymp_vbl_countdown(a0)
 
 	move.l	a1,ymp_register_list_ptr(a0)
-	; skip the register list and padding
+	; skip the register list and encoder ID (not checked)
 	lea	NUM_STREAMS+1(a1),a1
 
 	; Prime the read addresses for each reg
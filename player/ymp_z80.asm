@@ -0,0 +1,451 @@
+; -----------------------------------------------------------------------
+;	YMP PLAYER CODE (Z80 version)
+; -----------------------------------------------------------------------
+; Reference depacker for ZX Spectrum 128 and Amstrad CPC.
+;
+; This plays files packed with "-target spectrum" or "-target cpc", which
+; write the header words (cache size, frame count and cache set data)
+; in little-endian order. The version byte of these files is 083h.
+; Extended token lengths inside the packed data are still big-endian,
+; exactly as in the 68000 version.
+;
+; Only files packed with the "v1" encoder (miny -encoder v1, encoder ID 1
+; in the header) can be played. Other encoders need a different depacker.
+;
+; Define TARGET_CPC to non-zero for the Amstrad CPC, otherwise the
+; Spectrum 128 AY ports are used.
+;
+; Usage:
+;	ld	hl,tune_data
+;	ld	de,player_cache		; ds YMP cache size (from the header)
+;	call	ymp_player_init
+; then once per frame (e.g. from the interrupt):
+;	call	ymp_player_update
+;
+; All registers (including IX and IY) are trashed.
+; The mixer is always written with the I/O port bits (6 and 7) clear.
+
+		ifndef	TARGET_CPC
+TARGET_CPC	equ	0
+		endif
+
+YMP_NUM_STREAMS	equ	13
+
+; -----------------------------------------------------------------------
+; hl = start of packed ym data
+; de = start of player cache
+ymp_player_init:
+	ld	(ymp_tune_ptr),hl
+	ld	(ymp_cache_ptr),de
+ymp_player_restart:
+	ld	hl,(ymp_tune_ptr)
+	inc	hl				; skip 'Y'
+	inc	hl				; skip version
+	inc	hl				; skip cache size
+	inc	hl
+	ld	de,ymp_vbl_countdown		; 32-bit frame count
+	ld	bc,4
+	ldir
+	ld	(ymp_register_list_ptr),hl
+	ld	de,YMP_NUM_STREAMS+1		; skip the register list and encoder ID (not checked)
+	add	hl,de
+	ld	(ymp_sets_ptr),hl
+
+	; Prime the state for each stream
+	push	hl
+	ld	hl,ymp_streams_state
+	ld	b,YMP_NUM_STREAMS
+ymp_fill:
+	ld	(hl),0				; match read ptr
+	inc	hl
+	ld	(hl),0
+	inc	hl
+	ld	(hl),1				; copy count
+	inc	hl
+	ld	(hl),0
+	inc	hl
+	djnz	ymp_fill
+	pop	hl
+
+	; Calculate the set data
+	ld	ix,ymp_sets_state
+	ld	de,(ymp_cache_ptr)		; de = curr cache write point
+ymp_read_set:
+	ld	c,(hl)				; bc = size of set - 1
+	inc	hl
+	ld	b,(hl)
+	inc	hl
+	ld	a,b
+	and	c
+	inc	a				; 0ffffh terminates
+	jr	z,ymp_sets_read
+	ld	(ix+0),e			; cache base ptr
+	ld	(ix+1),d
+	ld	(ix+2),0			; cache offset
+	ld	(ix+3),0
+	inc	c				; c = streams in set
+	ld	a,(hl)				; read cache size per stream
+	inc	hl
+	push	hl
+	ld	h,(hl)
+	ld	l,a
+	ex	de,hl				; hl = cache ptr, de = size
+ymp_inc_cache_ptr:
+	add	hl,de
+	dec	c
+	jr	nz,ymp_inc_cache_ptr
+	ex	de,hl				; de = cache ptr
+	pop	hl
+	inc	hl
+	ld	bc,4
+	add	ix,bc				; on to next set
+	jr	ymp_read_set
+ymp_sets_read:
+	ld	(ymp_stream_read_ptr),hl	; setup packed data ptr
+	ret
+
+; -----------------------------------------------------------------------
+ymp_player_update:
+	ld	ix,ymp_streams_state		; ix = streams state
+	ld	iy,ymp_sets_state		; iy = set current data
+	ld	hl,ymp_output_buffer
+	ld	(ymp_output_ptr),hl
+	ld	hl,(ymp_sets_ptr)		; hl = static set info
+ymp_set_loop:
+	ld	c,(hl)				; c = registers in set - 1
+	inc	hl
+	ld	b,(hl)
+	inc	hl
+	ld	a,b
+	and	c
+	inc	a				; check end
+	jp	z,ymp_sets_done
+	ld	a,c
+	inc	a
+	ld	(ymp_set_count),a
+	ld	e,(hl)				; de = cache size for set
+	inc	hl
+	ld	d,(hl)
+	inc	hl
+	ld	(ymp_set_cache_size),de
+	push	hl
+
+	ld	l,(iy+0)			; hl = set cache base
+	ld	h,(iy+1)
+	push	hl
+	add	hl,de
+	ld	(ymp_cache_end),hl		; end of first stream's cache
+	pop	hl
+	ld	c,(iy+2)
+	ld	b,(iy+3)
+	add	hl,bc
+	ld	(ymp_cache_write),hl		; first stream's write ptr
+
+	;---------------------------------------------
+	; Register Loop
+ymp_register_loop:
+	ld	l,(ix+2)			; decrement copy count
+	ld	h,(ix+3)
+	dec	hl
+	ld	(ix+2),l
+	ld	(ix+3),h
+	ld	a,h
+	or	l
+	jp	nz,ymp_copy_one			; still in copying state
+
+	; Read the next token
+	ld	hl,(ymp_stream_read_ptr)
+	ld	a,(hl)
+	inc	hl
+	ld	c,a				; c = token type in bit 7
+	and	07fh
+	ld	e,a
+	ld	d,0
+	jr	nz,ymp_have_count
+	ld	d,(hl)				; extended count is big-endian
+	inc	hl
+	ld	e,(hl)
+	inc	hl
+ymp_have_count:
+	ld	(ix+2),e
+	ld	(ix+3),d
+	bit	7,c
+	jr	nz,ymp_literals
+
+	; Match code: read offset
+	ld	de,0
+ymp_read_offset:
+	ld	a,(hl)
+	inc	hl
+	or	a
+	jr	nz,ymp_offset_done
+	push	hl
+	ld	hl,255
+	add	hl,de
+	ex	de,hl
+	pop	hl
+	jr	ymp_read_offset
+ymp_offset_done:
+	add	a,e				; add final non-zero value
+	ld	e,a
+	jr	nc,ymp_offset_nc
+	inc	d
+ymp_offset_nc:
+	ld	(ymp_stream_read_ptr),hl
+
+	; Apply offset backwards from where we are writing
+	ld	hl,(ymp_cache_write)
+	ld	bc,(ymp_set_cache_size)
+	add	hl,bc				; add cache size
+	or	a
+	sbc	hl,de				; apply reverse offset
+	ld	de,(ymp_cache_end)
+	push	hl
+	or	a
+	sbc	hl,de				; past cache end?
+	pop	hl
+	jr	c,ymp_ptr_ok
+	sbc	hl,bc				; subtract cache size again (carry is clear)
+ymp_ptr_ok:
+	ld	(ix+0),l
+	ld	(ix+1),h
+	jr	ymp_copy_one
+
+ymp_literals:
+	; Literals code -- just a count
+	ld	(ix+0),l			; use the current packed stream address
+	ld	(ix+1),h
+	add	hl,de				; skip bytes in input stream
+	ld	(ymp_stream_read_ptr),hl
+	; Falls through to do the copy
+
+ymp_copy_one:
+	; Copy byte from either the cache or the literals in the stream
+	ld	l,(ix+0)
+	ld	h,(ix+1)
+	ld	a,(hl)				; a = output result
+	inc	hl
+	ld	de,(ymp_cache_write)
+	ld	(de),a				; add to cache
+	ld	c,a
+
+	; Handle the *read* pointer hitting the end of the cache
+	ld	de,(ymp_cache_end)
+	ld	a,l
+	cp	e
+	jr	nz,ymp_noloop_cache_read
+	ld	a,h
+	cp	d
+	jr	nz,ymp_noloop_cache_read
+	ld	de,(ymp_set_cache_size)
+	or	a
+	sbc	hl,de				; move back in cache
+ymp_noloop_cache_read:
+	ld	(ix+0),l
+	ld	(ix+1),h
+
+	ld	hl,(ymp_output_ptr)		; write to output buffer
+	ld	(hl),c
+	inc	hl
+	ld	(ymp_output_ptr),hl
+
+	; Move on to the next register
+	ld	de,(ymp_set_cache_size)
+	ld	hl,(ymp_cache_write)
+	add	hl,de
+	ld	(ymp_cache_write),hl
+	ld	hl,(ymp_cache_end)
+	add	hl,de
+	ld	(ymp_cache_end),hl
+	ld	de,4
+	add	ix,de				; next stream structure
+	ld	hl,ymp_set_count
+	dec	(hl)
+	jp	nz,ymp_register_loop
+	;---------------------------------------------
+
+	; Update and wrap the set offset
+	ld	l,(iy+2)
+	ld	h,(iy+3)
+	inc	hl
+	ld	de,(ymp_set_cache_size)
+	or	a
+	sbc	hl,de				; hit the cache size?
+	jr	z,ymp_no_cache_loop
+	add	hl,de
+ymp_no_cache_loop:
+	ld	(iy+2),l
+	ld	(iy+3),h
+	ld	de,4
+	add	iy,de
+	pop	hl
+	jp	ymp_set_loop
+
+ymp_sets_done:
+	; Write registers 0-6 inclusive
+	ld	hl,(ymp_register_list_ptr)
+	ld	d,0
+ymp_write_regs:
+	call	ymp_fetch
+	call	ay_write
+	inc	d
+	ld	a,d
+	cp	7
+	jr	nz,ymp_write_regs
+
+	; Fetch the volumes, which contain the mixer bits
+	call	ymp_fetch
+	ld	a,e
+	ld	(ymp_volumes),a
+	call	ymp_fetch
+	ld	a,e
+	ld	(ymp_volumes+1),a
+	call	ymp_fetch
+	ld	a,e
+	ld	(ymp_volumes+2),a
+	push	hl
+
+	; Accumulate mixer from the top bits of each volume.
+	; First the noise enable bits (bit 7), then square (bit 6)
+	ld	c,0
+	ld	a,(ymp_volumes+2)
+	rla
+	rl	c
+	ld	a,(ymp_volumes+1)
+	rla
+	rl	c
+	ld	a,(ymp_volumes)
+	rla
+	rl	c
+	ld	a,(ymp_volumes+2)
+	rla
+	rla
+	rl	c
+	ld	a,(ymp_volumes+1)
+	rla
+	rla
+	rl	c
+	ld	a,(ymp_volumes)
+	rla
+	rla
+	rl	c
+	ld	e,c
+	ld	d,7
+	call	ay_write
+
+	; Now 8,9,10 without the mixer bits
+	ld	a,(ymp_volumes)
+	and	01fh
+	ld	e,a
+	ld	d,8
+	call	ay_write
+	ld	a,(ymp_volumes+1)
+	and	01fh
+	ld	e,a
+	ld	d,9
+	call	ay_write
+	ld	a,(ymp_volumes+2)
+	and	01fh
+	ld	e,a
+	ld	d,10
+	call	ay_write
+	pop	hl
+
+	; 11, 12
+	ld	d,11
+	call	ymp_fetch
+	call	ay_write
+	ld	d,12
+	call	ymp_fetch
+	call	ay_write
+
+	; Reg 13 - buzzer envelope
+	call	ymp_fetch			; Buzzer envelope register is special case,
+	ld	a,e
+	cp	0ffh				; only write if value is not -1
+	jr	z,ymp_skip_env			; since writing re-starts the envelope
+	ld	d,13
+	call	ay_write
+ymp_skip_env:
+
+	; Check for tune restart (32-bit countdown)
+	ld	hl,(ymp_vbl_countdown)
+	ld	a,h
+	or	l
+	jr	nz,ymp_countdown_lo
+	ld	de,(ymp_vbl_countdown+2)
+	dec	de
+	ld	(ymp_vbl_countdown+2),de
+ymp_countdown_lo:
+	dec	hl
+	ld	(ymp_vbl_countdown),hl
+	ld	a,h
+	or	l
+	ret	nz
+	ld	hl,(ymp_vbl_countdown+2)
+	ld	a,h
+	or	l
+	ret	nz
+	jp	ymp_player_restart
+
+; Fetch the output value for the next register in the remap table
+; hl = remap table pointer (incremented)
+; e = output value
+ymp_fetch:
+	ld	a,(hl)
+	inc	hl
+	push	hl
+	ld	hl,ymp_output_buffer
+	add	a,l
+	ld	l,a
+	adc	a,h
+	sub	l
+	ld	h,a
+	ld	e,(hl)
+	pop	hl
+	ret
+
+; Write a single AY register
+; d = register, e = value
+; Trashes a, bc
+ay_write:
+		if	TARGET_CPC
+	ld	b,0f4h				; PPI port A = register number
+	out	(c),d
+	ld	bc,0f6c0h			; select register
+	out	(c),c
+	ld	bc,0f600h			; inactive
+	out	(c),c
+	ld	b,0f4h				; PPI port A = value
+	out	(c),e
+	ld	bc,0f680h			; write value
+	out	(c),c
+	ld	bc,0f600h			; inactive
+	out	(c),c
+		else
+	ld	bc,0fffdh			; register select port
+	out	(c),d
+	ld	b,0bfh				; data port 0bffdh
+	out	(c),e
+		endif
+	ret
+
+; -----------------------------------------------------------------------
+; Player state
+ymp_tune_ptr:		dw	0
+ymp_cache_ptr:		dw	0
+ymp_register_list_ptr:	dw	0
+ymp_sets_ptr:		dw	0
+ymp_stream_read_ptr:	dw	0		; position in packed data we are reading from
+ymp_vbl_countdown:	dw	0,0		; number of VBLs left to restart
+ymp_streams_state:	ds	4*YMP_NUM_STREAMS	; match read ptr, copy count
+ymp_sets_state:		ds	4*YMP_NUM_STREAMS	; cache base ptr, cache offset
+ymp_output_buffer:	ds	YMP_NUM_STREAMS
+ymp_volumes:		ds	3
+
+; Temporaries during the update
+ymp_output_ptr:		dw	0
+ymp_set_count:		db	0
+ymp_set_cache_size:	dw	0
+ymp_cache_write:	dw	0
+ymp_cache_end:		dw	0